@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/router"
+)
+
+// ServeAdmin serve the admin API, eg:
+//
+//	curl -X POST http://127.0.0.1:7777/flush/dns
+//	curl http://127.0.0.1:7777/rules/hits
+//	curl http://127.0.0.1:7777/dns/queries?name=google
+func ServeAdmin(ln net.Listener, r *router.Router) {
+	mux := http.NewServeMux()
+	actions := map[string]func(){
+		"/flush/dns":     r.FlushDNSCache,
+		"/flush/learned": r.ResetLearnedRules,
+		"/flush/access":  r.FlushAccessCache,
+		"/flush/verdict": r.FlushVerdicts,
+		"/flush/hits":    r.ResetRuleHits,
+		"/flush/fakeip":  r.ResetFakeIP,
+	}
+	actions["/flush/all"] = func() {
+		r.FlushDNSCache()
+		r.ResetLearnedRules()
+		r.FlushAccessCache()
+		r.FlushVerdicts()
+		r.ResetFakeIP()
+	}
+
+	for path, action := range actions {
+		path, action := path, action
+		mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			action()
+			log.Info().
+				Str("path", path).
+				Str("from", req.RemoteAddr).
+				Msg("admin action")
+			_, _ = w.Write([]byte("ok\n"))
+		})
+	}
+
+	// the match counts of the rules by the connections and the DNS queries,
+	// to prune the dead rules
+	mux.HandleFunc("/rules/hits", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "CONNS\tQUERIES\tKIND\tRULE\n")
+		for _, hit := range r.RuleHits() {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", hit.Conns, hit.Queries, hit.Kind, hit.Rule)
+		}
+	})
+
+	// the latest DNS queries with the verdicts, filtered by the name substring
+	mux.HandleFunc("/dns/queries", func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("name")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, q := range r.DNSQueries() {
+			if name != "" && !strings.Contains(q.Name, name) {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", q.Time.Format(time.RFC3339), q.Client,
+				q.Name, q.Type, q.Verdict, q.Rcode, strings.Join(q.Answer, ","), q.Latency.Round(time.Microsecond))
+		}
+	})
+
+	if err := http.Serve(ln, mux); err != nil && !isClosed(err) {
+		log.Error().Err(err).Msg("serve admin")
+	}
+}
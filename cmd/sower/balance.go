@@ -0,0 +1,267 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/router"
+)
+
+// defaultRemote is the tag of conf.Remote in the balance weights
+const defaultRemote = "default"
+
+// balancer spread the proxy routed connections across the remotes, the
+// remotes failed to dial are skipped until the health check passes
+type balancer struct {
+	policy    string
+	members   []*member
+	tolerance time.Duration
+
+	mu       sync.Mutex
+	selected *member // fastest remote of url-test
+}
+
+type member struct {
+	tag    string
+	dial   router.ProxyDialFn
+	weight int
+
+	current int   // smooth weighted round-robin state
+	conns   int64 // active connections
+	down    atomic.Bool
+	delay   atomic.Int64 // latency of url-test, 0 for unknown
+}
+
+// newBalancer create the balancer on the remotes in the order of tags,
+// weights are formatted as '<tag> <weight>'
+func newBalancer(policy string, weights []string,
+	tags []string, dials map[string]router.ProxyDialFn) (*balancer, error) {
+
+	switch policy {
+	case "round-robin", "least-conn", "failover", "url-test":
+	default:
+		return nil, errors.Errorf("unknown balance policy: %s", policy)
+	}
+
+	weightOf := map[string]int{}
+	for _, w := range weights {
+		tag, val, _ := strings.Cut(strings.TrimSpace(w), " ")
+		weight, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || weight < 0 {
+			return nil, errors.Errorf("invalid balance weight: %s", w)
+		}
+		if _, ok := dials[tag]; !ok {
+			return nil, errors.Errorf("unknown remote of balance weight: %s", w)
+		}
+		weightOf[tag] = weight
+	}
+
+	b := &balancer{policy: policy}
+	for _, tag := range tags {
+		weight, ok := weightOf[tag]
+		if !ok {
+			weight = 1
+		}
+		if weight > 0 {
+			b.members = append(b.members, &member{tag: tag, dial: dials[tag], weight: weight})
+		}
+	}
+	if len(b.members) == 0 {
+		return nil, errors.New("no remote to balance")
+	}
+	return b, nil
+}
+
+// dial through the picked remote, retry the others if failed
+func (b *balancer) dial(network, host string, port uint16) (net.Conn, error) {
+	tried := make(map[*member]bool, len(b.members))
+	var err error
+	for m := b.pick(tried); m != nil; m = b.pick(tried) {
+		tried[m] = true
+
+		atomic.AddInt64(&m.conns, 1)
+		var conn net.Conn
+		if conn, err = m.dial(network, host, port); err == nil {
+			m.down.Store(false)
+			return &countedConn{Conn: conn, conns: &m.conns}, nil
+		}
+
+		atomic.AddInt64(&m.conns, -1)
+		if isTargetErr(err) { // the remote is alive, the target fails anyway
+			m.down.Store(false)
+			return nil, errors.Wrapf(err, "remote (%s)", m.tag)
+		}
+		err = errors.Wrapf(err, "remote (%s)", m.tag)
+		if !m.down.Swap(true) {
+			log.Warn().Err(err).Msg("remote down, fail over to the others")
+		}
+	}
+	return nil, err
+}
+
+// pick the remote by policy from the untried ones, the healthy first
+func (b *balancer) pick(tried map[*member]bool) *member {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	candidates := make([]*member, 0, len(b.members))
+	for _, m := range b.members {
+		if !tried[m] && !m.down.Load() {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, m := range b.members {
+			if !tried[m] {
+				candidates = append(candidates, m)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var best *member
+	switch b.policy {
+	case "failover":
+		return candidates[0]
+
+	case "url-test":
+		for _, m := range candidates {
+			if best == nil || delayOf(m) < delayOf(best) {
+				best = m
+			}
+		}
+		// keep the selected one unless the fastest is better beyond tolerance
+		for _, m := range candidates {
+			if m == b.selected && delayOf(best)+int64(b.tolerance) >= delayOf(m) {
+				return m
+			}
+		}
+		b.selected = best
+		return best
+
+	case "least-conn":
+		for _, m := range candidates {
+			// conns/weight < best.conns/best.weight
+			if best == nil || atomic.LoadInt64(&m.conns)*int64(best.weight) <
+				atomic.LoadInt64(&best.conns)*int64(m.weight) {
+				best = m
+			}
+		}
+		return best
+	}
+
+	total := 0
+	for _, m := range candidates {
+		m.current += m.weight
+		total += m.weight
+		if best == nil || m.current > best.current {
+			best = m
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// healthCheck probe the remotes by dialing the probe address through them,
+// the url-test policy fetch the probe URL instead and record the latency
+func (b *balancer) healthCheck(interval time.Duration, probe, probeURL string) error {
+	host, portStr, err := net.SplitHostPort(probe)
+	if err != nil {
+		return errors.Wrapf(err, "probe address (%s)", probe)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return errors.Wrapf(err, "probe address (%s)", probe)
+	}
+
+	check := func() {
+		for _, m := range b.members {
+			if b.policy == "url-test" {
+				go b.urlTest(m, probeURL)
+			} else {
+				go b.probe(m, host, uint16(port))
+			}
+		}
+	}
+	go func() {
+		check()
+		for range time.Tick(interval) {
+			check()
+		}
+	}()
+	return nil
+}
+
+func (b *balancer) probe(m *member, host string, port uint16) {
+	conn, err := m.dial("tcp", host, port)
+	if err == nil {
+		conn.Close()
+	}
+	b.setDown(m, err)
+}
+
+// urlTest fetch the URL through the remote, the latency is the time to
+// receive the response header
+func (b *balancer) urlTest(m *member, probeURL string) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			Dial: func(network, addr string) (net.Conn, error) {
+				host, portStr, _ := net.SplitHostPort(addr)
+				port, _ := strconv.ParseUint(portStr, 10, 16)
+				return m.dial("tcp", host, uint16(port))
+			},
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Get(probeURL)
+	if err == nil {
+		resp.Body.Close()
+		m.delay.Store(int64(time.Since(start)))
+	} else {
+		m.delay.Store(0)
+	}
+	b.setDown(m, err)
+}
+
+func (b *balancer) setDown(m *member, err error) {
+	if down := err != nil; m.down.Swap(down) != down {
+		log.Info().Err(err).
+			Str("remote", m.tag).
+			Bool("down", down).
+			Msg("remote health changed")
+	}
+}
+
+// delayOf return the url-test latency, the unknown one is the slowest
+func delayOf(m *member) int64 {
+	if d := m.delay.Load(); d > 0 {
+		return d
+	}
+	return math.MaxInt64 / 2
+}
+
+// countedConn decrease the active connections of the remote once closed
+type countedConn struct {
+	net.Conn
+	conns *int64
+	once  sync.Once
+}
+
+func (c *countedConn) NetConn() net.Conn { return c.Conn }
+func (c *countedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(c.conns, -1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/wweir/sower/pkg/relay"
+	"github.com/wweir/sower/router"
+)
+
+func TestBalancer_HalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// echo server, reply after the request is fully read
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, _ := io.ReadAll(conn)
+		conn.Write(append(req, " done"...))
+	}()
+
+	dial := func(network, host string, port uint16) (net.Conn, error) {
+		return net.Dial(network, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+	b, err := newBalancer("round-robin", nil, []string{defaultRemote},
+		map[string]router.ProxyDialFn{defaultRemote: dial})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyLn.Close()
+	go func() {
+		conn, err := proxyLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		addr := ln.Addr().(*net.TCPAddr)
+		rc, err := b.dial("tcp", addr.IP.String(), uint16(addr.Port))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer rc.Close()
+		relay.Relay(conn, rc)
+	}()
+
+	conn, err := net.Dial("tcp", proxyLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	conn.(*net.TCPConn).CloseWrite()
+	resp, _ := io.ReadAll(conn)
+	if string(resp) != "ping done" {
+		t.Errorf("unexpected response: %q", resp)
+	}
+}
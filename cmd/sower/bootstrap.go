@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/pkg/dialer"
+	"github.com/wweir/sower/pkg/doh"
+)
+
+// bootstrap resolve the domain of remote by the clean IPs, DoH or DoT,
+// instead of the possibly poisoned system resolver
+type bootstrap struct {
+	domain, port string
+	doh, dot     string
+
+	mu     sync.Mutex
+	ips    []string
+	next   int
+	expire time.Time
+}
+
+// bootstrapConfig is the options to resolve the remote domain
+type bootstrapConfig struct {
+	IPs []string `usage:"clean IPs of the remote domain, used in turn, eg: 1.2.3.4"`
+	DoH string   `usage:"DoH server to resolve the remote domain, eg: https://1.1.1.1/dns-query"`
+	DoT string   `usage:"DoT server to resolve the remote domain, eg: 1.1.1.1:853"`
+}
+
+// newBootstrap return nil if the host of addr is IP or bootstrap not configured
+func newBootstrap(cfg *bootstrapConfig, addr, defaultPort string) *bootstrap {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, defaultPort
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	b := &bootstrap{domain: host, port: port, doh: cfg.DoH, dot: cfg.DoT}
+	switch {
+	case len(cfg.IPs) != 0:
+		b.ips = cfg.IPs
+		b.expire = time.Unix(1<<62, 0)
+	case cfg.DoH != "", cfg.DoT != "":
+	default:
+		return nil
+	}
+	return b
+}
+
+// addr return the remote address with the domain resolved, the IPs are used
+// in turn so that a failed one is skipped by the next dial
+func (b *bootstrap) addr() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Now().After(b.expire) {
+		ips, ttl, err := b.lookup()
+		switch {
+		case err == nil:
+			b.ips, b.expire = ips, time.Now().Add(ttl)
+		case len(b.ips) != 0:
+			log.Warn().Err(err).Str("domain", b.domain).Msg("bootstrap remote, use the stale IPs")
+		default:
+			return "", errors.Wrapf(err, "bootstrap remote (%s)", b.domain)
+		}
+	}
+
+	b.next = (b.next + 1) % len(b.ips)
+	return net.JoinHostPort(b.ips[b.next], b.port), nil
+}
+
+func (b *bootstrap) lookup() ([]string, time.Duration, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(b.domain), dns.TypeA)
+
+	var r *dns.Msg
+	var err error
+	if b.doh != "" {
+		r, err = doh.Exchange(&http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.New(0).DialContext},
+		}, b.doh, m)
+	} else {
+		client := &dns.Client{Net: "tcp-tls", Dialer: dialer.New(5 * time.Second)}
+		r, _, err = client.Exchange(m, b.dot)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ips []string
+	ttl := uint32(3600)
+	for _, rr := range r.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ips = append(ips, a.A.String())
+			if a.Hdr.Ttl < ttl {
+				ttl = a.Hdr.Ttl
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, errors.Errorf("no A record, rcode: %s", dns.RcodeToString[r.Rcode])
+	}
+	if ttl < 60 {
+		ttl = 60
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/pkg/doh"
+	"github.com/wweir/sower/router"
+)
+
+// dohConfig is the DoH endpoint served on the HTTPS listener
+type dohConfig struct {
+	Name string `usage:"SNI of the DoH endpoint '/dns-query' on port 443, eg: dns.sower.lan, empty to disable"`
+	Cert string `usage:"certificate file of the DoH endpoint"`
+	Key  string `usage:"private key file of the DoH endpoint"`
+}
+
+// dotConfig is the DoT listener, eg: for the Android Private DNS
+type dotConfig struct {
+	Addr string `usage:"DoT listen address, eg: :853, empty to disable"`
+	Cert string `usage:"certificate file of the DoT listener"`
+	Key  string `usage:"private key file of the DoT listener"`
+}
+
+// dotTLSConfig load the certificate of the DoT listener
+func dotTLSConfig(cfg *dotConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "load DoT certificate")
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// dohEndpoint, if set, serve the HTTPS connections of its SNI as DoH
+var dohEndpoint *dohServer
+
+// dohServer terminate the TLS of the connections handed over by the HTTPS
+// listener, and serve '/dns-query' by the router
+type dohServer struct {
+	name  string
+	conf  *tls.Config
+	conns chan net.Conn
+	done  sync.Map // *tls.Conn -> chan struct{}
+}
+
+func newDoHServer(cfg *dohConfig, r *router.Router) (*dohServer, error) {
+	if cfg.Name == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "load DoH certificate")
+	}
+
+	s := &dohServer{
+		name: cfg.Name,
+		conf: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		},
+		conns: make(chan net.Conn),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", doh.NewHandler(r))
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				if done, ok := s.done.LoadAndDelete(conn); ok {
+					close(done.(chan struct{}))
+				}
+			}
+		},
+	}
+	go srv.Serve(s)
+	return s, nil
+}
+
+// serve the connection, return after it closed
+func (s *dohServer) serve(conn net.Conn) {
+	tc := tls.Server(conn, s.conf)
+	done := make(chan struct{})
+	s.done.Store(tc, done)
+	s.conns <- tc
+	<-done
+}
+
+// Accept, Close and Addr implement net.Listener for the HTTP server
+func (s *dohServer) Accept() (net.Conn, error) { return <-s.conns, nil }
+func (s *dohServer) Close() error              { return nil }
+func (s *dohServer) Addr() net.Addr            { return &net.TCPAddr{} }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/pkg/dialer"
+	"github.com/wweir/sower/pkg/doh"
+)
+
+// echConfig hold the ECH config list of the remote, fetched from HTTPS RR lazily
+type echConfig struct {
+	sync.Mutex
+	domain string
+	doh    string
+	list   []byte
+}
+
+func newECHConfig(domain, configList, doh string) (*echConfig, error) {
+	c := &echConfig{domain: domain, doh: doh}
+	if configList != "" {
+		list, err := base64.StdEncoding.DecodeString(configList)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode ECH config list")
+		}
+		c.list = list
+	}
+	return c, nil
+}
+
+func (c *echConfig) get() ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.list != nil {
+		return c.list, nil
+	}
+
+	list, err := lookupECHConfig(c.domain, c.doh)
+	if err != nil {
+		return nil, err
+	}
+	c.list = list
+	return list, nil
+}
+
+func (c *echConfig) set(list []byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.list = list
+}
+
+// lookupECHConfig query the HTTPS RR of domain by DoH or the fallback DNS
+func lookupECHConfig(domain, dohURL string) ([]byte, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), dns.TypeHTTPS)
+
+	var r *dns.Msg
+	var err error
+	if dohURL != "" {
+		r, err = doh.Exchange(&http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.New(0).DialContext},
+		}, dohURL, m)
+	} else {
+		var conn net.Conn
+		if conn, err = dialer.DialTimeout("udp", net.JoinHostPort(conf.DNS.Fallback, "53"), 5*time.Second); err == nil {
+			defer conn.Close()
+			client := &dns.Client{Timeout: 5 * time.Second}
+			r, _, err = client.ExchangeWithConn(m, &dns.Conn{Conn: conn})
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "query HTTPS RR")
+	}
+
+	for _, rr := range r.Answer {
+		https, ok := rr.(*dns.HTTPS)
+		if !ok {
+			continue
+		}
+		for _, kv := range https.Value {
+			if ech, ok := kv.(*dns.SVCBECHConfig); ok {
+				return ech.ECH, nil
+			}
+		}
+	}
+	return nil, errors.Errorf("no ECH config found for %s", domain)
+}
+
+// dialECH dial by TLS with ECH, retry once with the configs offered by server
+func dialECH(addr string, tlsCfg *tls.Config, ech *echConfig) (net.Conn, error) {
+	list, err := ech.get()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := tlsCfg.Clone()
+	cfg.EncryptedClientHelloConfigList = list
+	conn, err := tls.DialWithDialer(dialer.Remote(0), "tcp", addr, cfg)
+
+	var rejectErr *tls.ECHRejectionError
+	if errors.As(err, &rejectErr) && len(rejectErr.RetryConfigList) != 0 {
+		ech.set(rejectErr.RetryConfigList)
+		cfg.EncryptedClientHelloConfigList = rejectErr.RetryConfigList
+		conn, err = tls.DialWithDialer(dialer.Remote(0), "tcp", addr, cfg)
+	}
+	return conn, err
+}
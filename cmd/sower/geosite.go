@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/pkg/geosite"
+	"github.com/wweir/sower/router"
+)
+
+// geoSiteData is the geosite.dat, loaded once the geosite rules are used
+var geoSiteData struct {
+	once sync.Once
+	data []byte
+}
+
+// expandGeoSite expand the geosite rules into the domain rules,
+// eg: 'geosite:cn', 'geosite:cn@ads', '>>us geosite:netflix'
+func expandGeoSite(proxyDial router.ProxyDialFn, rules []string) []string {
+	expanded := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		prefix, body := "", rule
+		if strings.HasPrefix(rule, ">>") {
+			tag, domain, _ := strings.Cut(rule, " ")
+			prefix, body = tag+" ", strings.TrimSpace(domain)
+		}
+
+		code, ok := strings.CutPrefix(body, "geosite:")
+		if !ok {
+			expanded = append(expanded, rule)
+			continue
+		}
+
+		domains, err := geosite.Parse(loadGeoSite(proxyDial), code)
+		if err != nil {
+			log.Error().Err(err).Str("rule", rule).Msg("expand geosite rule")
+			continue
+		}
+		for _, d := range domains {
+			switch d.Type {
+			case geosite.Plain:
+				expanded = append(expanded, prefix+"kw:"+d.Value)
+			case geosite.Regex:
+				expanded = append(expanded, prefix+"re:"+d.Value)
+			case geosite.RootDomain:
+				expanded = append(expanded, prefix+"**."+d.Value)
+			case geosite.Full:
+				expanded = append(expanded, prefix+d.Value)
+			}
+		}
+	}
+	return expanded
+}
+
+func loadGeoSite(proxyDial router.ProxyDialFn) []byte {
+	geoSiteData.once.Do(func() {
+		rc, err := openFile(proxyDial, conf.Router.GeoSite)
+		if err != nil {
+			log.Fatal().Err(err).
+				Str("file", conf.Router.GeoSite).
+				Msg("load geosite file")
+		}
+		defer rc.Close()
+
+		if geoSiteData.data, err = io.ReadAll(rc); err != nil {
+			log.Fatal().Err(err).
+				Str("file", conf.Router.GeoSite).
+				Msg("read geosite file")
+		}
+	})
+	return geoSiteData.data
+}
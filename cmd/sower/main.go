@@ -1,93 +1,297 @@
 package main
 
 import (
-	"bufio"
-	"io"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cristalhq/aconfig"
 	"github.com/cristalhq/aconfig/aconfighcl"
 	"github.com/cristalhq/aconfig/aconfigtoml"
 	"github.com/cristalhq/aconfig/aconfigyaml"
-	"github.com/miekg/dns"
-	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog"
 	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/pkg/dialer"
+	"github.com/wweir/sower/pkg/guard"
+	"github.com/wweir/sower/pkg/logthrottle"
+	"github.com/wweir/sower/pkg/netwatch"
 	"github.com/wweir/sower/router"
 )
 
+// remoteConfig is the options of a remote proxy
+type remoteConfig struct {
+	Type        string   `default:"sower" required:"true" usage:"option: sower/trojan/shadowsocks/vmess/snell/h2/naive/http/socks5/sshd"`
+	Addr        string   `required:"true" usage:"proxy address, eg: proxy.com/proxy.com:8443/127.0.0.1:7890, sshd accepts a jump chain: bastion.com:22,user@inner:22"`
+	User        string   `usage:"remote proxy user"`
+	Password    string   `usage:"remote proxy password"`
+	ClientID    string   `usage:"client identifier sent to sower server, eg: device name"`
+	Path        string   `usage:"websocket path for sower/trojan, eg: /ws, empty to disable websocket"`
+	Host        string   `usage:"websocket Host header override, eg: the domain behind CDN"`
+	SNI         string   `usage:"TLS server name of sower/trojan remote, default to the domain of Addr"`
+	ConnectAddr string   `usage:"TCP address to connect for sower/trojan, default to Addr, eg: 1.2.3.4:443"`
+	PinSHA256   []string `usage:"pinned base64 SHA256 of the remote certificate SPKI for sower/trojan, any matched in chain"`
+	CertFile    string   `usage:"TLS client certificate for sower/trojan remote, pairs with KeyFile"`
+	CAFile      string   `usage:"CA file to verify sower/trojan remote, eg: a private CA"`
+	UUID        string   `usage:"vmess user id, alterId=0 (AEAD) only"`
+	Cipher      string   `default:"chacha20-ietf-poly1305" usage:"shadowsocks cipher, option: chacha20-ietf-poly1305/aes-256-gcm/aes-128-gcm"`
+	Version     int      `default:"2" usage:"snell protocol version, option: 1/2/3"`
+	Obfs        []string `usage:"obfuscation wrappers stacked under the proxy protocol in order, option: http/tls"`
+	ObfsHost    string   `default:"bing.com" usage:"host disguised by the obfuscation wrappers"`
+	Plugin      string   `usage:"SIP003 plugin binary for shadowsocks/vmess/snell/http/socks5, eg: v2ray-plugin"`
+	PluginOpts  string   `usage:"SIP003 plugin options, eg: tls;host=proxy.com"`
+
+	KeyFile    string        `usage:"private key file, for sshd publickey auth or the TLS client certificate"`
+	Passphrase string        `usage:"passphrase of the sshd private key"`
+	Agent      bool          `default:"false" usage:"auth sshd by the ssh-agent of SSH_AUTH_SOCK"`
+	KnownHosts string        `usage:"known_hosts file to verify sshd host key, eg: /root/.ssh/known_hosts"`
+	HostKey    string        `usage:"pinned sshd host key fingerprint or public key, one per hop of the jump chain separated by comma, eg: SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"`
+	KeepAlive  time.Duration `default:"30s" usage:"sshd keepalive interval, 0 to disable"`
+	MPTCP      bool          `default:"false" usage:"multipath TCP on remote dials, fallback to TCP if unsupported"`
+
+	Breaker struct {
+		Threshold   int           `default:"5" usage:"continuous failures to open the breaker, 0 to disable"`
+		Cooldown    time.Duration `default:"1s" usage:"initial cooldown of an opened breaker"`
+		MaxCooldown time.Duration `default:"1m" usage:"max cooldown of an opened breaker"`
+	}
+	ECH struct {
+		Enable     bool   `default:"false" usage:"encrypted client hello for sower/trojan, config is fetched from the HTTPS RR of remote"`
+		ConfigList string `usage:"base64 encoded ECH config list, skip fetching HTTPS RR"`
+		DoH        string `usage:"DoH server to fetch HTTPS RR, eg: https://1.1.1.1/dns-query, empty to use fallback dns"`
+	}
+	Bootstrap bootstrapConfig
+	PreDial   struct {
+		Size    int           `default:"0" usage:"remote connections dialed in advance, 0 to disable, ignored with mux"`
+		MaxIdle time.Duration `default:"30s" usage:"drop the pre-dialed connections idle for longer"`
+	}
+	Mux struct {
+		Enable     bool `default:"false" usage:"multiplex connections over shared remote connections, sower/trojan only"`
+		MaxStreams int  `default:"16" usage:"max streams in one remote connection, 0 for unlimited"`
+	}
+}
+
 var (
 	version, date string
 
-	conf = struct {
-		Remote struct {
-			Type     string `default:"sower" required:"true" usage:"option: sower/trojan/socks5/sshd"`
-			Addr     string `required:"true" usage:"proxy address, eg: proxy.com/127.0.0.1:7890"`
-			User     string `usage:"remote proxy user"`
-			Password string `usage:"remote proxy password"`
-		}
-
-		DNS struct {
-			Disable  bool   `default:"false" usage:"disable DNS proxy"`
-			Serve    string `default:"127.0.0.1" required:"true" usage:"dns server ip"`
-			Fallback string `default:"223.5.5.5" usage:"fallback dns server"`
-		}
-		Socks5 struct {
-			Disable bool   `default:"false" usage:"disable sock5 proxy"`
-			Addr    string `default:":1080" usage:"socks5 listen address"`
-		} `flag:"socks5"`
-
-		Router struct {
-			Block struct {
-				File       string   `usage:"block list file, local file or remote"`
-				FilePrefix string   `default:"**." usage:"parsed as '<prefix>line_text'"`
-				Rules      []string `usage:"block list rules"`
-			}
-			Direct struct {
-				File       string   `usage:"direct list file, local file or remote"`
-				FilePrefix string   `default:"**." usage:"parsed as '<prefix>line_text'"`
-				Rules      []string `usage:"direct list rules"`
-			}
-			Proxy struct {
-				File       string   `usage:"proxy list file, local file or remote"`
-				FilePrefix string   `default:"**." usage:"parsed as '<prefix>line_text'"`
-				Rules      []string `usage:"proxy list rules"`
-			}
+	// remotes is the named remotes parsed from conf.Remotes, in the order of remoteTags
+	remotes    map[string]*remoteConfig
+	remoteTags []string
 
-			Country struct {
-				MMDB       string   `usage:"mmdb file"`
-				File       string   `usage:"CIDR block list file, local file or remote"`
-				FilePrefix string   `default:"" usage:"parsed as '<prefix>line_text'"`
-				Rules      []string `usage:"CIDR list rules"`
-			}
-		}
-	}{}
+	conf       config
+	configFile string
+	// cmdArgs is the subcommand and its arguments after the flags
+	cmdArgs []string
+	// builtinDirectRules is the reverse zones and the remote hosts, always direct
+	builtinDirectRules []string
 )
 
-func init() {
-	if err := aconfig.LoaderFor(&conf, aconfig.Config{
-		AllowUnknownFields: true,
-		FileFlag:           "f",
-		FileDecoders: map[string]aconfig.FileDecoder{
-			".yml":  aconfigyaml.New(),
-			".yaml": aconfigyaml.New(),
-			".toml": aconfigtoml.New(),
-			".hcl":  aconfighcl.New(),
-		},
-	}).Load(); err != nil {
+type config struct {
+	Remote  remoteConfig
+	Remotes []string `usage:"named remotes inheriting the options of Remote, format: '<tag> <type>://[user[:password]@]addr[?<option>=<value>]', eg: 'us trojan://pass@us.proxy.com?sni=cdn.com'"`
+
+	Balance struct {
+		Policy    string        `usage:"balance the untagged proxy traffic across Remote and Remotes, option: round-robin/least-conn/failover/url-test, empty to disable"`
+		Weights   []string      `usage:"remote weights, format: '<tag> <weight>', Remote is tagged 'default', 0 to exclude, eg: 'us 2'"`
+		Interval  time.Duration `default:"30s" usage:"interval to health check the remotes, 0 to disable"`
+		Probe     string        `default:"www.gstatic.com:443" usage:"address dialed through the remotes to health check"`
+		URL       string        `default:"http://www.gstatic.com/generate_204" usage:"URL fetched through the remotes by url-test"`
+		Tolerance time.Duration `default:"50ms" usage:"url-test switch to a faster remote only if it is faster beyond the tolerance"`
+	}
+
+	DNS struct {
+		Disable  bool   `default:"false" usage:"disable DNS proxy"`
+		Serve    string `default:"127.0.0.1" required:"true" usage:"dns server ip"`
+		Serve6   string `flag:"serve6" usage:"IPv6 serve IP answering the AAAA of the proxied domains, also listen to the HTTP and HTTPS ports of it"`
+		Fallback string `default:"223.5.5.5" usage:"fallback dns server, a DoH / DoT server replace the system DNS, eg: https://223.5.5.5/dns-query, tls://1.1.1.1:853"`
+		ViaProxy bool   `default:"false" usage:"resolve by the DoH / DoT fallback through the proxy"`
+		ECS      string `default:"forward" usage:"EDNS Client Subnet of the direct queries, option: forward/strip or a CIDR to override, eg: 1.2.3.0/24"`
+		DNSSEC   bool   `default:"false" usage:"verify the RRSIG of the signed answers by the DNSKEY of the signer, without the chain of trust"`
+		Proxied  string `usage:"resolve the proxied domains through the proxy by the DoH, DoT or DNS over TCP server, eg: tls://8.8.8.8, empty to use the fallback"`
+
+		Ports struct {
+			DNS   int `default:"53" usage:"DNS port of the serve IP, 0 to disable"`
+			HTTP  int `default:"80" usage:"HTTP port of the serve IPs, 0 to disable"`
+			HTTPS int `default:"443" usage:"HTTPS port of the serve IPs, 0 to disable"`
+		}
+
+		Hosts     []string `usage:"static hosts answered before routing, format: '<IP> <host> [<host>...]', eg: '192.168.1.2 nas.lan'"`
+		HostsFile string   `usage:"hosts file answered before routing, eg: /etc/hosts"`
+		Forwards  []string `usage:"resolvers of domain suffixes asked directly ahead of routing, format: '<suffix> <server>', eg: 'corp.internal 10.0.0.2'"`
+
+		Poison struct {
+			Upstream string        `usage:"DoH / DoT upstream resolving the poisoned answers of the system DNS again, empty to disable, eg: https://1.1.1.1/dns-query"`
+			Bogus    []string      `usage:"IPs or CIDRs of the poisoned answers, eg: 243.185.187.39"`
+			MinRTT   time.Duration `default:"0s" usage:"answers arrived faster are taken as poisoned, 0 to disable"`
+		}
+
+		QueryLog int `default:"0" usage:"latest DNS queries kept with the verdicts for the admin API /dns/queries, 0 to disable"`
+
+		FakeIP string `usage:"answer the proxied and unmatched domains by the addresses of the pool, eg: 198.18.0.0/15, the host itself should not resolve by sower"`
+
+		DoH dohConfig `flag:"doh"`
+		DoT dotConfig `flag:"dot"`
+
+		AAAA struct {
+			Proxy  string `default:"serve" usage:"AAAA answer of the proxied domains, option: serve/empty/pass"`
+			Direct string `default:"pass" usage:"AAAA answer of the direct domains, option: empty/pass"`
+		}
+
+		TTLRules []string `usage:"override answer TTL of matched domains, format: '<ttl> <rule>', eg: '30 **.lb.internal'"`
+
+		Cache struct {
+			Size     int           `default:"10000" usage:"max answers cached, 0 to disable"`
+			MinTTL   time.Duration `default:"0s" usage:"min TTL of the cached answers"`
+			MaxTTL   time.Duration `default:"1h" usage:"max TTL of the cached answers, 0 for unlimited"`
+			NegTTL   time.Duration `default:"5m" usage:"max TTL of the cached NXDOMAIN / NODATA answers, 0 to disable"`
+			Prefetch int           `default:"3" usage:"refresh the answers queried at least the times before they expire, 0 to disable"`
+		}
+	}
+	Outbound struct {
+		TFO       bool   `default:"false" usage:"enable TCP Fast Open on direct and remote dials, linux only"`
+		Interface string `usage:"bind direct and remote dials to the interface, eg: eth0"`
+		SourceIP  string `usage:"local IP of direct and remote dials"`
+	}
+	Log struct {
+		Burst    int           `default:"5" usage:"identical warn/error logs written in an interval, 0 to disable throttle"`
+		Interval time.Duration `default:"1m" usage:"interval to summarize suppressed logs"`
+	}
+	Guard struct {
+		MaxConns      int `default:"0" usage:"max concurrent inbound connections, 0 to disable"`
+		MaxGoroutines int `default:"0" usage:"reject inbound connections over the goroutines, 0 to disable"`
+		MemoryLimit   int `default:"0" usage:"soft memory limit in MiB, 0 to disable"`
+	}
+	Admin struct {
+		Addr string `usage:"admin API listen address, eg: 127.0.0.1:7777, empty to disable"`
+	}
+	NetWatch struct {
+		Interval time.Duration `default:"10s" usage:"interval to detect network changes, 0 to disable"`
+	}
+	Socks5 struct {
+		Disable bool   `default:"false" usage:"disable sock5 proxy"`
+		Addr    string `default:":1080" usage:"socks5 listen address"`
+	} `flag:"socks5"`
+	HTTP struct {
+		Addr string `usage:"HTTP proxy listen address, CONNECT and absolute-URI requests, eg: 127.0.0.1:8080, empty to disable"`
+	} `flag:"http"`
+	Mixed struct {
+		Addr string `usage:"SOCKS5 and HTTP proxy listen address on the same port, eg: 127.0.0.1:7890, empty to disable"`
+	} `flag:"mixed"`
+
+	Router routerConfig
+}
+
+// routerConfig is the rule lists, which are reloaded once the files changed
+type routerConfig struct {
+	Priority []string `default:"block,direct,proxy" usage:"evaluation order of the rule lists, the first matched wins"`
+	Final    string   `default:"detect" usage:"policy of the hosts not matched by any rule, option: direct/proxy/detect"`
+	DryRun   bool     `default:"false" usage:"log the decisions but forward everything direct, to audit the rules"`
+	Hook     struct {
+		Command string        `usage:"program overriding the verdicts, reads '<id> <host> <port> <source IP> <SNI or ->' lines and answers '<id> <block|direct|proxy|->' lines"`
+		Timeout time.Duration `default:"200ms" usage:"timeout of the hook answer, the verdict is kept on timeout"`
+	}
+	Clients []string      `usage:"routing policies by the client source IP, format: '<IP or CIDR> <policy>', option: rules/noblock/block/direct/proxy, eg: '192.168.1.10 proxy'"`
+	Reload  time.Duration `default:"10s" usage:"interval to check the config file and local rule files for changes, 0 to disable"`
+	Refresh time.Duration `default:"24h" usage:"interval to refresh the remote rule files by conditional GET, 0 to disable"`
+
+	Block struct {
+		Action     string   `default:"close" usage:"action of the blocked connections, option: close/reset/reject, reject is HTTP 403 for port 80 and TLS alert for port 443"`
+		DNSAnswer  string   `default:"nxdomain" usage:"DNS answer of the blocked domains, option: nxdomain/zero/<sinkhole IP>, zero is 0.0.0.0 or ::"`
+		File       string   `usage:"block list file, local file or remote, plain list or clash rule-provider"`
+		FileMode   string   `usage:"matching mode of the file lines, option: exact/suffix/wildcard/cidr, empty to use FilePrefix"`
+		FilePrefix string   `default:"**." usage:"parsed as '<prefix>line_text'"`
+		Rules      []string `usage:"block list rules, wildcard, regexp prefixed with re:, keyword prefixed with kw:, geosite:<code>, CIDR for IP destinations, port:<port>[-<port>] or time:[<days>@]<hh:mm>-<hh:mm> optionally after a host rule, or proc:<process name> on linux/windows, prefix ! for exceptions"`
+	}
+	Direct struct {
+		File       string   `usage:"direct list file, local file or remote, plain list or clash rule-provider"`
+		FileMode   string   `usage:"matching mode of the file lines, option: exact/suffix/wildcard/cidr, empty to use FilePrefix"`
+		FilePrefix string   `default:"**." usage:"parsed as '<prefix>line_text'"`
+		Rules      []string `usage:"direct list rules, wildcard, regexp prefixed with re:, keyword prefixed with kw:, geosite:<code>, CIDR for IP destinations, port:<port>[-<port>] or time:[<days>@]<hh:mm>-<hh:mm> optionally after a host rule, or proc:<process name> on linux/windows, prefix ! for exceptions"`
+	}
+	Proxy struct {
+		File       string   `usage:"proxy list file, local file or remote, plain list or clash rule-provider"`
+		FileMode   string   `usage:"matching mode of the file lines, option: exact/suffix/wildcard/cidr, empty to use FilePrefix"`
+		FilePrefix string   `default:"**." usage:"parsed as '<prefix>line_text'"`
+		Rules      []string `usage:"proxy list rules, wildcard, regexp prefixed with re:, keyword prefixed with kw:, geosite:<code>, CIDR for IP destinations, port:<port>[-<port>] or time:[<days>@]<hh:mm>-<hh:mm> optionally after a host rule, or proc:<process name> on linux/windows, prefix ! for exceptions, prefix >>tag to route via the named remote"`
+	}
+
+	GeoSite string `default:"https://github.com/v2fly/domain-list-community/releases/latest/download/dlc.dat" usage:"geosite.dat for the 'geosite:<code>' rules, local file or remote"`
+
+	Country struct {
+		Codes      []string      `default:"CN" usage:"ISO codes of the countries routed direct by the mmdb, eg: CN,HK"`
+		Excludes   []string      `usage:"CIDRs excluded from the countries, both IPv4 and IPv6, eg: 203.0.113.0/24"`
+		MMDB       string        `usage:"mmdb file, or the URL to download it"`
+		MMDBURL    string        `usage:"URL to download the mmdb file if missing or stale, eg: https://github.com/Loyalsoldier/geoip/releases/latest/download/Country.mmdb"`
+		Refresh    time.Duration `default:"168h" usage:"interval to refresh the downloaded mmdb, 0 to disable"`
+		ViaProxy   bool          `default:"true" usage:"download the mmdb through the proxy"`
+		File       string        `usage:"CIDR block list file, local file or remote"`
+		FileMode   string        `usage:"matching mode of the file lines, option: exact/suffix/wildcard/cidr, empty to use FilePrefix"`
+		FilePrefix string        `default:"" usage:"parsed as '<prefix>line_text'"`
+		Rules      []string      `usage:"CIDR list rules"`
+	}
+
+	Cache struct {
+		Size int           `default:"4096" usage:"max routing decisions cached, 0 to disable"`
+		TTL  time.Duration `default:"1m" usage:"TTL of the cached routing decisions, which also delays the time rules"`
+	}
+	Verdict struct {
+		TTL      time.Duration `default:"24h" usage:"keep the verdicts of the hosts not matched by any rule, 0 to disable"`
+		File     string        `usage:"file to persist the verdicts across restarts, empty to disable"`
+		Interval time.Duration `default:"5m" usage:"interval to save the changed verdicts and learned rules"`
+	}
+
+	Fallback struct {
+		Enable    bool          `default:"false" usage:"retry through proxy when a direct dial fails"`
+		TTL       time.Duration `default:"0s" usage:"route the failed domain to proxy for the TTL, 0 to disable"`
+		Threshold int           `default:"1" usage:"learn the domain after the direct dials failed the times within the TTL"`
+		File      string        `usage:"file to persist the learned domains across restarts, empty to disable"`
+	}
+}
+
+// setup load the config and the remotes, which is not done in init, so that
+// the tests of the package do not parse the test flags as the config
+func setup() {
+	var err error
+	if configFile, cmdArgs, err = loadConfig(&conf); err != nil {
 		log.Fatal().Err(err).
 			Interface("config", conf).
 			Msg("Load config")
 	}
 
-	conf.Router.Direct.Rules = append(conf.Router.Direct.Rules,
-		conf.Remote.Addr, "**.in-addr.arpa", "**.ip6.arpa")
+	if conf.Log.Burst > 0 {
+		throttle := logthrottle.New(log.Logger, conf.Log.Burst, conf.Log.Interval)
+		log.Logger = log.Logger.Hook(throttle)
+		deferlog.Logger = deferlog.Logger.Hook(throttle)
+	}
+
+	builtinDirectRules = []string{"**.in-addr.arpa", "**.ip6.arpa"}
+	remotes = map[string]*remoteConfig{}
+	remoteAddrs := []string{conf.Remote.Addr}
+	for _, spec := range conf.Remotes {
+		tag, remote, err := parseRemote(conf.Remote, spec)
+		if err != nil {
+			log.Fatal().Err(err).Msg("parse remotes")
+		}
+		if _, ok := remotes[tag]; ok {
+			log.Fatal().Str("tag", tag).Msg("duplicated remote tag")
+		}
+		remotes[tag], remoteTags = remote, append(remoteTags, tag)
+		remoteAddrs = append(remoteAddrs, remote.Addr)
+	}
+	for _, addr := range strings.Split(strings.Join(remoteAddrs, ","), ",") {
+		addr = strings.TrimSpace(addr)
+		if i := strings.LastIndex(addr, "@"); i >= 0 {
+			addr = addr[i+1:]
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		builtinDirectRules = append(builtinDirectRules, addr)
+	}
 	log.Info().
 		Str("version", version).
 		Str("date", date).
@@ -95,63 +299,219 @@ func init() {
 		Msg("Starting")
 }
 
+// loadConfig load the config from the file, environment and flags, return the
+// config file and the arguments after the flags
+func loadConfig(c *config) (string, []string, error) {
+	loader := aconfig.LoaderFor(c, aconfig.Config{
+		AllowUnknownFields: true,
+		FileFlag:           "f",
+		FileDecoders: map[string]aconfig.FileDecoder{
+			".yml":  aconfigyaml.New(),
+			".yaml": aconfigyaml.New(),
+			".toml": aconfigtoml.New(),
+			".hcl":  aconfighcl.New(),
+		},
+	})
+	if err := loader.Load(); err != nil {
+		return "", nil, err
+	}
+	return loader.Flags().Lookup("f").Value.String(), loader.Flags().Args(), nil
+}
+
 func main() {
-	proxtDial := GenProxyDial(conf.Remote.Type, conf.Remote.Addr, conf.Remote.Password)
-	r := router.NewRouter(conf.DNS.Serve, conf.DNS.Fallback, conf.Router.Country.MMDB, proxtDial)
+	setup()
+	if err := dialer.SetTFO(conf.Outbound.TFO); err != nil {
+		log.Warn().Err(err).Msg("set outbound TCP Fast Open")
+	}
+	dialer.SetMPTCP(conf.Remote.MPTCP)
+	if err := dialer.SetInterface(conf.Outbound.Interface); err != nil {
+		log.Fatal().Err(err).Msg("set outbound interface")
+	}
+	if err := dialer.SetSourceIP(conf.Outbound.SourceIP); err != nil {
+		log.Fatal().Err(err).Msg("set outbound source IP")
+	}
+
+	proxtDial := GenProxyDial(&conf.Remote)
+	remoteDials := genRemoteDials()
+	if conf.Balance.Policy != "" {
+		dials := map[string]router.ProxyDialFn{defaultRemote: proxtDial}
+		for tag, dial := range remoteDials {
+			dials[tag] = dial
+		}
+		b, err := newBalancer(conf.Balance.Policy, conf.Balance.Weights,
+			append([]string{defaultRemote}, remoteTags...), dials)
+		if err != nil {
+			log.Fatal().Err(err).Msg("init balance")
+		}
+		b.tolerance = conf.Balance.Tolerance
+		if conf.Balance.Interval > 0 {
+			if err := b.healthCheck(conf.Balance.Interval, conf.Balance.Probe, conf.Balance.URL); err != nil {
+				log.Fatal().Err(err).Msg("init balance health check")
+			}
+		}
+		proxtDial = b.dial
+	}
+	mmdbFile := conf.Router.Country.MMDB
+	if isURL(mmdbFile) {
+		mmdbFile = ""
+	}
+	r := router.NewRouter(conf.DNS.Serve, conf.DNS.Fallback, mmdbFile, proxtDial)
+	r.SetRemotes(remoteDials)
+	if err := r.SetPriority(conf.Router.Priority); err != nil {
+		log.Fatal().Err(err).Msg("set rule priority")
+	}
+	if err := r.SetFinal(conf.Router.Final); err != nil {
+		log.Fatal().Err(err).Msg("set final policy")
+	}
+	r.SetDryRun(conf.Router.DryRun)
+	if err := r.SetHook(conf.Router.Hook.Command, conf.Router.Hook.Timeout); err != nil {
+		log.Fatal().Err(err).Msg("start routing hook")
+	}
+	if err := r.SetClientPolicies(conf.Router.Clients); err != nil {
+		log.Fatal().Err(err).Msg("set client policies")
+	}
+	if err := r.SetBlockAction(conf.Router.Block.Action); err != nil {
+		log.Fatal().Err(err).Msg("set block action")
+	}
+	if err := r.SetBlockAnswer(conf.Router.Block.DNSAnswer); err != nil {
+		log.Fatal().Err(err).Msg("set block DNS answer")
+	}
 	r.SetBlockRules(conf.Router.Block.Rules)
-	r.SetDirectRules(conf.Router.Direct.Rules)
+	r.SetDirectRules(append(conf.Router.Direct.Rules, builtinDirectRules...))
 	r.SetProxyRules(conf.Router.Proxy.Rules)
 	r.SetCountryCIDRs(conf.Router.Country.Rules)
+	r.SetCountryExcludes(conf.Router.Country.Excludes)
+	r.SetCountryCodes(conf.Router.Country.Codes)
+	r.SetTTLRules(conf.DNS.TTLRules)
+	r.SetFallbackProxy(conf.DNS.ViaProxy)
+	if err := r.SetECS(conf.DNS.ECS); err != nil {
+		log.Fatal().Err(err).Msg("set EDNS Client Subnet")
+	}
+	r.SetDNSSECVerify(conf.DNS.DNSSEC)
+	if err := r.SetPoisonFilter(conf.DNS.Poison.Bogus, conf.DNS.Poison.MinRTT, conf.DNS.Poison.Upstream); err != nil {
+		log.Fatal().Err(err).Msg("set poison filter")
+	}
+	r.SetQueryLog(conf.DNS.QueryLog)
+	if err := r.SetProxyResolver(conf.DNS.Proxied); err != nil {
+		log.Fatal().Err(err).Msg("set resolver of proxied domains")
+	}
+	hosts, err := loadHosts(conf.DNS.HostsFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("load hosts file")
+	}
+	if err := r.SetHosts(append(conf.DNS.Hosts, hosts...)); err != nil {
+		log.Fatal().Err(err).Msg("set static hosts")
+	}
+	if err := r.SetForwards(conf.DNS.Forwards); err != nil {
+		log.Fatal().Err(err).Msg("set DNS forwards")
+	}
+	if err := r.SetFakeIP(conf.DNS.FakeIP); err != nil {
+		log.Fatal().Err(err).Msg("set fake IP pool")
+	}
+	if err := r.SetServeIP6(conf.DNS.Serve6); err != nil {
+		log.Fatal().Err(err).Msg("set IPv6 serve IP")
+	}
+	if err := r.SetAAAAPolicy(router.RuleProxy, conf.DNS.AAAA.Proxy); err != nil {
+		log.Fatal().Err(err).Msg("set AAAA policy")
+	}
+	if err := r.SetAAAAPolicy(router.RuleDirect, conf.DNS.AAAA.Direct); err != nil {
+		log.Fatal().Err(err).Msg("set AAAA policy")
+	}
+	r.SetDNSCache(conf.DNS.Cache.Size, conf.DNS.Cache.MinTTL, conf.DNS.Cache.MaxTTL, conf.DNS.Cache.NegTTL)
+	r.SetDNSPrefetch(conf.DNS.Cache.Prefetch)
+	r.SetDirectFallback(conf.Router.Fallback.Enable, conf.Router.Fallback.TTL)
+	r.SetDecisionCache(conf.Router.Cache.Size, conf.Router.Cache.TTL)
+	r.SetVerdictTTL(conf.Router.Verdict.TTL)
+	if conf.Router.Verdict.TTL > 0 && conf.Router.Verdict.File != "" {
+		go persist("verdicts", conf.Router.Verdict.File, conf.Router.Verdict.Interval,
+			r.LoadVerdicts, r.VerdictsChanged, r.SaveVerdicts)
+	}
+	r.SetFallbackThreshold(conf.Router.Fallback.Threshold)
+	if conf.Router.Fallback.TTL > 0 && conf.Router.Fallback.File != "" {
+		go persist("learned rules", conf.Router.Fallback.File, conf.Router.Verdict.Interval,
+			r.LoadLearned, r.LearnedChanged, r.SaveLearned)
+	}
 
-	go func() {
-		if conf.DNS.Disable {
-			log.Info().Msg("DNS proxy disabled")
+	if len(cmdArgs) != 0 {
+		switch cmdArgs[0] {
+		case "route":
+			if err := runRoute(r, proxtDial, cmdArgs[1:]); err != nil {
+				log.Fatal().Err(err).Msg("route")
+			}
 			return
+		default:
+			log.Fatal().Strs("args", cmdArgs).Msg("unknown subcommand, option: route")
 		}
+	}
 
-		lnHTTP, err := net.Listen("tcp", net.JoinHostPort(conf.DNS.Serve, "80"))
-		if err != nil {
-			log.Fatal().Err(err).Msg("listen port")
-		}
-		go ServeHTTP(lnHTTP, r)
+	connGuard = guard.New(conf.Guard.MaxConns, conf.Guard.MaxGoroutines)
+	if conf.Guard.MemoryLimit > 0 {
+		limit := uint64(conf.Guard.MemoryLimit) << 20
+		debug.SetMemoryLimit(int64(limit))
+		go watchMemory(limit, r)
+	}
 
-		lnHTTPS, err := net.Listen("tcp", net.JoinHostPort(conf.DNS.Serve, "443"))
-		if err != nil {
-			log.Fatal().Err(err).Msg("listen port")
+	if conf.DNS.Disable {
+		log.Info().Msg("DNS proxy disabled")
+	} else {
+		if dohEndpoint, err = newDoHServer(&conf.DNS.DoH, r); err != nil {
+			log.Fatal().Err(err).Msg("init DoH endpoint")
 		}
-		go ServeHTTPS(lnHTTPS, r)
-
-		log.Info().
-			Str("listen_on", conf.DNS.Serve).
-			Msg("DNS proxy started")
-		if err := dns.ListenAndServe(net.JoinHostPort(conf.DNS.Serve, "53"), "udp", r); err != nil {
-			log.Fatal().Err(err).Msg("serve dns")
+		startHijack(conf.DNS.Serve, "", r)
+		if port := conf.DNS.Ports.DNS; port != 0 {
+			startService(dnsService("dns", net.JoinHostPort(conf.DNS.Serve, strconv.Itoa(port)), r))
 		}
-	}()
-
-	go func() {
-		if conf.Socks5.Disable {
-			log.Info().Msg("SOCKS5 proxy disabled")
-			return
+		if conf.DNS.DoT.Addr != "" {
+			tlsConf, err := dotTLSConfig(&conf.DNS.DoT)
+			if err != nil {
+				log.Fatal().Err(err).Msg("init DoT listener")
+			}
+			startService(dotService("dot", conf.DNS.DoT.Addr, tlsConf, r))
 		}
-
-		ln, err := net.Listen("tcp", conf.Socks5.Addr)
-		if err != nil {
-			log.Fatal().Err(err).Msg("listen port")
+		if conf.DNS.Serve6 != "" {
+			startHijack(conf.DNS.Serve6, "6", r)
 		}
-		log.Info().Msgf("SOCKS5 proxy listening on %s", conf.Socks5.Addr)
-		go ServeSocks5(ln, r)
-	}()
+	}
+
+	if conf.Socks5.Disable {
+		log.Info().Msg("SOCKS5 proxy disabled")
+	} else {
+		startService(tcpService("socks5", conf.Socks5.Addr,
+			func(ln net.Listener) { ServeSocks5(ln, r) }))
+	}
+	if conf.HTTP.Addr != "" {
+		startService(tcpService("http proxy", conf.HTTP.Addr,
+			func(ln net.Listener) { ServeHTTPProxy(ln, r) }))
+	}
+	if conf.Mixed.Addr != "" {
+		startService(tcpService("mixed", conf.Mixed.Addr,
+			func(ln net.Listener) { ServeMixed(ln, r) }))
+	}
+
+	if conf.Admin.Addr != "" {
+		startService(tcpService("admin", conf.Admin.Addr,
+			func(ln net.Listener) { ServeAdmin(ln, r) }))
+	}
+
+	if conf.NetWatch.Interval > 0 {
+		go netwatch.Watch(conf.NetWatch.Interval, func() {
+			log.Info().Msg("network changed, reset network states")
+			r.ResetNetwork()
+			for _, reset := range remoteResets {
+				reset()
+			}
+			rebindServices()
+		})
+	}
 
 	start := time.Now()
-	r.SetBlockRules(append(conf.Router.Block.Rules,
-		loadRules(proxtDial, conf.Router.Block.File, conf.Router.Block.FilePrefix)...))
-	r.SetDirectRules(append(conf.Router.Direct.Rules,
-		loadRules(proxtDial, conf.Router.Direct.File, conf.Router.Direct.FilePrefix)...))
-	r.SetProxyRules(append(conf.Router.Proxy.Rules,
-		loadRules(proxtDial, conf.Router.Proxy.File, conf.Router.Proxy.FilePrefix)...))
-	r.SetCountryCIDRs(append(conf.Router.Country.Rules,
-		loadRules(proxtDial, conf.Router.Country.File, conf.Router.Country.FilePrefix)...))
+	if err := applyRules(r, proxtDial, &conf.Router, conf.DNS.TTLRules); err != nil {
+		log.Fatal().Err(err).Msg("load rules")
+	}
+	go refreshMMDB(r, proxtDial)
+	if conf.Router.Reload > 0 || conf.Router.Refresh > 0 {
+		go watchRules(conf.Router.Reload, conf.Router.Refresh, r, proxtDial)
+	}
 
 	log.Info().
 		Dur("spend", time.Since(start)).
@@ -164,84 +524,30 @@ func main() {
 	log.Info().Msg("--- : directRule matched")
 	log.Info().Msg(">>> : proxyRule matched")
 	log.Info().Msg("... : no rule matched")
+	log.Info().Msg("..> : no rule matched, proxied by the final policy")
 	runtime.GC()
-	select {}
-}
-
-func loadRules(proxyDial router.ProxyDialFn, file, linePrefix string) []string {
-	var loadFn func() (io.ReadCloser, error)
-	if _, err := url.Parse(file); err == nil {
-		// load rule file from remote by HTTP
-		client := &http.Client{
-			Transport: &http.Transport{
-				Dial: func(network, addr string) (net.Conn, error) {
-					domain, port, _ := net.SplitHostPort(addr)
-					p, _ := strconv.Atoi(port)
-					return proxyDial("tcp", domain, uint16(p))
-				},
-			},
-		}
-
-		loadFn = func() (io.ReadCloser, error) {
-			resp, err := client.Get(file)
-			if err != nil {
-				return nil, err
-			}
 
-			if resp.StatusCode != http.StatusOK {
-				resp.Body.Close()
-				return nil, errors.Errorf("status code: %d", resp.StatusCode)
-			}
-
-			return resp.Body, nil
-		}
-
-	} else {
-		// load rule file from local file
-		loadFn = func() (io.ReadCloser, error) {
-			return os.Open(file)
-		}
-	}
-
-	// load rule file, retry 10 times
-	rc, err := loadFn()
-	for i := time.Duration(1); i < 10; i++ {
-		if err == nil {
-			break
-		}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	log.Info().Str("signal", (<-sig).String()).Msg("shutting down")
+	stopPlugins()
+	pluginWG.Wait()
+}
 
-		// wait: 28.5s
-		time.Sleep(i * i * 100 * time.Millisecond)
-		rc, err = loadFn()
-	}
-	if err != nil {
-		log.Fatal().Err(err).
-			Str("file", file).
-			Msg("load config file")
-	}
-	defer rc.Close()
-
-	// parse rule file into rule tree
-	var lines []string
-	br := bufio.NewReader(rc)
-	for {
-		line, _, err := br.ReadLine()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Error().Err(err).
-				Str("file", file).
-				Msg("read line")
-			return nil
-		}
-
-		if strings.TrimSpace(string(line)) == "" {
+// watchMemory shed the DNS cache when heap usage is close to the soft limit
+func watchMemory(limit uint64, r *router.Router) {
+	for range time.Tick(10 * time.Second) {
+		ms := runtime.MemStats{}
+		runtime.ReadMemStats(&ms)
+		if ms.HeapAlloc < limit/10*9 {
 			continue
 		}
 
-		// use line content as suffix
-		lines = append(lines, linePrefix+string(line))
+		r.FlushDNSCache()
+		debug.FreeOSMemory()
+		log.Warn().
+			Uint64("heap", ms.HeapAlloc).
+			Uint64("limit", limit).
+			Msg("memory close to soft limit, DNS cache dropped")
 	}
-
-	return lines
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/pkg/dialer"
+	"github.com/wweir/sower/router"
+)
+
+func isURL(file string) bool {
+	return strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://")
+}
+
+// refreshMMDB download the mmdb if Country.MMDB is a URL, or the file is
+// missing or stale, and refresh it in the interval
+func refreshMMDB(r *router.Router, proxyDial router.ProxyDialFn) {
+	c := conf.Router.Country
+	src, file := c.MMDBURL, c.MMDB
+	if isURL(c.MMDB) {
+		src, file = c.MMDB, ""
+	}
+	if src == "" {
+		return
+	}
+	if !c.ViaProxy {
+		proxyDial = func(network, host string, port uint16) (net.Conn, error) {
+			return dialer.Dial(network, net.JoinHostPort(host, strconv.Itoa(int(port))))
+		}
+	}
+
+	for {
+		stale, wait := true, c.Refresh
+		if file != "" {
+			if info, err := os.Stat(file); err == nil {
+				age := time.Since(info.ModTime())
+				stale = c.Refresh > 0 && age >= c.Refresh
+				wait = c.Refresh - age
+			}
+		}
+
+		if stale {
+			err := downloadMMDB(r, proxyDial, src, file)
+			log.InfoWarn(err).
+				Str("url", src).
+				Str("file", file).
+				Msg("download mmdb")
+			if wait = c.Refresh; err != nil {
+				wait = time.Hour // retry later
+			}
+		}
+
+		if wait <= 0 {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+func downloadMMDB(r *router.Router, proxyDial router.ProxyDialFn, src, file string) error {
+	rc, err := openFile(proxyDial, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := r.SetCountryDB(data); err != nil {
+		return err
+	}
+	if file == "" {
+		return nil
+	}
+
+	return replaceFile(file, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// replaceFile write the file atomically by renaming a temporary file
+func replaceFile(file string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), file))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/wweir/sower/pkg/mux"
+)
+
+// muxPool share the remote connections between routed connections
+type muxPool struct {
+	mu         sync.Mutex
+	sessions   []*mux.Session
+	maxStreams int
+
+	wrapSession func(conn net.Conn) error
+	dialFn      func(host string, port uint16) (net.Conn, error)
+}
+
+// newMuxPool create the mux pool, wrapSession start the session on the dialed connection
+func newMuxPool(wrapSession func(conn net.Conn) error,
+	dialFn func(host string, port uint16) (net.Conn, error), maxStreams int) *muxPool {
+	return &muxPool{
+		maxStreams:  maxStreams,
+		wrapSession: wrapSession,
+		dialFn:      dialFn,
+	}
+}
+
+// dial open a stream in the pooled sessions instead of dialing remote, the
+// remote is dialed out of the lock to not block the other streams
+func (p *muxPool) dial(host string, port uint16) (net.Conn, error) {
+	if sess := p.pick(); sess != nil {
+		return open(sess)
+	}
+
+	conn, err := p.dialFn(mux.Host, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.wrapSession(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	sess := mux.Client(conn)
+	p.mu.Lock()
+	p.sessions = append(p.sessions, sess)
+	p.mu.Unlock()
+	return open(sess)
+}
+
+// open avoid returning a nil *mux.Stream as a non-nil net.Conn
+func open(sess *mux.Session) (net.Conn, error) {
+	stream, err := sess.Open()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// pick return a live session with free streams, nil if none
+func (p *muxPool) pick() *mux.Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	alive := p.sessions[:0]
+	var sess *mux.Session
+	for _, s := range p.sessions {
+		if s.IsClosed() {
+			continue
+		}
+		alive = append(alive, s)
+		if sess == nil && (p.maxStreams <= 0 || s.NumStreams() < p.maxStreams) {
+			sess = s
+		}
+	}
+	p.sessions = alive
+	return sess
+}
+
+// reset close all the sessions, eg: after network changed
+func (p *muxPool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.sessions {
+		s.Close()
+	}
+	p.sessions = nil
+}
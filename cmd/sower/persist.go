@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/sower-proxy/deferlog/log"
+)
+
+// persist load the saved states from the file, and save the changed states every interval
+func persist(name, file string, interval time.Duration,
+	load func(io.Reader) error, changed func() bool, save func(io.Writer) error) {
+	if f, err := os.Open(file); err == nil {
+		err = load(f)
+		f.Close()
+		log.InfoWarn(err).Str("file", file).Msg("load " + name)
+	} else if !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("file", file).Msg("open " + name + " file")
+	}
+
+	for range time.Tick(interval) {
+		if !changed() {
+			continue
+		}
+
+		if err := replaceFile(file, save); err != nil {
+			log.Warn().Err(err).Str("file", file).Msg("save " + name)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+)
+
+// the running SIP003 plugins, stopped on shutdown
+var (
+	pluginCtx, stopPlugins = context.WithCancel(context.Background())
+	pluginWG               sync.WaitGroup
+)
+
+// startPlugin launch the SIP003 plugin which tunnels the local port to remote,
+// and return the local address to dial. The plugin is restarted if it exits,
+// until it failed to listen in time or sower shuts down.
+func startPlugin(plugin, opts, remoteAddr string) (string, error) {
+	remoteHost, remotePort, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return "", errors.Wrap(err, "parse remote address")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", errors.Wrap(err, "pick local port")
+	}
+	localAddr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	env := append(os.Environ(),
+		"SS_REMOTE_HOST="+remoteHost,
+		"SS_REMOTE_PORT="+remotePort,
+		"SS_LOCAL_HOST="+localAddr.IP.String(),
+		"SS_LOCAL_PORT="+strconv.Itoa(localAddr.Port),
+		"SS_PLUGIN_OPTIONS="+opts)
+
+	ctx, cancel := context.WithCancel(pluginCtx)
+	run := func() error {
+		cmd := exec.CommandContext(ctx, plugin)
+		cmd.Env = env
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		setPdeathsig(cmd)
+		if err := cmd.Start(); err != nil {
+			return errors.Wrap(err, "start plugin")
+		}
+		return cmd.Wait()
+	}
+
+	errCh := make(chan error, 1)
+	pluginWG.Add(1)
+	go func() {
+		defer pluginWG.Done()
+		defer cancel()
+		for {
+			err := run()
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case errCh <- err:
+			default:
+			}
+
+			log.Error().Err(err).
+				Str("plugin", plugin).
+				Msg("plugin exited, restart")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+
+	// wait for the plugin listening
+	for i := 0; i < 50; i++ {
+		select {
+		case err := <-errCh:
+			cancel()
+			return "", errors.Wrap(err, "plugin exited")
+		default:
+		}
+
+		if conn, err := net.DialTimeout("tcp", localAddr.String(), 100*time.Millisecond); err == nil {
+			conn.Close()
+			return localAddr.String(), nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cancel()
+	return "", errors.Errorf("plugin not listening on %s", localAddr)
+}
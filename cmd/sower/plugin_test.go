@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartPlugin_Exited(t *testing.T) {
+	dir := t.TempDir()
+	starts := filepath.Join(dir, "starts")
+	plugin := filepath.Join(dir, "plugin")
+	script := "#!/bin/sh\necho start >> " + starts + "\nexit 1\n"
+	if err := os.WriteFile(plugin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := startPlugin(plugin, "", "127.0.0.1:8388"); err == nil {
+		t.Fatal("expect the plugin exited error")
+	}
+
+	// the failed plugin must not be restarted
+	time.Sleep(1500 * time.Millisecond)
+	data, _ := os.ReadFile(starts)
+	if n := strings.Count(string(data), "start"); n != 1 {
+		t.Errorf("plugin started %d times", n)
+	}
+}
+
+func TestStartPlugin_NotListening(t *testing.T) {
+	plugin := filepath.Join(t.TempDir(), "plugin")
+	if err := os.WriteFile(plugin, []byte("#!/bin/sh\nexec sleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := startPlugin(plugin, "", "127.0.0.1:8388"); err == nil {
+		t.Fatal("expect the plugin not listening error")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/wweir/sower/pkg/breaker"
+)
+
+// preDialPool keep some remote connections dialed in advance, so that the
+// handshake latency is hidden from the proxied connections
+type preDialPool struct {
+	dialFn  func(host string, port uint16) (net.Conn, error)
+	maxIdle time.Duration
+	conns   chan idleConn
+	cb      *breaker.Breaker
+}
+
+type idleConn struct {
+	net.Conn
+	since time.Time
+}
+
+func newPreDialPool(dialFn func(host string, port uint16) (net.Conn, error),
+	size int, maxIdle time.Duration) *preDialPool {
+
+	p := &preDialPool{
+		dialFn:  dialFn,
+		maxIdle: maxIdle,
+		conns:   make(chan idleConn, size),
+		cb:      breaker.New(1, time.Second, time.Minute),
+	}
+	go p.refill()
+	return p
+}
+
+// refill dial the remote in background, blocked while the pool is full
+func (p *preDialPool) refill() {
+	for {
+		if err := p.cb.Allow(); err != nil {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// the target is written by proxy protocol later, not used by dialFn
+		conn, err := p.dialFn("", 0)
+		if err != nil {
+			p.cb.Failure()
+			continue
+		}
+		p.cb.Success()
+		p.conns <- idleConn{Conn: conn, since: time.Now()}
+	}
+}
+
+// dial take an idle connection from pool, or dial a new one if none
+func (p *preDialPool) dial(host string, port uint16) (net.Conn, error) {
+	for {
+		select {
+		case c := <-p.conns:
+			if time.Since(c.since) < p.maxIdle {
+				return c.Conn, nil
+			}
+			c.Close()
+		default:
+			return p.dialFn(host, port)
+		}
+	}
+}
+
+// reset close the idle connections, eg: after network changed
+func (p *preDialPool) reset() {
+	for {
+		select {
+		case c := <-p.conns:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
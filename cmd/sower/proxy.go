@@ -3,109 +3,373 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/sower-proxy/conns/relay"
 	"github.com/sower-proxy/conns/teeconn"
 	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/pkg/breaker"
+	"github.com/wweir/sower/pkg/dialer"
+	"github.com/wweir/sower/pkg/guard"
+	"github.com/wweir/sower/pkg/mux"
+	"github.com/wweir/sower/pkg/relay"
+	"github.com/wweir/sower/pkg/wsconn"
 	"github.com/wweir/sower/router"
 	"github.com/wweir/sower/transport"
+	"github.com/wweir/sower/transport/httpproxy"
+	"github.com/wweir/sower/transport/obfs"
+	"github.com/wweir/sower/transport/shadowsocks"
+	"github.com/wweir/sower/transport/snell"
+	"github.com/wweir/sower/transport/socks4"
 	"github.com/wweir/sower/transport/socks5"
 	"github.com/wweir/sower/transport/sower"
 	"github.com/wweir/sower/transport/ssh"
 	"github.com/wweir/sower/transport/trojan"
+	"github.com/wweir/sower/transport/vmess"
 
 	crypto_ssh "golang.org/x/crypto/ssh"
 )
 
-func GenProxyDial(proxyType, proxyHost, proxyPassword string) router.ProxyDialFn {
+var connGuard *guard.Guard
+
+// remoteResets drop the long-lived remote connections, eg: after network changed
+var remoteResets []func()
+
+func addRemoteReset(reset func()) { remoteResets = append(remoteResets, reset) }
+
+// acceptGuard close the connection if resource guard rejects it
+func acceptGuard(conn net.Conn) bool {
+	if err := connGuard.Acquire(); err != nil {
+		log.Warn().Err(err).
+			Str("from", conn.RemoteAddr().String()).
+			Int64("conns", connGuard.Conns()).
+			Msg("reject inbound connection")
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+func GenProxyDial(remote *remoteConfig) router.ProxyDialFn {
+	proxyHost := remote.Addr
 	var proxy transport.Transport
+	var connProxy transport.ConnTransport
 	var dialFn func(host string, port uint16) (net.Conn, error)
 
-	switch conf.Remote.Type {
-	case "sower":
-		proxy = sower.New(conf.Remote.Password)
-		tlsCfg := &tls.Config{}
-		dialFn = func(host string, port uint16) (net.Conn, error) {
-			return tls.Dial("tcp", net.JoinHostPort(proxyHost, "443"), tlsCfg)
+	// the plain TCP remotes dial the SIP003 plugin instead of the remote
+	dialAddr, boot := proxyHost, (*bootstrap)(nil)
+	if remote.Plugin == "" {
+		boot = newBootstrap(&remote.Bootstrap, proxyHost, "")
+	} else {
+		switch remote.Type {
+		case "shadowsocks", "vmess", "snell", "http", "socks5":
+		default:
+			log.Fatal().
+				Str("type", remote.Type).
+				Msg("plugin is not supported by the remote type")
 		}
 
+		var err error
+		if dialAddr, err = startPlugin(remote.Plugin, remote.PluginOpts, proxyHost); err != nil {
+			log.Fatal().Err(err).
+				Str("plugin", remote.Plugin).
+				Msg("start plugin")
+		}
+	}
+
+	plainDial := func(host string, port uint16) (net.Conn, error) {
+		addr := dialAddr
+		if boot != nil {
+			var err error
+			if addr, err = boot.addr(); err != nil {
+				return nil, err
+			}
+		}
+		return dialer.Remote(0).Dial("tcp", addr)
+	}
+
+	switch remote.Type {
+	case "sower":
+		proxy = sower.New(remote.Password).SetClientID(remote.ClientID)
+		dialFn = genTLSDial(remote)
+
 	case "trojan":
-		proxy = trojan.New(conf.Remote.Password)
-		tlsCfg := &tls.Config{}
-		dialFn = func(host string, port uint16) (net.Conn, error) {
-			return tls.Dial("tcp", net.JoinHostPort(proxyHost, "443"), tlsCfg)
+		proxy = trojan.New(remote.Password)
+		dialFn = genTLSDial(remote)
+
+	case "shadowsocks":
+		ss, err := shadowsocks.New(remote.Cipher, remote.Password)
+		if err != nil {
+			log.Fatal().Err(err).Msg("init shadowsocks")
 		}
 
-	case "socks5":
-		proxy = socks5.New()
-		dialFn = func(host string, port uint16) (net.Conn, error) {
-			return net.Dial("tcp", proxyHost)
+		connProxy = ss
+		dialFn = plainDial
+
+	case "vmess":
+		vmessProxy, err := vmess.New(remote.UUID)
+		if err != nil {
+			log.Fatal().Err(err).Msg("init vmess")
+		}
+
+		connProxy = vmessProxy
+		dialFn = plainDial
+
+	case "snell":
+		snellProxy, err := snell.New(remote.Password, remote.Version)
+		if err != nil {
+			log.Fatal().Err(err).Msg("init snell")
 		}
 
+		connProxy = snellProxy
+		dialFn = plainDial
+
+	case "h2":
+		dialFn = httpproxy.NewH2(proxyHost, remote.User, remote.Password).Dial
+
+	case "naive":
+		dialFn = httpproxy.NewH2(proxyHost, remote.User, remote.Password).
+			SetPadding(true).Dial
+
+	case "http":
+		proxy = httpproxy.New(remote.User, remote.Password)
+		dialFn = plainDial
+
+	case "socks5":
+		proxy = socks5.New().SetAuth(remote.User, remote.Password)
+		dialFn = plainDial
+
 	case "sshd":
-		config := crypto_ssh.ClientConfig{
-			User:            conf.Remote.User,
-			Auth:            []crypto_ssh.AuthMethod{crypto_ssh.Password(conf.Remote.Password)},
-			HostKeyCallback: crypto_ssh.InsecureIgnoreHostKey(),
+		auth, err := sshAuthMethods(remote)
+		if err != nil {
+			log.Fatal().Err(err).Msg("init ssh auth")
 		}
-		sshClient, err := crypto_ssh.Dial("tcp", proxyHost, &config)
+		hops := parseSSHHops(proxyHost)
+		hostKeys, err := sshHostKeyCallbacks(remote.KnownHosts, remote.HostKey, len(hops))
 		if err != nil {
-			log.Fatal().Msg("connect to sshd failed")
+			log.Fatal().Err(err).Msg("init ssh host key verification")
+		}
+		config := crypto_ssh.ClientConfig{
+			User: remote.User,
+			Auth: auth,
+		}
+		dialer := newSSHDialer(hops, &config, hostKeys, remote.KeepAlive)
+		if _, err := dialer.getClient(); err != nil {
+			log.Fatal().Err(err).Msg("connect to sshd failed")
 		}
 
+		addRemoteReset(dialer.reset)
 		proxy = ssh.New()
-		dialFn = func(host string, port uint16) (net.Conn, error) {
-			conn, err := sshClient.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
-			if err != nil {
-				log.Error().Err(err).Msg("sshClient.Dial failed, re-connect...")
-				sshClient, err = crypto_ssh.Dial("tcp", proxyHost, &config)
-				if err != nil {
-					log.Fatal().Msg("re-connect to sshd failed")
-				} else {
-					conn, err = sshClient.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
-				}
-			}
-			return conn, err
-		}
+		dialFn = dialer.Dial
 
 	default:
 		log.Fatal().
-			Str("type", conf.Remote.Type).
+			Str("type", remote.Type).
 			Msg("unknown proxy type")
 	}
 
+	if len(remote.Obfs) != 0 {
+		dialFn = genWrapDial(dialFn, remote.Obfs, remote.ObfsHost)
+	}
+	if remote.Mux.Enable && (remote.Type == "sower" || remote.Type == "trojan") {
+		var wrapSession func(conn net.Conn) error
+		if tj, ok := proxy.(*trojan.Trojan); ok {
+			// trojan-go compatible mux, streams start with simplesocks request
+			wrapSession, proxy = tj.WrapMux, trojan.SimpleSocks{}
+		} else {
+			sessProxy := proxy
+			wrapSession = func(conn net.Conn) error { return sessProxy.Wrap(conn, mux.Host, 0) }
+		}
+
+		pool := newMuxPool(wrapSession, dialFn, remote.Mux.MaxStreams)
+		addRemoteReset(pool.reset)
+		dialFn = pool.dial
+
+	} else if remote.PreDial.Size > 0 {
+		switch remote.Type {
+		case "h2", "naive", "sshd": // the dialed connections are bound to target
+		default:
+			pool := newPreDialPool(dialFn, remote.PreDial.Size, remote.PreDial.MaxIdle)
+			addRemoteReset(pool.reset)
+			dialFn = pool.dial
+		}
+	}
+
+	cb := breaker.New(remote.Breaker.Threshold,
+		remote.Breaker.Cooldown, remote.Breaker.MaxCooldown)
 	return func(network, host string, port uint16) (net.Conn, error) {
 		if host == "" || port == 0 {
 			return nil, errors.Errorf("invalid addr(%s:%d)", host, port)
 		}
 
+		if err := cb.Allow(); err != nil {
+			return nil, err
+		}
+
 		conn, err := dialFn(host, port)
 		if err != nil {
+			countFailure(cb, err)
 			return nil, err
 		}
 
-		if err := proxy.Wrap(conn, host, port); err != nil {
+		if connProxy != nil {
+			wrapped, err := connProxy.WrapConn(conn, host, port)
+			if err != nil {
+				countFailure(cb, err)
+				conn.Close()
+				return nil, err
+			}
+			conn = wrapped
+
+		} else if proxy == nil {
+			// the dialed connection is already a tunnel to target
+
+		} else if err := proxy.Wrap(conn, host, port); err != nil {
+			countFailure(cb, err)
 			conn.Close()
 			return nil, err
 		}
 
+		cb.Success()
 		return conn, nil
 	}
 }
 
+// isTargetErr check whether the remote reported the failure of the target,
+// eg: the target refused the connection through socks5, HTTP or sshd
+func isTargetErr(err error) bool {
+	var openErr *crypto_ssh.OpenChannelError
+	return errors.Is(err, transport.ErrTarget) || errors.As(err, &openErr)
+}
+
+// countFailure record the failure in the breaker, the failure of the target
+// proves the remote is alive
+func countFailure(cb *breaker.Breaker, err error) {
+	if isTargetErr(err) {
+		cb.Success()
+	} else {
+		cb.Failure()
+	}
+}
+
+// genWrapDial stack the wrappers on the dialed connection in order,
+// before the proxy protocol is written
+func genWrapDial(dialFn func(host string, port uint16) (net.Conn, error),
+	modes []string, host string) func(host string, port uint16) (net.Conn, error) {
+
+	wrappers := make([]transport.Wrapper, 0, len(modes))
+	for _, mode := range modes {
+		wrapper, err := obfs.New(mode, host)
+		if err != nil {
+			log.Fatal().Err(err).Msg("init obfs")
+		}
+		wrappers = append(wrappers, wrapper)
+	}
+
+	return func(tgtHost string, tgtPort uint16) (net.Conn, error) {
+		conn, err := dialFn(tgtHost, tgtPort)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, wrapper := range wrappers {
+			wrapped, err := wrapper.Wrap(conn)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = wrapped
+		}
+		return conn, nil
+	}
+}
+
+// genTLSDial dial the remote by TLS, and optionally upgrade to websocket
+func genTLSDial(remote *remoteConfig) func(host string, port uint16) (net.Conn, error) {
+	proxyHost := remote.Addr
+	// the port of Addr is optional, default to 443
+	domain := proxyHost
+	if host, _, err := net.SplitHostPort(proxyHost); err == nil {
+		domain = host
+	}
+
+	serverName, connectAddr := remote.SNI, remote.ConnectAddr
+	if serverName == "" {
+		serverName = domain
+	}
+	var boot *bootstrap
+	if connectAddr == "" {
+		connectAddr, boot = proxyHost, newBootstrap(&remote.Bootstrap, proxyHost, "443")
+	}
+	if _, _, err := net.SplitHostPort(connectAddr); err != nil {
+		connectAddr = net.JoinHostPort(connectAddr, "443")
+	}
+
+	tlsCfg, err := remoteTLSConfig(remote, serverName)
+	if err != nil {
+		log.Fatal().Err(err).Msg("init remote TLS config")
+	}
+	wsHost := remote.Host
+	if wsHost == "" {
+		wsHost = proxyHost
+	}
+
+	var ech *echConfig
+	if remote.ECH.Enable {
+		if ech, err = newECHConfig(domain, remote.ECH.ConfigList, remote.ECH.DoH); err != nil {
+			log.Fatal().Err(err).Msg("init ECH")
+		}
+	}
+
+	return func(host string, port uint16) (net.Conn, error) {
+		addr := connectAddr
+		if boot != nil {
+			var err error
+			if addr, err = boot.addr(); err != nil {
+				return nil, err
+			}
+		}
+
+		var conn net.Conn
+		var err error
+		if ech != nil {
+			conn, err = dialECH(addr, tlsCfg, ech)
+		} else {
+			conn, err = tls.DialWithDialer(dialer.Remote(0), "tcp", addr, tlsCfg)
+		}
+		if err != nil || remote.Path == "" {
+			return conn, err
+		}
+
+		ws, err := wsconn.Client(conn, wsHost, remote.Path)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return ws, nil
+	}
+}
+
 func ServeHTTP(ln net.Listener, r *router.Router) {
 	conn, err := ln.Accept()
-	if err != nil {
+	if isClosed(err) {
+		return
+	} else if err != nil {
 		log.Fatal().Err(err).
-			Msg("serve socks5")
+			Msg("serve http")
 	}
 
 	go ServeHTTP(ln, r)
+	if !acceptGuard(conn) {
+		return
+	}
+	defer connGuard.Release()
+
 	start := time.Now()
 	teeconn := teeconn.New(conn)
 	defer teeconn.Close()
@@ -120,7 +384,7 @@ func ServeHTTP(ln net.Listener, r *router.Router) {
 		Str("host", req.Host).
 		Msg("ServeHTTP")
 
-	rc, err := r.ProxyDial("tcp", req.Host, 80)
+	rc, err := r.ProxyDialFor(req.Host)("tcp", req.Host, 80)
 	if err != nil {
 		log.Error().Err(err).
 			Str("host", req.Host).
@@ -140,12 +404,19 @@ func ServeHTTP(ln net.Listener, r *router.Router) {
 
 func ServeHTTPS(ln net.Listener, r *router.Router) {
 	conn, err := ln.Accept()
-	if err != nil {
+	if isClosed(err) {
+		return
+	} else if err != nil {
 		log.Fatal().Err(err).
-			Msg("serve socks5")
+			Msg("serve https")
 	}
 
 	go ServeHTTPS(ln, r)
+	if !acceptGuard(conn) {
+		return
+	}
+	defer connGuard.Release()
+
 	start := time.Now()
 	teeconn := teeconn.New(conn)
 	defer teeconn.Close()
@@ -158,11 +429,20 @@ func ServeHTTPS(ln net.Listener, r *router.Router) {
 		},
 	}).Handshake()
 
+	if dohEndpoint != nil && strings.EqualFold(domain, dohEndpoint.name) {
+		log.Debug().
+			Str("domain", domain).
+			Msg("ServeHTTPS DoH")
+		teeconn.Stop().Reread()
+		dohEndpoint.serve(teeconn)
+		return
+	}
+
 	log.Info().
 		Str("domain", domain).
 		Msg("ServeHTTPS")
 
-	rc, err := r.ProxyDial("tcp", domain, 443)
+	rc, err := r.ProxyDialFor(domain)("tcp", domain, 443)
 	if err != nil {
 		log.Error().Err(err).
 			Str("host", domain).
@@ -181,20 +461,116 @@ func ServeHTTPS(ln net.Listener, r *router.Router) {
 
 func ServeSocks5(ln net.Listener, r *router.Router) {
 	conn, err := ln.Accept()
-	if err != nil {
+	if isClosed(err) {
+		return
+	} else if err != nil {
 		log.Fatal().Err(err).
 			Msg("serve socks5")
 	}
 	go ServeSocks5(ln, r)
+	if !acceptGuard(conn) {
+		return
+	}
+	defer connGuard.Release()
+	defer conn.Close()
+
+	handleSocks(conn, r)
+}
+
+// handleSocks serve the SOCKS4 / SOCKS5 connection
+func handleSocks(conn net.Conn, r *router.Router) {
+	// detect SOCKS version by the first byte
+	teeconn := teeconn.New(conn)
+	ver := make([]byte, 1)
+	if _, err := io.ReadFull(teeconn, ver); err != nil {
+		log.Warn().Err(err).Msg("read socks version")
+		return
+	}
+	teeconn.Stop().Reread()
+
+	var addr net.Addr
+	var err error
+	switch ver[0] {
+	case 4:
+		addr, err = socks4.New().Unwrap(teeconn)
+	default:
+		addr, err = socks5.New().Unwrap(teeconn)
+	}
+	if err != nil {
+		log.Warn().Err(err).
+			Uint8("version", ver[0]).
+			Msgf("parse socks target: %s", addr)
+		return
+	}
+
+	host, port := addr.(interface{ Addr() (string, uint16) }).Addr()
+	r.RouteHandle(teeconn, host, port)
+}
+
+// ServeHTTPProxy serve the HTTP proxy, CONNECT for HTTPS and absolute-URI
+// for plain HTTP, for the apps only support HTTP_PROXY
+func ServeHTTPProxy(ln net.Listener, r *router.Router) {
+	conn, err := ln.Accept()
+	if isClosed(err) {
+		return
+	} else if err != nil {
+		log.Fatal().Err(err).
+			Msg("serve http proxy")
+	}
+	go ServeHTTPProxy(ln, r)
+	if !acceptGuard(conn) {
+		return
+	}
+	defer connGuard.Release()
 	defer conn.Close()
 
-	addr, err := socks5.New().Unwrap(conn)
+	handleHTTPProxy(conn, r)
+}
+
+// handleHTTPProxy serve the HTTP proxy connection
+func handleHTTPProxy(conn net.Conn, r *router.Router) {
+	c, addr, err := httpproxy.New("", "").UnwrapConn(conn)
 	if err != nil {
 		log.Warn().Err(err).
-			Msgf("parse socks5 target: %s", addr)
+			Str("from", conn.RemoteAddr().String()).
+			Msg("parse http proxy target")
+		return
+	}
+
+	host, portStr, _ := net.SplitHostPort(addr.String())
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	r.RouteHandle(c, host, uint16(port))
+}
+
+// ServeMixed serve the SOCKS4 / SOCKS5 and the HTTP proxy on the same port,
+// detected by the first byte
+func ServeMixed(ln net.Listener, r *router.Router) {
+	conn, err := ln.Accept()
+	if isClosed(err) {
+		return
+	} else if err != nil {
+		log.Fatal().Err(err).
+			Msg("serve mixed")
+	}
+	go ServeMixed(ln, r)
+	if !acceptGuard(conn) {
+		return
+	}
+	defer connGuard.Release()
+	defer conn.Close()
+
+	teeconn := teeconn.New(conn)
+	ver := make([]byte, 1)
+	if _, err := io.ReadFull(teeconn, ver); err != nil {
+		log.Warn().Err(err).Msg("read mixed protocol")
 		return
 	}
+	teeconn.Stop().Reread()
 
-	host, port := addr.(*socks5.AddrHead).Addr()
-	r.RouteHandle(conn, host, port)
+	switch ver[0] {
+	case 4, 5:
+		handleSocks(teeconn, r)
+	default:
+		handleHTTPProxy(teeconn, r)
+	}
 }
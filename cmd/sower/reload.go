@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/router"
+)
+
+// applyRules load the rule files and replace the rules of the router. Nothing
+// is replaced if any rule file failed to load.
+func applyRules(r *router.Router, proxyDial router.ProxyDialFn, rc *routerConfig, ttlRules []string) error {
+	blockRules, err := loadRules(proxyDial, rc.Block.File, rc.Block.FileMode, rc.Block.FilePrefix)
+	if err != nil {
+		return err
+	}
+	directRules, err := loadRules(proxyDial, rc.Direct.File, rc.Direct.FileMode, rc.Direct.FilePrefix)
+	if err != nil {
+		return err
+	}
+	proxyRules, err := loadRules(proxyDial, rc.Proxy.File, rc.Proxy.FileMode, rc.Proxy.FilePrefix)
+	if err != nil {
+		return err
+	}
+	countryRules, err := loadRules(proxyDial, rc.Country.File, rc.Country.FileMode, rc.Country.FilePrefix)
+	if err != nil {
+		return err
+	}
+
+	r.SetBlockRules(append(expandGeoSite(proxyDial, rc.Block.Rules), blockRules...))
+	r.SetDirectRules(append(append(expandGeoSite(proxyDial, rc.Direct.Rules),
+		builtinDirectRules...), directRules...))
+	r.SetProxyRules(append(expandGeoSite(proxyDial, rc.Proxy.Rules), proxyRules...))
+	r.SetCountryCIDRs(append(rc.Country.Rules, countryRules...))
+	r.SetCountryExcludes(rc.Country.Excludes)
+	r.SetTTLRules(ttlRules)
+	return nil
+}
+
+// watchRules poll the config file and the local rule files every reload, and
+// the remote rule files every refresh, rebuild the rules once any of them
+// changed. The live connections are kept.
+func watchRules(reload, refresh time.Duration, r *router.Router, proxyDial router.ProxyDialFn) {
+	tick := reload
+	if tick <= 0 || (refresh > 0 && refresh < tick) {
+		tick = refresh
+	}
+
+	rc, ttlRules := conf.Router, conf.DNS.TTLRules
+	mtimes := modTimes(configFile, &rc)
+	nextRefresh := time.Now().Add(refresh)
+	for range time.Tick(tick) {
+		changed := false
+		if reload > 0 {
+			latest := modTimes(configFile, &rc)
+			changed = !maps.Equal(latest, mtimes)
+
+			if changed && configFile != "" && !latest[configFile].Equal(mtimes[configFile]) {
+				var fresh config
+				if _, _, err := loadConfig(&fresh); err != nil {
+					log.Error().Err(err).Str("file", configFile).Msg("reload config")
+					mtimes = latest
+					continue
+				}
+				rc, ttlRules = fresh.Router, fresh.DNS.TTLRules
+			}
+			mtimes = modTimes(configFile, &rc)
+		}
+
+		if refresh > 0 && !time.Now().Before(nextRefresh) {
+			nextRefresh = time.Now().Add(refresh)
+			if remoteChanged(proxyDial, &rc) {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		start := time.Now()
+		if err := applyRules(r, proxyDial, &rc, ttlRules); err != nil {
+			log.Error().Err(err).Msg("reload rules")
+			continue
+		}
+		log.Info().
+			Dur("spend", time.Since(start)).
+			Msg("Reloaded rules, changes other than the rule lists take effect after restart")
+	}
+}
+
+// modTimes return the modify time of the local files, zero if not exist
+func modTimes(configFile string, rc *routerConfig) map[string]time.Time {
+	mtimes := map[string]time.Time{}
+	for _, file := range []string{configFile,
+		rc.Block.File, rc.Direct.File, rc.Proxy.File, rc.Country.File} {
+		if file == "" || isURL(file) {
+			continue
+		}
+
+		if fi, err := os.Stat(file); err == nil {
+			mtimes[file] = fi.ModTime()
+		} else {
+			mtimes[file] = time.Time{}
+		}
+	}
+	return mtimes
+}
+
+// ruleFiles cache the fetched remote rule files, url -> *ruleFile
+var ruleFiles sync.Map
+
+type ruleFile struct {
+	etag         string
+	lastModified string
+	data         []byte
+}
+
+// fetchRuleFile fetch the remote rule file by conditional GET, return whether
+// it changed since the last fetch
+func fetchRuleFile(proxyDial router.ProxyDialFn, file string) ([]byte, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, file, nil)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "new request")
+	}
+
+	var prev *ruleFile
+	if val, ok := ruleFiles.Load(file); ok {
+		prev = val.(*ruleFile)
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+	}
+
+	resp, err := proxyClient(proxyDial).Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && prev != nil:
+		return prev.data, false, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, errors.Errorf("status code: %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "read body")
+	}
+	ruleFiles.Store(file, &ruleFile{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		data:         data,
+	})
+	return data, prev == nil || !bytes.Equal(prev.data, data), nil
+}
+
+// remoteChanged check whether any of the remote rule files changed
+func remoteChanged(proxyDial router.ProxyDialFn, rc *routerConfig) bool {
+	changed := false
+	for _, file := range []string{rc.Block.File, rc.Direct.File, rc.Proxy.File, rc.Country.File} {
+		if !isURL(file) {
+			continue
+		}
+
+		_, modified, err := fetchRuleFile(proxyDial, file)
+		if err != nil {
+			log.Warn().Err(err).Str("file", file).Msg("refresh remote rule file")
+			continue
+		}
+		changed = changed || modified
+	}
+	return changed
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/router"
+)
+
+// genRemoteDials generate the dials of the named remotes
+func genRemoteDials() map[string]router.ProxyDialFn {
+	dials := make(map[string]router.ProxyDialFn, len(remotes))
+	for tag, remote := range remotes {
+		dials[tag] = GenProxyDial(remote)
+	}
+	return dials
+}
+
+// parseRemote parse the named remote, the options not set are inherited from
+// base, eg: 'us trojan://pass@us.proxy.com:443?sni=cdn.com&mux.enable=true'
+func parseRemote(base remoteConfig, spec string) (string, *remoteConfig, error) {
+	tag, rawURL, ok := strings.Cut(strings.TrimSpace(spec), " ")
+	if !ok || tag == "" {
+		return "", nil, errors.Errorf("invalid remote: %s", spec)
+	}
+	if tag == defaultRemote {
+		return "", nil, errors.Errorf("remote tag '%s' is reserved for Remote", tag)
+	}
+
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "parse remote (%s)", tag)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", nil, errors.Errorf("invalid remote (%s): %s", tag, rawURL)
+	}
+
+	remote := base
+	remote.Type, remote.Addr = u.Scheme, u.Host
+	if u.User != nil {
+		password, hasPassword := u.User.Password()
+		switch {
+		case hasPassword:
+			remote.User, remote.Password = u.User.Username(), password
+		case remote.Type == "vmess":
+			remote.UUID = u.User.Username()
+		default: // the password only remotes, eg: trojan://password@proxy.com
+			remote.Password = u.User.Username()
+		}
+	}
+
+	for key, vals := range u.Query() {
+		if err := setOption(reflect.ValueOf(&remote).Elem(), key, vals[len(vals)-1]); err != nil {
+			return "", nil, errors.Wrapf(err, "remote (%s) option (%s)", tag, key)
+		}
+	}
+	return tag, &remote, nil
+}
+
+// setOption set the field of struct by the case insensitive dotted path
+func setOption(v reflect.Value, path, val string) error {
+	name, rest, nested := strings.Cut(path, ".")
+	field := v.FieldByNameFunc(func(s string) bool { return strings.EqualFold(s, name) })
+	if !field.IsValid() {
+		return errors.New("unknown option")
+	}
+	if nested {
+		if field.Kind() != reflect.Struct {
+			return errors.New("unknown option")
+		}
+		return setOption(field, rest, val)
+	}
+
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(val)
+	case bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		field.SetBool(b)
+	case int:
+		i, err := strconv.Atoi(val)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		field.SetInt(int64(i))
+	case time.Duration:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		field.SetInt(int64(d))
+	case []string:
+		field.Set(reflect.ValueOf(strings.Split(val, ",")))
+	default:
+		return errors.New("unsupported option")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/router"
+)
+
+// runRoute print how the destinations are routed by the configured rules,
+// without starting the proxy, eg:
+//
+//	sower -f sower.toml route www.google.com 8.8.8.8:53
+func runRoute(r *router.Router, proxyDial router.ProxyDialFn, dsts []string) error {
+	if len(dsts) == 0 {
+		return errors.New("usage: sower [flags] route <host>[:<port>] ...")
+	}
+	if err := applyRules(r, proxyDial, &conf.Router, conf.DNS.TTLRules); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DESTINATION\tROUTE\tREMOTE\tREASON")
+	for _, dst := range dsts {
+		host, port := dst, uint16(443)
+		if h, p, err := net.SplitHostPort(dst); err == nil {
+			n, err := strconv.ParseUint(p, 10, 16)
+			if err != nil {
+				return errors.Wrapf(err, "parse port of (%s)", dst)
+			}
+			host, port = h, uint16(n)
+		}
+
+		kind, rule, remote := r.Explain(host, port)
+		switch {
+		case kind == router.RuleBlock || kind == router.RuleDirect:
+			remote = "-"
+		case remote == "":
+			remote = defaultRemote
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", net.JoinHostPort(host, strconv.Itoa(int(port))), kind, remote, rule)
+	}
+	return w.Flush()
+}
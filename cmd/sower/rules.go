@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/router"
+	"gopkg.in/yaml.v2"
+)
+
+// parseRules parse the rule file, either a plain list with a rule per line,
+// which may be the surge / quantumult rules, or a clash rule-provider YAML of
+// behavior domain/ipcidr/classical
+func parseRules(r io.Reader, mode, linePrefix string) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if isRuleProvider(data) {
+		provider := struct {
+			Payload []string `yaml:"payload"`
+		}{}
+		if err := yaml.Unmarshal(data, &provider); err != nil {
+			return nil, errors.Wrap(err, "parse rule-provider")
+		}
+
+		rules := make([]string, 0, len(provider.Payload))
+		for _, item := range provider.Payload {
+			if rule, ok := convertProviderRule(strings.TrimSpace(item)); ok {
+				rules = append(rules, rule)
+			}
+		}
+		return rules, nil
+	}
+
+	var lines []string
+	adguard := isAdGuard(data)
+	br := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, _, err := br.ReadLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		text := strings.TrimSpace(string(line))
+		switch {
+		case text == "", strings.HasPrefix(text, "#"),
+			strings.HasPrefix(text, "//"), strings.HasPrefix(text, ";"):
+
+		// adguard syntax, where '!' starts a comment, eg: ||ads.example.com^
+		case adguard:
+			lines = append(lines, convertAdGuardRule(text, mode, linePrefix)...)
+
+		// hosts file, eg: 0.0.0.0 ads.example.com
+		case isHostsLine(text):
+			lines = append(lines, hostsRules(text)...)
+
+		// exception of the list, eg: !good.ads.com
+		case strings.HasPrefix(text, "!"):
+			if rule, ok := parseLine(strings.TrimSpace(text[1:]), mode, linePrefix); ok {
+				lines = append(lines, "!"+rule)
+			}
+
+		default:
+			if rule, ok := parseLine(text, mode, linePrefix); ok {
+				lines = append(lines, rule)
+			}
+		}
+	}
+	return lines, nil
+}
+
+// the matching modes of the plain list lines which are not typed rules,
+// empty mode parse the line as '<prefix>line_text'
+const (
+	modeExact    = "exact"    // the exact host, eg: www.google.com
+	modeSuffix   = "suffix"   // the domain and its subdomains, eg: google.com
+	modeWildcard = "wildcard" // the wildcard rule as is, eg: *.google.*
+	modeCIDR     = "cidr"     // the CIDR or IP, eg: 10.0.0.0/8, 10.0.0.1
+)
+
+// parseLine convert a line of the plain list into the rule
+func parseLine(text, mode, linePrefix string) (string, bool) {
+	switch {
+	// the typed rules are taken as is, eg: re:^img\d+\.cdn\.com$, kw:google
+	case strings.HasPrefix(text, "re:"), strings.HasPrefix(text, "kw:"), strings.HasPrefix(text, "port:"), strings.HasPrefix(text, "proc:"):
+		return text, true
+
+	// the host rules combined with the port or time, eg: **.example.com port:8080
+	case strings.HasPrefix(text, "time:"), strings.Contains(text, " time:"), strings.Contains(text, " port:"):
+		return text, true
+
+	// surge / quantumult rule, eg: DOMAIN-SUFFIX,google.com,Proxy
+	case strings.Contains(text, ","):
+		return convertClassicalRule(text)
+
+	// CIDR for the literal IP destinations, eg: 10.0.0.0/8
+	case isCIDR(text):
+		return text, true
+
+	// surge domain set, eg: .google.com
+	case strings.HasPrefix(text, "."):
+		return "**" + text, true
+
+	default:
+		return bareLine(text, mode, linePrefix)
+	}
+}
+
+// bareLine convert the line which is not a typed rule by the matching mode
+func bareLine(text, mode, linePrefix string) (string, bool) {
+	switch mode {
+	case modeExact:
+		if strings.Contains(text, "*") {
+			log.Debug().Str("rule", text).Msg("skip wildcard in exact list")
+			return "", false
+		}
+		return text, true
+	case modeSuffix:
+		return "**." + strings.TrimPrefix(strings.TrimPrefix(text, "*."), "."), true
+	case modeWildcard:
+		return text, true
+	case modeCIDR:
+		ip := net.ParseIP(text)
+		switch {
+		case ip == nil:
+			log.Debug().Str("rule", text).Msg("skip non-IP in cidr list")
+			return "", false
+		case ip.To4() != nil:
+			return text + "/32", true
+		default:
+			return text + "/128", true
+		}
+
+	// use line content as suffix
+	default:
+		return linePrefix + text, true
+	}
+}
+
+func isCIDR(text string) bool {
+	_, _, err := net.ParseCIDR(text)
+	return err == nil
+}
+
+// isAdGuard check if any line is in the adguard / adblock syntax
+func isAdGuard(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[Adblock") || strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+			return true
+		}
+	}
+	return false
+}
+
+// convertAdGuardRule convert the adguard rule, the rules with modifiers other
+// than $important are skipped, eg: ||ads.com^ / @@||good.ads.com^ / /^ad\d+\./
+func convertAdGuardRule(text, mode, linePrefix string) []string {
+	switch {
+	case strings.HasPrefix(text, "!"), strings.HasPrefix(text, "["):
+		return nil
+	case isHostsLine(text):
+		return hostsRules(text)
+	}
+
+	exception := ""
+	if strings.HasPrefix(text, "@@") {
+		exception, text = "!", text[2:]
+	}
+	text = strings.TrimSuffix(text, "$important")
+	if len(text) > 2 && strings.HasPrefix(text, "/") && strings.HasSuffix(text, "/") {
+		return []string{exception + "re:" + text[1:len(text)-1]}
+	}
+	if strings.Contains(text, "$") {
+		log.Debug().Str("rule", text).Msg("skip adguard rule with modifiers")
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(text, "||") && strings.HasSuffix(text, "^"):
+		return []string{exception + "**." + strings.TrimSuffix(text[2:], "^")}
+	case strings.ContainsAny(text, "|^#"):
+		log.Debug().Str("rule", text).Msg("skip unsupported adguard rule")
+		return nil
+	}
+
+	if rule, ok := parseLine(text, mode, linePrefix); ok {
+		return []string{exception + rule}
+	}
+	return nil
+}
+
+// isHostsLine check if the line is an IP followed by the hostnames only, so
+// that the typed rules of an IP are not taken, eg: 1.2.3.4 port:80
+func isHostsLine(text string) bool {
+	text, _, _ = strings.Cut(text, "#")
+	fields := strings.Fields(text)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return false
+	}
+	for _, host := range fields[1:] {
+		if !isHostname(host) {
+			return false
+		}
+	}
+	return true
+}
+
+// isHostname check if the text only contains the hostname characters
+func isHostname(text string) bool {
+	for _, c := range text {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return text != ""
+}
+
+// hostsRules convert the hosts of the hosts file line into the exact rules,
+// the loopback names are skipped
+func hostsRules(text string) []string {
+	text, _, _ = strings.Cut(text, "#")
+	var rules []string
+	for _, host := range strings.Fields(text)[1:] {
+		switch host {
+		case "localhost", "localhost.localdomain", "local", "broadcasthost",
+			"ip6-localhost", "ip6-loopback", "0.0.0.0":
+		default:
+			rules = append(rules, host)
+		}
+	}
+	return rules
+}
+
+// isRuleProvider check if the first non-comment line is the payload key
+func isRuleProvider(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return strings.HasPrefix(line, "payload:")
+	}
+	return false
+}
+
+// convertProviderRule convert the payload item of rule-provider
+func convertProviderRule(item string) (string, bool) {
+	switch {
+	case item == "" || strings.HasPrefix(item, "#"):
+		return "", false
+
+	case strings.Contains(item, ","): // classical
+		return convertClassicalRule(item)
+
+	case strings.HasPrefix(item, "+."), strings.HasPrefix(item, "."):
+		return "**." + strings.TrimLeft(item, "+."), true
+
+	default: // domain, wildcard or CIDR
+		return item, true
+	}
+}
+
+// convertClassicalRule convert the clash classical, surge or quantumult rule,
+// eg: DOMAIN-SUFFIX,google.com / HOST-SUFFIX,google.com,proxy. The policy
+// field is ignored, the rule belongs to the list it is loaded into.
+func convertClassicalRule(item string) (string, bool) {
+	fields := strings.Split(item, ",")
+	if len(fields) < 2 {
+		return "", false
+	}
+
+	typ, value := strings.ToUpper(strings.TrimSpace(fields[0])), strings.TrimSpace(fields[1])
+	switch typ {
+	case "DOMAIN", "HOST":
+		return value, true
+	case "DOMAIN-SUFFIX", "HOST-SUFFIX":
+		return "**." + value, true
+	case "DOMAIN-KEYWORD", "HOST-KEYWORD":
+		return "kw:" + value, true
+	case "DOMAIN-REGEX":
+		return "re:" + value, true
+	case "IP-CIDR", "IP-CIDR6", "IP6-CIDR":
+		return value, true
+	case "PROCESS-NAME":
+		return "proc:" + value, true
+	default:
+		log.Debug().Str("rule", item).Msg("skip unsupported rule")
+		return "", false
+	}
+}
+
+// loadRules load the rule file, a malformed file is logged and skipped
+func loadRules(proxyDial router.ProxyDialFn, file, mode, linePrefix string) ([]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+	switch mode {
+	case "", modeExact, modeSuffix, modeWildcard, modeCIDR:
+	default:
+		return nil, errors.Errorf("unknown matching mode (%s) of rule file (%s)", mode, file)
+	}
+
+	var rc io.ReadCloser
+	if isURL(file) {
+		err := retry(func() error {
+			data, _, err := fetchRuleFile(proxyDial, file)
+			rc = io.NopCloser(bytes.NewReader(data))
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "load rule file (%s)", file)
+		}
+	} else {
+		var err error
+		if rc, err = openFile(proxyDial, file); err != nil {
+			return nil, errors.Wrapf(err, "load rule file (%s)", file)
+		}
+	}
+	defer rc.Close()
+
+	// parse rule file into rule tree
+	lines, err := parseRules(rc, mode, linePrefix)
+	if err != nil {
+		log.Error().Err(err).
+			Str("file", file).
+			Msg("parse rule file")
+		return nil, nil
+	}
+	return lines, nil
+}
+
+// loadHosts load the hosts file as the static hosts entries, the comments and
+// the blank lines are skipped
+func loadHosts(file string) ([]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read hosts file (%s)", file)
+	}
+
+	var entries []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, nil
+}
+
+// openFile open the local file, or fetch the remote file through proxy, retry 10 times
+func openFile(proxyDial router.ProxyDialFn, file string) (io.ReadCloser, error) {
+	var loadFn func() (io.ReadCloser, error)
+	if isURL(file) {
+		// load rule file from remote by HTTP
+		client := proxyClient(proxyDial)
+		loadFn = func() (io.ReadCloser, error) {
+			resp, err := client.Get(file)
+			if err != nil {
+				return nil, err
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				return nil, errors.Errorf("status code: %d", resp.StatusCode)
+			}
+
+			return resp.Body, nil
+		}
+
+	} else {
+		// load rule file from local file
+		loadFn = func() (io.ReadCloser, error) {
+			return os.Open(file)
+		}
+	}
+
+	var rc io.ReadCloser
+	err := retry(func() (err error) {
+		rc, err = loadFn()
+		return err
+	})
+	return rc, err
+}
+
+// proxyClient is the HTTP client dialing through the proxy
+func proxyClient(proxyDial router.ProxyDialFn) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				domain, port, _ := net.SplitHostPort(addr)
+				p, _ := strconv.Atoi(port)
+				return proxyDial("tcp", domain, uint16(p))
+			},
+		},
+	}
+}
+
+// retry call fn until success, at most 10 times
+func retry(fn func() error) error {
+	err := fn()
+	for i := time.Duration(1); i < 10; i++ {
+		if err == nil {
+			break
+		}
+
+		// wait: 28.5s
+		time.Sleep(i * i * 100 * time.Millisecond)
+		err = fn()
+	}
+	return err
+}
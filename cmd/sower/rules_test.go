@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		mode  string
+		input string
+		want  []string
+	}{{
+		name: "plain list",
+		input: `# comment
+// comment
+; comment
+google.com
+!good.google.com
+re:^img\d+\.cdn\.com$
+kw:track
+port:25
+**.example.com port:8080
+10.0.0.0/8
+.apple.com`,
+		want: []string{"**.google.com", "!**.good.google.com", `re:^img\d+\.cdn\.com$`, "kw:track",
+			"port:25", "**.example.com port:8080", "10.0.0.0/8", "**.apple.com"},
+	}, {
+		name: "exact mode",
+		mode: modeExact,
+		input: `www.google.com
+*.google.com`,
+		want: []string{"www.google.com"},
+	}, {
+		name: "cidr mode",
+		mode: modeCIDR,
+		input: `10.0.0.1
+::1
+192.168.0.0/16
+google.com`,
+		want: []string{"10.0.0.1/32", "::1/128", "192.168.0.0/16"},
+	}, {
+		name: "surge and quantumult classical",
+		input: `DOMAIN,www.google.com,Proxy
+DOMAIN-SUFFIX,google.com
+HOST-SUFFIX,apple.com,direct
+DOMAIN-KEYWORD,track
+IP-CIDR,10.0.0.0/8,no-resolve
+PROCESS-NAME,chrome.exe
+GEOIP,CN`,
+		want: []string{"www.google.com", "**.google.com", "**.apple.com", "kw:track", "10.0.0.0/8", "proc:chrome.exe"},
+	}, {
+		name: "clash rule-provider",
+		input: `# comment
+payload:
+  - '+.google.com'
+  - '.apple.com'
+  - 'www.example.com'
+  - '10.0.0.0/8'
+  - DOMAIN-SUFFIX,github.com`,
+		want: []string{"**.google.com", "**.apple.com", "www.example.com", "10.0.0.0/8", "**.github.com"},
+	}, {
+		name: "adguard",
+		input: `[Adblock Plus 2.0]
+! comment
+||ads.example.com^
+@@||good.ads.example.com^
+||track.io^$important
+||third.com^$third-party
+/^ad\d+\.cdn\.net$/
+example.com##.banner
+|http://exact.com|
+0.0.0.0 hosted.ad.com`,
+		want: []string{"**.ads.example.com", "!**.good.ads.example.com", "**.track.io",
+			`re:^ad\d+\.cdn\.net$`, "hosted.ad.com"},
+	}, {
+		name: "hosts file",
+		input: `127.0.0.1 localhost
+::1 ip6-localhost ip6-loopback
+0.0.0.0 evil.com tracker.net # trackers
+1.2.3.4 port:80
+10.0.0.1 time:22:00-06:00`,
+		want: []string{"evil.com", "tracker.net", "1.2.3.4 port:80", "10.0.0.1 time:22:00-06:00"},
+	}} {
+		got, err := parseRules(strings.NewReader(tc.input), tc.mode, "**.")
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s:\n got  %q\n want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/router"
+)
+
+// service is a listening service, which can be rebound after network changed
+type service struct {
+	name, addr string
+	start      func() (io.Closer, error)
+	closer     io.Closer
+}
+
+var services []*service
+
+type closerFunc func() error
+
+func (fn closerFunc) Close() error { return fn() }
+
+// startService start the service, and register it for rebinding
+func startService(svc *service) {
+	closer, err := svc.start()
+	if err != nil {
+		log.Fatal().Err(err).
+			Str("service", svc.name).
+			Str("addr", svc.addr).
+			Msg("listen port")
+	}
+
+	svc.closer = closer
+	services = append(services, svc)
+	log.Info().
+		Str("service", svc.name).
+		Str("addr", svc.addr).
+		Msg("service started")
+}
+
+func tcpService(name, addr string, serve func(ln net.Listener)) *service {
+	return &service{
+		name: name,
+		addr: addr,
+		start: func() (io.Closer, error) {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+
+			go serve(ln)
+			return ln, nil
+		},
+	}
+}
+
+// dnsService serve the DNS over both UDP and TCP of the address
+func dnsService(name, addr string, handler dns.Handler) *service {
+	return &service{
+		name: name,
+		addr: addr,
+		start: func() (io.Closer, error) {
+			pc, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				return nil, err
+			}
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				pc.Close()
+				return nil, err
+			}
+
+			udpSrv := &dns.Server{PacketConn: pc, Handler: handler}
+			tcpSrv := &dns.Server{Listener: ln, Net: "tcp", Handler: handler}
+			for _, srv := range []*dns.Server{udpSrv, tcpSrv} {
+				go func(srv *dns.Server) {
+					if err := srv.ActivateAndServe(); err != nil && !errors.Is(err, net.ErrClosed) {
+						log.Error().Err(err).Str("addr", addr).Msg("serve dns")
+					}
+				}(srv)
+			}
+			return closerFunc(func() error {
+				udpErr, tcpErr := udpSrv.Shutdown(), tcpSrv.Shutdown()
+				if udpErr != nil {
+					return udpErr
+				}
+				return tcpErr
+			}), nil
+		},
+	}
+}
+
+func dotService(name, addr string, conf *tls.Config, handler dns.Handler) *service {
+	return &service{
+		name: name,
+		addr: addr,
+		start: func() (io.Closer, error) {
+			ln, err := tls.Listen("tcp", addr, conf)
+			if err != nil {
+				return nil, err
+			}
+
+			srv := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: handler}
+			go func() {
+				if err := srv.ActivateAndServe(); err != nil && !errors.Is(err, net.ErrClosed) {
+					log.Error().Err(err).Str("addr", addr).Msg("serve dot")
+				}
+			}()
+			return closerFunc(srv.Shutdown), nil
+		},
+	}
+}
+
+// startHijack listen the HTTP and HTTPS ports of the serve IP for the domains
+// answered by it, the service names are suffixed
+func startHijack(serveIP, suffix string, r *router.Router) {
+	if port := conf.DNS.Ports.HTTP; port != 0 {
+		startService(tcpService("http"+suffix, net.JoinHostPort(serveIP, strconv.Itoa(port)),
+			func(ln net.Listener) { ServeHTTP(ln, r) }))
+	}
+	if port := conf.DNS.Ports.HTTPS; port != 0 {
+		startService(tcpService("https"+suffix, net.JoinHostPort(serveIP, strconv.Itoa(port)),
+			func(ln net.Listener) { ServeHTTPS(ln, r) }))
+	}
+}
+
+// rebindServices re-listen the services which bind to a specific interface IP
+func rebindServices() {
+	for _, svc := range services {
+		host, _, _ := net.SplitHostPort(svc.addr)
+		if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+			continue
+		}
+
+		svc.closer.Close()
+		closer, err := svc.start()
+		if err != nil {
+			log.Error().Err(err).
+				Str("service", svc.name).
+				Str("addr", svc.addr).
+				Msg("rebind service")
+			continue
+		}
+
+		svc.closer = closer
+		log.Info().
+			Str("service", svc.name).
+			Str("addr", svc.addr).
+			Msg("service rebound")
+	}
+}
+
+// isClosed check if the accept error is caused by rebinding
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/pkg/breaker"
+	"github.com/wweir/sower/pkg/dialer"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshAuthMethods build the auth methods of sshd remote, in the order of
+// private key, ssh-agent and password
+func sshAuthMethods(remote *remoteConfig) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if remote.KeyFile != "" {
+		key, err := os.ReadFile(remote.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read key file")
+		}
+
+		var signer ssh.Signer
+		if remote.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(remote.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "parse private key")
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if remote.Agent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, errors.New("SSH_AUTH_SOCK is not set")
+		}
+
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, errors.Wrap(err, "connect ssh-agent")
+		}
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	if remote.Password != "" || len(methods) == 0 {
+		methods = append(methods, ssh.Password(remote.Password))
+	}
+	return methods, nil
+}
+
+// sshHostKeyCallbacks build the host key verification of each hop, by the
+// known_hosts file and the pinned keys. The pinned keys are separated by comma
+// in the order of the hops, each one is a SHA256 fingerprint or an
+// authorized_keys format public key. Only a single hop sshd is allowed to skip
+// the verification, a jump chain must verify every hop.
+func sshHostKeyCallbacks(knownHosts, pinned string, hops int) ([]ssh.HostKeyCallback, error) {
+	var pins []string
+	if pinned != "" {
+		for _, pin := range strings.Split(pinned, ",") {
+			pins = append(pins, strings.TrimSpace(pin))
+		}
+		if len(pins) != hops {
+			return nil, errors.Errorf("%d host keys pinned for %d sshd hops", len(pins), hops)
+		}
+	}
+
+	var khCallback ssh.HostKeyCallback
+	if knownHosts != "" {
+		var err error
+		if khCallback, err = knownhosts.New(knownHosts); err != nil {
+			return nil, errors.Wrap(err, "load known_hosts")
+		}
+	}
+
+	callbacks := make([]ssh.HostKeyCallback, hops)
+	for i := range callbacks {
+		var pin string
+		if pins != nil {
+			pin = pins[i]
+		}
+		if pin == "" && khCallback == nil {
+			if hops > 1 {
+				return nil, errors.Errorf("sshd hop %d has no host key to verify, set KnownHosts or HostKey", i+1)
+			}
+			log.Warn().Msg("sshd host key is not verified, set KnownHosts or HostKey")
+			callbacks[i] = ssh.InsecureIgnoreHostKey()
+			continue
+		}
+
+		var err error
+		if callbacks[i], err = sshHostKeyCallback(khCallback, pin); err != nil {
+			return nil, errors.Wrapf(err, "sshd hop %d", i+1)
+		}
+	}
+	return callbacks, nil
+}
+
+// sshHostKeyCallback verify the host key by the pinned key and the known_hosts,
+// reject the connection on mismatch
+func sshHostKeyCallback(khCallback ssh.HostKeyCallback, pin string) (ssh.HostKeyCallback, error) {
+	var pinCallback ssh.HostKeyCallback
+	switch {
+	case pin == "":
+	case strings.HasPrefix(pin, "SHA256:"):
+		pinCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if fp := ssh.FingerprintSHA256(key); fp != pin {
+				return errors.Errorf("host key fingerprint mismatch: %s", fp)
+			}
+			return nil
+		}
+	default:
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pin))
+		if err != nil {
+			return nil, errors.Wrap(err, "parse pinned host key")
+		}
+		pinCallback = ssh.FixedHostKey(key)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if pinCallback != nil {
+			if err := pinCallback(hostname, remote, key); err != nil {
+				return err
+			}
+		}
+		if khCallback != nil {
+			return khCallback(hostname, remote, key)
+		}
+		return nil
+	}, nil
+}
+
+// sshHop is a hop of the sshd chain, in the format of [user@]host[:port]
+type sshHop struct {
+	user, addr string
+}
+
+func parseSSHHops(chain string) []sshHop {
+	var hops []sshHop
+	for _, hop := range strings.Split(chain, ",") {
+		hop = strings.TrimSpace(hop)
+		if hop == "" {
+			continue
+		}
+
+		var user string
+		if i := strings.LastIndex(hop, "@"); i >= 0 {
+			user, hop = hop[:i], hop[i+1:]
+		}
+		if _, _, err := net.SplitHostPort(hop); err != nil {
+			hop = net.JoinHostPort(hop, "22")
+		}
+		hops = append(hops, sshHop{user: user, addr: hop})
+	}
+	return hops
+}
+
+// sshDialer dial targets through the sshd remote, jumping through the hops
+// before the last one like OpenSSH's ProxyJump. The broken ssh connection
+// is detected by keepalive and re-dialed with backoff on demand.
+type sshDialer struct {
+	hops      []sshHop
+	config    *ssh.ClientConfig
+	hostKeys  []ssh.HostKeyCallback // host key verification of each hop
+	keepAlive time.Duration
+	cb        *breaker.Breaker
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func newSSHDialer(hops []sshHop, config *ssh.ClientConfig, hostKeys []ssh.HostKeyCallback, keepAlive time.Duration) *sshDialer {
+	return &sshDialer{
+		hops:      hops,
+		config:    config,
+		hostKeys:  hostKeys,
+		keepAlive: keepAlive,
+		cb:        breaker.New(1, time.Second, time.Minute),
+	}
+}
+
+// connect dial the hops one by one, the jump clients are closed with the last one
+func (d *sshDialer) connect() (*ssh.Client, error) {
+	if len(d.hops) == 0 {
+		return nil, errors.New("no sshd address")
+	}
+
+	var clients []*ssh.Client
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+
+	for i, hop := range d.hops {
+		config := *d.config
+		config.HostKeyCallback = d.hostKeys[i]
+		if hop.user != "" {
+			config.User = hop.user
+		}
+
+		var conn net.Conn
+		var err error
+		if i == 0 {
+			conn, err = dialer.Remote(config.Timeout).Dial("tcp", hop.addr)
+		} else {
+			conn, err = clients[i-1].Dial("tcp", hop.addr)
+		}
+		if err != nil {
+			closeAll()
+			return nil, errors.Wrapf(err, "dial %s", hop.addr)
+		}
+
+		c, chans, reqs, err := ssh.NewClientConn(conn, hop.addr, &config)
+		if err != nil {
+			conn.Close()
+			closeAll()
+			return nil, errors.Wrapf(err, "connect %s", hop.addr)
+		}
+		clients = append(clients, ssh.NewClient(c, chans, reqs))
+	}
+
+	last := clients[len(clients)-1]
+	go func() {
+		_ = last.Wait()
+		closeAll()
+	}()
+	return last, nil
+}
+
+func (d *sshDialer) Dial(host string, port uint16) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	client, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial("tcp", addr)
+	if err == nil {
+		return conn, nil
+	}
+	// the target is refused or unreachable by sshd, the session is still alive
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		return nil, err
+	}
+
+	// the ssh connection may be broken silently, re-connect and retry once
+	log.Warn().Err(err).Msg("dial through sshd failed, re-connect")
+	d.drop(client)
+	if client, err = d.getClient(); err != nil {
+		return nil, err
+	}
+	return client.Dial("tcp", addr)
+}
+
+func (d *sshDialer) getClient() (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	if err := d.cb.Allow(); err != nil {
+		return nil, errors.Wrap(err, "re-connect sshd")
+	}
+	client, err := d.connect()
+	if err != nil {
+		d.cb.Failure()
+		return nil, errors.Wrap(err, "connect sshd")
+	}
+	d.cb.Success()
+
+	d.client = client
+	go func() {
+		_ = client.Wait()
+		d.drop(client)
+	}()
+	if d.keepAlive > 0 {
+		go d.keepalive(client)
+	}
+	return client, nil
+}
+
+// keepalive probe the ssh connection, drop it if no reply in time
+func (d *sshDialer) keepalive(client *ssh.Client) {
+	ticker := time.NewTicker(d.keepAlive)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			errCh <- err
+		}()
+
+		select {
+		case err := <-errCh:
+			if err == nil {
+				continue
+			}
+			log.Warn().Err(err).Msg("sshd keepalive failed")
+		case <-time.After(d.keepAlive):
+			log.Warn().Msg("sshd keepalive timeout")
+		}
+		d.drop(client)
+		return
+	}
+}
+
+func (d *sshDialer) drop(client *ssh.Client) {
+	d.mu.Lock()
+	if d.client == client {
+		d.client = nil
+	}
+	d.mu.Unlock()
+	client.Close()
+}
+
+// reset drop the current ssh connection, eg: after network changed
+func (d *sshDialer) reset() {
+	d.mu.Lock()
+	client := d.client
+	d.mu.Unlock()
+	if client != nil {
+		d.drop(client)
+	}
+}
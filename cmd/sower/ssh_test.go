@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHHostKeyCallbacks(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	jump, last := newKey(), newKey()
+	pinned := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(jump))) + "," + ssh.FingerprintSHA256(last)
+
+	for _, tt := range []struct {
+		name    string
+		pinned  string
+		hops    int
+		wantErr bool
+	}{
+		{"single hop unverified", "", 1, false},
+		{"jump chain unverified", "", 2, true},
+		{"partial pinned chain", "," + ssh.FingerprintSHA256(last), 2, true},
+		{"pins mismatch hops", ssh.FingerprintSHA256(last), 2, true},
+		{"bad public key", "ssh-ed25519 sower", 1, true},
+		{"pinned chain", pinned, 2, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			callbacks, err := sshHostKeyCallbacks("", tt.pinned, tt.hops)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if err != nil || tt.pinned == "" {
+				return
+			}
+
+			for i, key := range []ssh.PublicKey{jump, last} {
+				if err := callbacks[i]("sower", nil, key); err != nil {
+					t.Errorf("hop %d rejects the pinned key: %v", i+1, err)
+				}
+				if err := callbacks[i]("sower", nil, newKey()); err == nil {
+					t.Errorf("hop %d accepts an unknown key", i+1)
+				}
+			}
+		})
+	}
+}
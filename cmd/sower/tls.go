@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// remoteTLSConfig build the TLS config to dial the sower/trojan remote.
+// Sessions are resumed by ticket, crypto/tls does not send 0-RTT early data.
+func remoteTLSConfig(remote *remoteConfig, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(32),
+	}
+
+	if remote.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(remote.CertFile, remote.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if remote.CAFile != "" {
+		pem, err := os.ReadFile(remote.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read CA file")
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in %s", remote.CAFile)
+		}
+	}
+
+	if len(remote.PinSHA256) != 0 {
+		pins := map[string]bool{}
+		for _, pin := range remote.PinSHA256 {
+			if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+				return nil, errors.Errorf("invalid SPKI pin: %s", pin)
+			}
+			pins[pin] = true
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs.PeerCertificates, pins)
+		}
+	}
+
+	return cfg, nil
+}
+
+// verifyPins check if any certificate in the chain matches the SPKI pins
+func verifyPins(certs []*x509.Certificate, pins map[string]bool) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+	return errors.New("remote certificate does not match the SPKI pins")
+}
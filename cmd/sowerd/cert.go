@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+)
+
+// certStore holds the configured certificate/key pairs, selects a
+// certificate by SNI and reloads them once the files are changed.
+type certStore struct {
+	certFiles, keyFiles []string
+	fallback            func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	mu      sync.RWMutex
+	certs   []*tls.Certificate
+	modTime time.Time
+}
+
+func newCertStore(certFiles, keyFiles []string,
+	fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*certStore, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, errors.Errorf("%d certificates with %d keys", len(certFiles), len(keyFiles))
+	}
+
+	s := &certStore{
+		certFiles: certFiles,
+		keyFiles:  keyFiles,
+		fallback:  fallback,
+	}
+	return s, s.load()
+}
+
+func (s *certStore) lastModTime() (last time.Time) {
+	for _, files := range [][]string{s.certFiles, s.keyFiles} {
+		for _, file := range files {
+			if fi, err := os.Stat(file); err == nil && fi.ModTime().After(last) {
+				last = fi.ModTime()
+			}
+		}
+	}
+	return last
+}
+
+func (s *certStore) load() error {
+	modTime := s.lastModTime()
+	certs := make([]*tls.Certificate, 0, len(s.certFiles))
+	for i := range s.certFiles {
+		cert, err := tls.LoadX509KeyPair(s.certFiles[i], s.keyFiles[i])
+		if err != nil {
+			return errors.Wrapf(err, "load certificate %s", s.certFiles[i])
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return errors.Wrapf(err, "parse certificate %s", s.certFiles[i])
+		}
+		certs = append(certs, &cert)
+	}
+
+	s.mu.Lock()
+	s.certs, s.modTime = certs, modTime
+	s.mu.Unlock()
+	return nil
+}
+
+// watch reload certificates on SIGHUP or files changed
+func (s *certStore) watch(interval time.Duration) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sigCh:
+		case <-ticker.C:
+			s.mu.RLock()
+			modTime := s.modTime
+			s.mu.RUnlock()
+			if !s.lastModTime().After(modTime) {
+				continue
+			}
+		}
+
+		err := s.load()
+		log.InfoWarn(err).
+			Strs("certs", s.certFiles).
+			Msg("reload certificates")
+	}
+}
+
+// GetCertificate select the certificate by SNI. If nothing matched, the
+// fallback(ACME) is used, or the first certificate is returned.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	certs := s.certs
+	s.mu.RUnlock()
+
+	for _, cert := range certs {
+		if hello.ServerName != "" && cert.Leaf.VerifyHostname(hello.ServerName) == nil &&
+			hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+
+	if s.fallback != nil && hello.ServerName != "" {
+		return s.fallback(hello)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate configured")
+	}
+	return certs[0], nil
+}
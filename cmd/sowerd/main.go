@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"net/http"
 	"os"
@@ -9,10 +10,11 @@ import (
 	"time"
 
 	"github.com/cristalhq/aconfig"
-	"github.com/sower-proxy/conns/relay"
 	"github.com/sower-proxy/conns/teeconn"
 	"github.com/sower-proxy/deferlog"
 	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/pkg/relay"
+	"github.com/wweir/sower/pkg/wsconn"
 	"github.com/wweir/sower/transport/sower"
 	"github.com/wweir/sower/transport/trojan"
 	"golang.org/x/crypto/acme/autocert"
@@ -25,11 +27,15 @@ var (
 		ServeIP  string `usage:"listen to port 80 443 of this IP, eg: 0.0.0.0"`
 		Password string `required:"true"`
 		FakeSite string `required:"true" default:"127.0.0.1:8080" usage:"fake site address"`
+		WSPath   string `usage:"websocket path for sower/trojan behind CDN, eg: /ws, empty to disable"`
 
 		Cert struct {
-			Email string
-			Cert  string
-			Key   string
+			Email string   `usage:"ACME email, also enables ACME for domains not covered by the certificates"`
+			Cert  []string `usage:"certificate files, pairs with key files by order"`
+			Key   []string `usage:"key files, pairs with certificate files by order"`
+
+			ClientCA          string `usage:"CA file to verify the client certificates"`
+			RequireClientCert bool   `default:"false" usage:"serve sower/trojan for verified client certificates only, others see the fake site"`
 		}
 	}{}
 )
@@ -63,14 +69,34 @@ func main() {
 		MinVersion:     tls.VersionTLS12,
 		NextProtos:     []string{"http/1.1", "h2"},
 	}
-	if conf.Cert.Cert != "" || conf.Cert.Key != "" {
-		cert, err := tls.LoadX509KeyPair(conf.Cert.Cert, conf.Cert.Key)
+	if len(conf.Cert.Cert) != 0 || len(conf.Cert.Key) != 0 {
+		var fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+		if conf.Cert.Email != "" {
+			fallback = certManager.GetCertificate
+		}
+
+		store, err := newCertStore(conf.Cert.Cert, conf.Cert.Key, fallback)
 		if err != nil {
 			log.Fatal().Err(err).Msg("load certificate")
 		}
+		go store.watch(time.Minute)
 
-		tlsConf.GetCertificate = nil
-		tlsConf.Certificates = []tls.Certificate{cert}
+		tlsConf.GetCertificate = store.GetCertificate
+	}
+
+	if conf.Cert.RequireClientCert && conf.Cert.ClientCA == "" {
+		log.Fatal().Msg("client CA is required to verify client certificates")
+	}
+	if conf.Cert.ClientCA != "" {
+		pem, err := os.ReadFile(conf.Cert.ClientCA)
+		if err != nil {
+			log.Fatal().Err(err).Msg("read client CA")
+		}
+		tlsConf.ClientCAs = x509.NewCertPool()
+		if !tlsConf.ClientCAs.AppendCertsFromPEM(pem) {
+			log.Fatal().Str("file", conf.Cert.ClientCA).Msg("no certificate found in client CA")
+		}
+		tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
 	}
 
 	// Redirect 80 to 443
@@ -87,6 +113,7 @@ func main() {
 		Str("IP", conf.ServeIP).
 		Msg("Start listen HTTPS service")
 
+	go reportStats(time.Hour)
 	go serve443(ln, conf.FakeSite, sower.New(conf.Password), trojan.New(conf.Password))
 	select {}
 }
@@ -108,13 +135,45 @@ func serve443(ln net.Listener, fakeSite string, sower *sower.Sower, trojan *troj
 		log.Fatal().Err(err).Msg("serve 443 port")
 	}
 	go serve443(ln, fakeSite, sower, trojan)
+	if conf.Cert.RequireClientCert && !verifiedClient(conn) {
+		defer conn.Close()
+		dur, err := relay.RelayTo(conn, fakeSite)
+		deferlog.DebugWarn(err).
+			Dur("spend", dur).
+			Msg("relay unverified client to fake site")
+		return
+	}
+	serveConn(conn, fakeSite, sower, trojan)
+}
+
+// verifiedClient check if the client presents a certificate signed by the client CA
+func verifiedClient(conn net.Conn) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+
+	_ = tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer tlsConn.SetDeadline(time.Time{})
+	if err := tlsConn.Handshake(); err != nil {
+		return false
+	}
+	return len(tlsConn.ConnectionState().VerifiedChains) != 0
+}
+
+// serveConn detect the underlaying protocol of conn and relay it.
+// Connections upgraded to websocket are served again without fake site.
+func serveConn(conn net.Conn, fakeSite string, sower *sower.Sower, trojan *trojan.Trojan) {
+	var err error
 	teeconn := teeconn.New(conn)
 	defer teeconn.Close()
 
 	var addr net.Addr
+	var client string
 	var dur time.Duration
 	defer func() {
 		deferlog.DebugWarn(err).
+			Str("client", client).
 			Dur("spend", dur).
 			Msgf("relay conn to %s", addr)
 	}()
@@ -123,8 +182,15 @@ func serve443(ln net.Listener, fakeSite string, sower *sower.Sower, trojan *troj
 	teeconn.Reread()
 	if addr, err = sower.Unwrap(teeconn); err == nil {
 		teeconn.Stop()
+		client = clientOf(addr)
+		if isMux(addr) {
+			dur, err = serveMux(teeconn, sower, trojan)
+			return
+		}
 
-		dur, err = relay.RelayTo(teeconn, addr.String())
+		conn := newCountConn(teeconn, client)
+		defer conn.done()
+		dur, err = relay.RelayTo(conn, addr.String())
 		return
 	}
 
@@ -132,12 +198,40 @@ func serve443(ln net.Listener, fakeSite string, sower *sower.Sower, trojan *troj
 	teeconn.Reread()
 	if addr, err = trojan.Unwrap(teeconn); err == nil {
 		teeconn.Stop()
+		if isMux(addr) {
+			dur, err = serveMux(teeconn, sower, trojan)
+			return
+		}
+		if addr.Network() == "mux" {
+			dur, err = serveTrojanMux(teeconn)
+			return
+		}
 
-		dur, err = relay.RelayTo(teeconn, addr.String())
+		conn := newCountConn(teeconn, client)
+		defer conn.done()
+		if addr.Network() == "udp" {
+			dur, err = relayUDP(conn)
+			return
+		}
+		dur, err = relay.RelayTo(conn, addr.String())
 		return
 	}
 
-	// 3. fallback to fake site
+	// 3. detect if it's a websocket underlaying connection, eg: behind CDN
+	if conf.WSPath != "" && fakeSite != "" {
+		teeconn.Reread()
+		if ws, wsErr := wsconn.Accept(teeconn, conf.WSPath); wsErr == nil {
+			teeconn.Stop()
+			err = nil
+			serveConn(ws, "", sower, trojan)
+			return
+		}
+	}
+
+	// 4. fallback to fake site
+	if fakeSite == "" {
+		return
+	}
 	teeconn.Stop().Reread()
 	dur, err = relay.RelayTo(teeconn, fakeSite)
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/sower-proxy/deferlog"
+	"github.com/wweir/sower/pkg/mux"
+	"github.com/wweir/sower/pkg/relay"
+	"github.com/wweir/sower/transport/sower"
+	"github.com/wweir/sower/transport/trojan"
+)
+
+func isMux(addr net.Addr) bool {
+	host, _, _ := net.SplitHostPort(addr.String())
+	return host == mux.Host
+}
+
+// serveMux serve each stream of the mux session as an underlaying connection
+func serveMux(conn net.Conn, sower *sower.Sower, trojan *trojan.Trojan) (time.Duration, error) {
+	start := time.Now()
+	sess := mux.Server(conn)
+	defer sess.Close()
+
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			return time.Since(start), nil
+		}
+		go serveConn(stream, "", sower, trojan)
+	}
+}
+
+// serveTrojanMux serve the trojan-go mux session, streams start with simplesocks request
+func serveTrojanMux(conn net.Conn) (time.Duration, error) {
+	start := time.Now()
+	sess := mux.Server(conn)
+	defer sess.Close()
+
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			return time.Since(start), nil
+		}
+		go serveSimpleSocks(stream)
+	}
+}
+
+func serveSimpleSocks(stream net.Conn) {
+	var err error
+	var addr net.Addr
+	var dur time.Duration
+	defer func() {
+		deferlog.DebugWarn(err).
+			Dur("spend", dur).
+			Msgf("relay mux stream to %s", addr)
+	}()
+
+	conn := newCountConn(stream, "")
+	defer conn.Close()
+	defer conn.done()
+
+	if addr, err = (trojan.SimpleSocks{}).Unwrap(conn); err != nil {
+		return
+	}
+	if addr.Network() == "udp" {
+		dur, err = relayUDP(conn)
+		return
+	}
+	dur, err = relay.RelayTo(conn, addr.String())
+}
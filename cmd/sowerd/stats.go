@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/transport/sower"
+)
+
+// clientStat is the accounting of a client, identified by the client id
+type clientStat struct {
+	conns    int64
+	active   int64
+	upload   int64
+	download int64
+}
+
+var stats sync.Map // client id -> *clientStat
+
+func clientOf(addr net.Addr) string {
+	if ca, ok := addr.(*sower.ClientAddr); ok {
+		return ca.Client
+	}
+	return ""
+}
+
+func statOf(client string) *clientStat {
+	if client == "" {
+		client = "-"
+	}
+	val, _ := stats.LoadOrStore(client, &clientStat{})
+	return val.(*clientStat)
+}
+
+// reportStats log the accounting of all clients periodically
+func reportStats(interval time.Duration) {
+	for range time.Tick(interval) {
+		stats.Range(func(key, val interface{}) bool {
+			stat := val.(*clientStat)
+			log.Info().
+				Str("client", key.(string)).
+				Int64("conns", atomic.LoadInt64(&stat.conns)).
+				Int64("active", atomic.LoadInt64(&stat.active)).
+				Int64("upload", atomic.LoadInt64(&stat.upload)).
+				Int64("download", atomic.LoadInt64(&stat.download)).
+				Msg("client stats")
+			return true
+		})
+	}
+}
+
+// countConn count the traffic of the connection into clientStat
+type countConn struct {
+	net.Conn
+	stat *clientStat
+}
+
+func newCountConn(conn net.Conn, client string) *countConn {
+	stat := statOf(client)
+	atomic.AddInt64(&stat.conns, 1)
+	atomic.AddInt64(&stat.active, 1)
+	return &countConn{Conn: conn, stat: stat}
+}
+
+func (c *countConn) NetConn() net.Conn { return c.Conn }
+func (c *countConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddInt64(&c.stat.upload, int64(n))
+	return n, err
+}
+func (c *countConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	atomic.AddInt64(&c.stat.download, int64(n))
+	return n, err
+}
+
+// done must be called once the relay finished
+func (c *countConn) done() {
+	atomic.AddInt64(&c.stat.active, -1)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/transport/trojan"
+)
+
+const udpIdleTimeout = 2 * time.Minute
+
+// relayUDP relay the trojan UDP packets carried by conn, until one side idle
+func relayUDP(conn net.Conn) (time.Duration, error) {
+	start := time.Now()
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "listen udp")
+	}
+	defer pc.Close()
+
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 0xFFFF)
+		for {
+			_ = pc.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+			n, from, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if err := trojan.WritePacket(conn, from.IP.String(), uint16(from.Port), buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		host, port, payload, err := trojan.ReadPacket(conn)
+		if err != nil {
+			return time.Since(start), nil
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			return time.Since(start), errors.Wrap(err, "resolve udp addr")
+		}
+		if _, err := pc.WriteToUDP(payload, addr); err != nil {
+			return time.Since(start), errors.Wrap(err, "write udp")
+		}
+	}
+}
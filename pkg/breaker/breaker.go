@@ -0,0 +1,101 @@
+package breaker
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrOpen is returned by Allow while the breaker is open
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Breaker is a circuit breaker with exponential backoff and jitter.
+// After threshold continuous failures, it fails fast for a cooldown period.
+// Once the cooldown expires, a single trial is let through, and the cooldown
+// doubles on every failed trial, until max.
+type Breaker struct {
+	threshold int
+	base, max time.Duration
+
+	mu        sync.Mutex
+	fails     int
+	trial     bool
+	openUntil time.Time
+}
+
+// New create a breaker, threshold <= 0 disables the breaker
+func New(threshold int, base, max time.Duration) *Breaker {
+	if max < base {
+		max = base
+	}
+	return &Breaker{
+		threshold: threshold,
+		base:      base,
+		max:       max,
+	}
+}
+
+// Allow check if a new request is allowed to pass
+func (b *Breaker) Allow() error {
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fails < b.threshold {
+		return nil
+	}
+
+	if b.trial || time.Now().Before(b.openUntil) {
+		return errors.Wrapf(ErrOpen, "retry after %s", time.Until(b.openUntil).Round(time.Millisecond))
+	}
+
+	// half open, let a single trial through
+	b.trial = true
+	return nil
+}
+
+// Success report a succeeded request, and close the breaker
+func (b *Breaker) Success() {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.fails, b.trial = 0, false
+	b.mu.Unlock()
+}
+
+// Failure report a failed request
+func (b *Breaker) Failure() {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fails++
+	b.trial = false
+	if b.fails < b.threshold {
+		return
+	}
+
+	cooldown := b.max
+	if shift := b.fails - b.threshold; shift < 32 {
+		if d := b.base << shift; d > 0 && d < b.max {
+			cooldown = d
+		}
+	}
+
+	// jitter: [cooldown/2, cooldown)
+	half := cooldown / 2
+	if half > 0 {
+		cooldown = half + time.Duration(rand.Int63n(int64(half)))
+	}
+	b.openUntil = time.Now().Add(cooldown)
+}
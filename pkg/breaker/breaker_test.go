@@ -0,0 +1,36 @@
+package breaker_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/pkg/breaker"
+)
+
+func TestBreaker(t *testing.T) {
+	b := breaker.New(2, 20*time.Millisecond, time.Second)
+
+	b.Failure()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("should allow before threshold, err: %s", err)
+	}
+
+	b.Failure()
+	if err := b.Allow(); !errors.Is(err, breaker.ErrOpen) {
+		t.Fatalf("should be open after threshold, err: %v", err)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("should allow a trial after cooldown, err: %s", err)
+	}
+	if err := b.Allow(); !errors.Is(err, breaker.ErrOpen) {
+		t.Fatalf("should only allow a single trial, err: %v", err)
+	}
+
+	b.Success()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("should be closed after success, err: %s", err)
+	}
+}
@@ -0,0 +1,124 @@
+// Package dialer is the outbound dialer shared by the direct and remote
+// connections, which applies the socket options set at startup.
+package dialer
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	tfo      bool
+	mptcp    bool
+	iface    string
+	sourceIP net.IP
+)
+
+// SetTFO enable TCP Fast Open on the outbound TCP dials
+func SetTFO(enable bool) error {
+	if enable && !tfoSupported {
+		return errors.New("TCP Fast Open is not supported on this platform")
+	}
+	tfo = enable
+	return nil
+}
+
+// SetMPTCP enable multipath TCP on the remote dials, it falls back to TCP
+// if the kernel or the remote does not support it
+func SetMPTCP(enable bool) {
+	mptcp = enable
+}
+
+// SetInterface bind the outbound dials to the network interface. It is
+// SO_BINDTODEVICE on linux, other platforms bind to the address of it.
+func SetInterface(name string) error {
+	if name == "" {
+		iface = ""
+		return nil
+	}
+
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return errors.Wrapf(err, "interface (%s)", name)
+	}
+	if bindDeviceSupported {
+		iface = ifi.Name
+		return nil
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return errors.Wrapf(err, "address of interface (%s)", name)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			sourceIP = ipnet.IP
+			return nil
+		}
+	}
+	return errors.Errorf("no IPv4 address on interface (%s)", name)
+}
+
+// SetSourceIP set the local address of the outbound dials
+func SetSourceIP(ip string) error {
+	if ip == "" {
+		return nil
+	}
+	if sourceIP = net.ParseIP(ip); sourceIP == nil {
+		return errors.Errorf("invalid source IP: %s", ip)
+	}
+	return nil
+}
+
+// New create a TCP dialer with the socket options applied
+func New(timeout time.Duration) *net.Dialer {
+	return newDialer("tcp", timeout)
+}
+
+// Remote create a TCP dialer for the remote connections, with MPTCP applied
+func Remote(timeout time.Duration) *net.Dialer {
+	d := newDialer("tcp", timeout)
+	d.SetMultipathTCP(mptcp)
+	return d
+}
+
+func newDialer(network string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout, Control: control}
+	if sourceIP != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: sourceIP}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: sourceIP}
+		}
+	}
+	return d
+}
+
+func Dial(network, addr string) (net.Conn, error) {
+	return newDialer(network, 0).Dial(network, addr)
+}
+
+func DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	return newDialer(network, timeout).Dial(network, addr)
+}
+
+func control(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		if iface != "" {
+			if err = bindDevice(fd, iface); err != nil {
+				return
+			}
+		}
+		if tfo && strings.HasPrefix(network, "tcp") {
+			err = setTFO(fd)
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return errors.Wrap(err, "set socket option")
+}
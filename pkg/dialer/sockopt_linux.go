@@ -0,0 +1,19 @@
+package dialer
+
+import "syscall"
+
+const (
+	tfoSupported        = true
+	bindDeviceSupported = true
+)
+
+// TCP_FASTOPEN_CONNECT, since Linux 4.11
+const tcpFastOpenConnect = 30
+
+func setTFO(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+}
+
+func bindDevice(fd uintptr, name string) error {
+	return syscall.BindToDevice(int(fd), name)
+}
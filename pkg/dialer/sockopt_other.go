@@ -0,0 +1,12 @@
+//go:build !linux
+
+package dialer
+
+const (
+	tfoSupported        = false
+	bindDeviceSupported = false
+)
+
+func setTFO(fd uintptr) error { return nil }
+
+func bindDevice(fd uintptr, name string) error { return nil }
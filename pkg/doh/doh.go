@@ -0,0 +1,52 @@
+// Package doh implement the DNS over HTTPS client and server, RFC 8484
+package doh
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const mimeType = "application/dns-message"
+
+// Exchange send the DNS query to the DoH server by POST method
+func Exchange(client *http.Client, url string, m *dns.Msg) (*dns.Msg, error) {
+	pack, err := m.Pack()
+	if err != nil {
+		return nil, errors.Wrap(err, "pack query")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(pack))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", mimeType)
+	req.Header.Set("Accept", mimeType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("doh status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, errors.Wrap(err, "unpack answer")
+	}
+	if r.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return r, nil
+}
@@ -0,0 +1,73 @@
+package doh
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestExchange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		m := new(dns.Msg)
+		if err := m.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(1, 2, 3, 4),
+		})
+		pack, _ := resp.Pack()
+		w.Header().Set("Content-Type", mimeType)
+		_, _ = w.Write(pack)
+	}))
+	defer srv.Close()
+
+	m := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	r, err := Exchange(srv.Client(), srv.URL, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("unexpected answer: %v", r.Answer)
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(5, 6, 7, 8),
+		})
+		_ = w.WriteMsg(resp)
+	})))
+	defer srv.Close()
+
+	m := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	r, err := Exchange(srv.Client(), srv.URL, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "5.6.7.8" {
+		t.Errorf("unexpected answer: %v", r.Answer)
+	}
+
+	pack, _ := m.Pack()
+	resp, err := srv.Client().Get(srv.URL + "?dns=" + base64.RawURLEncoding.EncodeToString(pack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Control") != "max-age=60" {
+		t.Errorf("unexpected response: %s %v", resp.Status, resp.Header)
+	}
+}
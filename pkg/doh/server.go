@@ -0,0 +1,95 @@
+package doh
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// NewHandler serve the DoH requests of GET and POST method by the DNS handler
+func NewHandler(h dns.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pack []byte
+		var err error
+		switch req.Method {
+		case http.MethodGet:
+			pack, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if req.Header.Get("Content-Type") != mimeType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			pack, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m := new(dns.Msg)
+		if err := m.Unpack(pack); err != nil {
+			http.Error(w, "unpack query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rw := &responseWriter{remote: parseAddr(req.RemoteAddr)}
+		h.ServeDNS(rw, m)
+		if rw.msg == nil {
+			http.Error(w, "no answer", http.StatusBadGateway)
+			return
+		}
+
+		out, err := rw.msg.Pack()
+		if err != nil {
+			http.Error(w, "pack answer: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", mimeType)
+		if len(rw.msg.Answer) != 0 {
+			ttl := rw.msg.Answer[0].Header().Ttl
+			for _, rr := range rw.msg.Answer {
+				ttl = min(ttl, rr.Header().Ttl)
+			}
+			w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+		}
+		_, _ = w.Write(out)
+	})
+}
+
+func parseAddr(addr string) net.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// responseWriter keep the answer written by the DNS handler
+type responseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *responseWriter) LocalAddr() net.Addr       { return &net.TCPAddr{} }
+func (w *responseWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *responseWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *responseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+func (w *responseWriter) Close() error        { return nil }
+func (w *responseWriter) TsigStatus() error   { return nil }
+func (w *responseWriter) TsigTimersOnly(bool) {}
+func (w *responseWriter) Hijack()             {}
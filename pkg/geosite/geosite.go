@@ -0,0 +1,149 @@
+// Package geosite decode the domain lists of v2ray geosite.dat, which is the
+// protobuf encoded GeoSiteList:
+//
+//	GeoSiteList { repeated GeoSite entry = 1; }
+//	GeoSite     { string country_code = 1; repeated Domain domain = 2; }
+//	Domain      { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+//	Attribute   { string key = 1; ... }
+package geosite
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Type is the matching type of domain
+type Type int
+
+const (
+	Plain      Type = iota // keyword
+	Regex                  // regexp
+	RootDomain             // the domain and its sub domains
+	Full                   // the exact domain
+)
+
+type Domain struct {
+	Type  Type
+	Value string
+}
+
+// Parse return the domains of the list code, eg: cn / gfw. The code is case
+// insensitive, and the domains may be filtered by attribute, eg: cn@ads
+func Parse(data []byte, code string) ([]Domain, error) {
+	code, attr, _ := strings.Cut(code, "@")
+
+	var domains []Domain
+	found := false
+	err := walk(data, func(num int, _ uint64, site []byte) error {
+		if num != 1 {
+			return nil
+		}
+
+		var siteCode string
+		var siteDomains [][]byte
+		if err := walk(site, func(num int, _ uint64, b []byte) error {
+			switch num {
+			case 1:
+				siteCode = string(b)
+			case 2:
+				siteDomains = append(siteDomains, b)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if !strings.EqualFold(siteCode, code) {
+			return nil
+		}
+
+		found = true
+		for _, b := range siteDomains {
+			d, attrs, err := parseDomain(b)
+			if err != nil {
+				return err
+			}
+			if attr == "" || attrs[attr] {
+				domains = append(domains, d)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.Errorf("geosite code not found: %s", code)
+	}
+	return domains, nil
+}
+
+func parseDomain(data []byte) (Domain, map[string]bool, error) {
+	var d Domain
+	attrs := map[string]bool{}
+	err := walk(data, func(num int, val uint64, b []byte) error {
+		switch num {
+		case 1:
+			d.Type = Type(val)
+		case 2:
+			d.Value = string(b)
+		case 3:
+			return walk(b, func(num int, _ uint64, b []byte) error {
+				if num == 1 {
+					attrs[string(b)] = true
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return d, attrs, err
+}
+
+// walk iterate the fields of a protobuf message, val is the value of varint
+// field, b is the payload of length-delimited field
+func walk(data []byte, fn func(num int, val uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid field key")
+		}
+		data = data[n:]
+
+		var val uint64
+		var b []byte
+		switch key & 0x7 {
+		case 0: // varint
+			if val, n = binary.Uvarint(data); n <= 0 {
+				return errors.New("invalid varint field")
+			}
+			data = data[n:]
+		case 2: // length-delimited
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errors.New("invalid length-delimited field")
+			}
+			b, data = data[n:n+int(size)], data[n+int(size):]
+		case 1: // 64-bit
+			if len(data) < 8 {
+				return errors.New("invalid 64-bit field")
+			}
+			data = data[8:]
+			continue
+		case 5: // 32-bit
+			if len(data) < 4 {
+				return errors.New("invalid 32-bit field")
+			}
+			data = data[4:]
+			continue
+		default:
+			return errors.Errorf("unsupported wire type: %d", key&0x7)
+		}
+
+		if err := fn(int(key>>3), val, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package geosite
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func field(num int, b []byte) []byte {
+	buf := binary.AppendUvarint(nil, uint64(num<<3|2))
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func varint(num int, val uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(num<<3)), val)
+}
+
+func domain(typ Type, value string, attrs ...string) []byte {
+	b := append(varint(1, uint64(typ)), field(2, []byte(value))...)
+	for _, attr := range attrs {
+		b = append(b, field(3, append(field(1, []byte(attr)), varint(2, 1)...))...)
+	}
+	return b
+}
+
+func TestParse(t *testing.T) {
+	cn := append(field(1, []byte("CN")), field(2, domain(RootDomain, "baidu.com"))...)
+	cn = append(cn, field(2, domain(Full, "ad.qq.com", "ads"))...)
+	gfw := append(field(1, []byte("GFW")), field(2, domain(Plain, "google"))...)
+	data := append(field(1, cn), field(1, gfw)...)
+
+	tests := []struct {
+		code string
+		want []Domain
+	}{
+		{"cn", []Domain{{RootDomain, "baidu.com"}, {Full, "ad.qq.com"}}},
+		{"cn@ads", []Domain{{Full, "ad.qq.com"}}},
+		{"gfw", []Domain{{Plain, "google"}}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(data, tt.code)
+		if err != nil {
+			t.Fatalf("Parse(%s): %s", tt.code, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%s) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+
+	if _, err := Parse(data, "us"); err == nil {
+		t.Error("Parse(us) should fail")
+	}
+}
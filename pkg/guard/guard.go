@@ -0,0 +1,62 @@
+package guard
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrTooManyConns      = errors.New("too many concurrent connections")
+	ErrTooManyGoroutines = errors.New("too many goroutines")
+)
+
+// Guard limits the resources taken by inbound connections,
+// so that new connections are rejected instead of exhausting the system.
+type Guard struct {
+	maxConns      int64
+	maxGoroutines int
+	conns         int64
+}
+
+// New create a guard, zero value for any limit disables it
+func New(maxConns, maxGoroutines int) *Guard {
+	return &Guard{
+		maxConns:      int64(maxConns),
+		maxGoroutines: maxGoroutines,
+	}
+}
+
+// Acquire take a connection slot, Release must be called if no error returned
+func (g *Guard) Acquire() error {
+	if g == nil {
+		return nil
+	}
+
+	if g.maxGoroutines > 0 && runtime.NumGoroutine() > g.maxGoroutines {
+		return errors.Wrapf(ErrTooManyGoroutines, "limit %d", g.maxGoroutines)
+	}
+
+	if conns := atomic.AddInt64(&g.conns, 1); g.maxConns > 0 && conns > g.maxConns {
+		atomic.AddInt64(&g.conns, -1)
+		return errors.Wrapf(ErrTooManyConns, "limit %d", g.maxConns)
+	}
+	return nil
+}
+
+// Release give back a connection slot
+func (g *Guard) Release() {
+	if g == nil {
+		return
+	}
+	atomic.AddInt64(&g.conns, -1)
+}
+
+// Conns return the number of active connections
+func (g *Guard) Conns() int64 {
+	if g == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&g.conns)
+}
@@ -0,0 +1,70 @@
+package logthrottle
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Throttle is a zerolog hook which collapses repeated identical warn/error
+// logs. Within an interval, only the first burst logs with the same level and
+// message are written, and the rest are summarized into one line with count.
+type Throttle struct {
+	logger zerolog.Logger
+	burst  int
+
+	mu     sync.Mutex
+	counts map[key]int
+}
+
+type key struct {
+	level zerolog.Level
+	msg   string
+}
+
+// New create a throttle, the summary lines are written by logger
+func New(logger zerolog.Logger, burst int, interval time.Duration) *Throttle {
+	t := &Throttle{
+		logger: logger,
+		burst:  burst,
+		counts: map[key]int{},
+	}
+	go t.flush(interval)
+	return t
+}
+
+// Run implements zerolog.Hook
+func (t *Throttle) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if level < zerolog.WarnLevel || level >= zerolog.FatalLevel {
+		return
+	}
+
+	t.mu.Lock()
+	k := key{level, msg}
+	t.counts[k]++
+	n := t.counts[k]
+	t.mu.Unlock()
+
+	if n > t.burst {
+		e.Discard()
+	}
+}
+
+func (t *Throttle) flush(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.mu.Lock()
+		counts := t.counts
+		t.counts = map[key]int{}
+		t.mu.Unlock()
+
+		for k, n := range counts {
+			if n > t.burst {
+				t.logger.WithLevel(k.level).
+					Int("suppressed", n-t.burst).
+					Dur("interval", interval).
+					Msg(k.msg)
+			}
+		}
+	}
+}
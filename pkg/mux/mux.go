@@ -0,0 +1,283 @@
+// Package mux multiplex streams over a single connection.
+// The frame format is the same as smux v1, so it's able to talk to
+// the implementations based on github.com/xtaci/smux.
+//
+//	+-----+-----+--------+----------+---------+
+//	| VER | CMD | LENGTH | STREAMID | PAYLOAD |
+//	+-----+-----+--------+----------+---------+
+//	|  1  |  1  | 2(LE)  |  4(LE)   | LENGTH  |
+//	+-----+-----+--------+----------+---------+
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Host is the reserved target host to start a mux session over sower/trojan.
+// The .invalid TLD is reserved by RFC 2606, so it never collides with a real target.
+const Host = "mux.sower.invalid"
+
+const (
+	version = 1
+
+	cmdSYN = 0 // stream open
+	cmdFIN = 1 // stream close
+	cmdPSH = 2 // data push
+	cmdNOP = 3 // keepalive
+
+	headSize   = 8
+	maxPayload = 32 << 10
+	maxBuffer  = 4 << 20
+
+	keepAliveInterval = 10 * time.Second
+	keepAliveTimeout  = 30 * time.Second
+)
+
+var ErrSessionClosed = errors.New("mux: session closed")
+
+// Session is a mux session over one connection
+type Session struct {
+	conn net.Conn
+
+	wmu    sync.Mutex
+	nextID uint32
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	buffer  int // bytes received but not yet read by all streams
+
+	bucketCh chan struct{}
+	acceptCh chan *Stream
+	die      chan struct{}
+	dieOnce  sync.Once
+	dataRecv int32
+}
+
+// Client start a session which opens streams with odd ids
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1)
+}
+
+// Server start a session which accepts streams from client
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 0)
+}
+
+func newSession(conn net.Conn, nextID uint32) *Session {
+	s := &Session{
+		conn:     conn,
+		nextID:   nextID,
+		streams:  map[uint32]*Stream{},
+		bucketCh: make(chan struct{}, 1),
+		acceptCh: make(chan *Stream, 64),
+		die:      make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.keepalive()
+	return s
+}
+
+// Open a new stream to the peer
+func (s *Session) Open() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, ErrSessionClosed
+	}
+
+	s.wmu.Lock()
+	s.nextID += 2
+	id := s.nextID
+	s.wmu.Unlock()
+
+	stream := newStream(id, s)
+	s.mu.Lock()
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, nil); err != nil {
+		s.mu.Lock()
+		delete(s.streams, id)
+		s.mu.Unlock()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept a stream opened by the peer
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.die:
+		return nil, ErrSessionClosed
+	}
+}
+
+// NumStreams return the count of the alive streams
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close the session and all the streams in it
+func (s *Session) Close() error {
+	err := ErrSessionClosed
+	s.dieOnce.Do(func() {
+		close(s.die)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+func (s *Session) writeFrame(cmd byte, id uint32, payload []byte) error {
+	buf := make([]byte, headSize+len(payload))
+	buf[0], buf[1] = version, cmd
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], id)
+	copy(buf[headSize:], payload)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		s.Close()
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	defer s.Close()
+
+	head := make([]byte, headSize)
+	for {
+		// wait for the streams consuming the buffered data
+		for !s.IsClosed() {
+			s.mu.Lock()
+			full := s.buffer >= maxBuffer
+			s.mu.Unlock()
+			if !full {
+				break
+			}
+			select {
+			case <-s.bucketCh:
+			case <-s.die:
+			}
+		}
+
+		if _, err := io.ReadFull(s.conn, head); err != nil {
+			return
+		}
+		atomic.StoreInt32(&s.dataRecv, 1)
+		if head[0] != version {
+			return
+		}
+
+		id := binary.LittleEndian.Uint32(head[4:])
+		payload := make([]byte, binary.LittleEndian.Uint16(head[2:]))
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return
+		}
+
+		switch head[1] {
+		case cmdSYN:
+			s.mu.Lock()
+			if _, ok := s.streams[id]; ok {
+				s.mu.Unlock()
+				continue
+			}
+			stream := newStream(id, s)
+			s.streams[id] = stream
+			s.mu.Unlock()
+
+			select {
+			case s.acceptCh <- stream:
+			case <-s.die:
+				return
+			}
+
+		case cmdFIN:
+			s.mu.Lock()
+			stream := s.streams[id]
+			s.mu.Unlock()
+			if stream != nil {
+				stream.fin()
+			}
+
+		case cmdPSH:
+			s.mu.Lock()
+			stream := s.streams[id]
+			if stream != nil {
+				s.buffer += len(payload)
+			}
+			s.mu.Unlock()
+			if stream != nil {
+				stream.push(payload)
+			}
+
+		case cmdNOP:
+		default:
+			return
+		}
+	}
+}
+
+func (s *Session) keepalive() {
+	ping := time.NewTicker(keepAliveInterval)
+	defer ping.Stop()
+	check := time.NewTicker(keepAliveTimeout)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-ping.C:
+			_ = s.writeFrame(cmdNOP, 0, nil)
+		case <-check.C:
+			if !atomic.CompareAndSwapInt32(&s.dataRecv, 1, 0) {
+				s.Close()
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// returnTokens release the buffer consumed by streams
+func (s *Session) returnTokens(n int) {
+	if n == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	s.buffer -= n
+	s.mu.Unlock()
+	select {
+	case s.bucketCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
@@ -0,0 +1,101 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	c, s := net.Pipe()
+	client, server := Client(c), Server(s)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				_, _ = io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	data := bytes.Repeat([]byte("sower"), 3*maxPayload)
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+
+			stream, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+
+			go func() { _, _ = stream.Write(data) }()
+			buf := make([]byte, len(data))
+			if _, err := io.ReadFull(stream, buf); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(buf, data) {
+				t.Error("data mismatch")
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	client.Close()
+	if _, err := client.Open(); err != ErrSessionClosed {
+		t.Errorf("expect session closed, got %v", err)
+	}
+}
+
+func TestStreamCloseWrite(t *testing.T) {
+	c, s := net.Pipe()
+	client, server := Client(c), Server(s)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		stream, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+
+		// read the request until the client half-closed, then reply
+		req, _ := io.ReadAll(stream)
+		_, _ = stream.Write(append([]byte("re: "), req...))
+	}()
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	if _, err := stream.Write([]byte("sower")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("sower")); err == nil {
+		t.Error("write after CloseWrite should fail")
+	}
+
+	resp, err := io.ReadAll(stream)
+	if err != nil || string(resp) != "re: sower" {
+		t.Errorf("unexpected response: %q, err: %v", resp, err)
+	}
+}
@@ -0,0 +1,192 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a virtual connection in a session. It implements net.Conn.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	finRecv       bool
+	finSent       bool
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readCh    chan struct{}
+	closeOnce sync.Once
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:     id,
+		sess:   sess,
+		readCh: make(chan struct{}, 1),
+	}
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(b)
+			s.mu.Unlock()
+			s.sess.returnTokens(n)
+			return n, nil
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if s.finRecv {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case <-s.readCh:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-s.sess.die:
+			s.mu.Lock()
+			empty := s.buf.Len() == 0
+			s.mu.Unlock()
+			if empty {
+				return 0, io.EOF
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (s *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		s.mu.Lock()
+		closed, finSent, deadline := s.closed, s.finSent, s.writeDeadline
+		s.mu.Unlock()
+		switch {
+		case closed, finSent:
+			return n, io.ErrClosedPipe
+		case !deadline.IsZero() && !time.Now().Before(deadline):
+			return n, os.ErrDeadlineExceeded
+		}
+
+		size := len(b)
+		if size > maxPayload {
+			size = maxPayload
+		}
+		if err := s.sess.writeFrame(cmdPSH, s.id, b[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// Close the stream, the unread data is dropped
+func (s *Stream) Close() error {
+	var err error = io.ErrClosedPipe
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		finSent := s.finSent
+		s.finSent = true
+		n := s.buf.Len()
+		s.buf.Reset()
+		s.mu.Unlock()
+
+		s.sess.removeStream(s.id)
+		s.sess.returnTokens(n)
+		s.notifyRead()
+		err = nil
+		if !finSent {
+			err = s.sess.writeFrame(cmdFIN, s.id, nil)
+		}
+	})
+	return err
+}
+
+// CloseWrite send FIN to the peer, the stream is still readable until the
+// peer closes its write side
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.closed || s.finSent {
+		s.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+	s.finSent = true
+	s.mu.Unlock()
+	return s.sess.writeFrame(cmdFIN, s.id, nil)
+}
+
+func (s *Stream) LocalAddr() net.Addr  { return s.sess.conn.LocalAddr() }
+func (s *Stream) RemoteAddr() net.Addr { return s.sess.conn.RemoteAddr() }
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	s.notifyRead()
+	return nil
+}
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Stream) push(b []byte) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		s.sess.returnTokens(len(b))
+		return
+	}
+	s.buf.Write(b)
+	s.mu.Unlock()
+	s.notifyRead()
+}
+
+func (s *Stream) fin() {
+	s.mu.Lock()
+	s.finRecv = true
+	s.mu.Unlock()
+	s.notifyRead()
+}
+
+func (s *Stream) notifyRead() {
+	select {
+	case s.readCh <- struct{}{}:
+	default:
+	}
+}
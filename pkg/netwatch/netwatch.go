@@ -0,0 +1,51 @@
+package netwatch
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Watch poll the addresses of net interfaces, and call onChange once the
+// addresses changed or the system woke up from sleep.
+func Watch(interval time.Duration, onChange func()) {
+	last := snapshot()
+	lastTick := time.Now().Round(0) // wall clock, keeps counting during sleep
+	for range time.Tick(interval) {
+		now := time.Now().Round(0)
+		wakeup := now.Sub(lastTick) > 3*interval
+		lastTick = now
+
+		addrs := snapshot()
+		if addrs == last && !wakeup {
+			continue
+		}
+
+		last = addrs
+		onChange()
+	}
+}
+
+// snapshot return the sorted addresses of all active net interfaces
+func snapshot() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	var addrs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		ifaceAddrs, _ := iface.Addrs()
+		for _, addr := range ifaceAddrs {
+			addrs = append(addrs, iface.Name+"/"+addr.String())
+		}
+	}
+
+	sort.Strings(addrs)
+	return strings.Join(addrs, ",")
+}
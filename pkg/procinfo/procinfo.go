@@ -0,0 +1,43 @@
+// Package procinfo find the local process owning a TCP connection, by /proc
+// on linux and the IP helper API on windows.
+package procinfo
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnsupported is returned on the platforms without process lookup
+var ErrUnsupported = errors.New("process lookup is not supported on this platform")
+
+// Lookup return the executable name of the local process which dialed the
+// accepted connection, eg: chrome.exe / curl
+func Lookup(conn net.Conn) (string, error) {
+	client, ok1 := conn.RemoteAddr().(*net.TCPAddr)
+	server, ok2 := conn.LocalAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return "", errors.Errorf("not a TCP connection: %s", conn.RemoteAddr())
+	}
+	if !client.IP.IsLoopback() && !isLocalIP(client.IP) {
+		return "", errors.Errorf("not a local connection: %s", client)
+	}
+
+	path, err := lookup(client, server)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(strings.ReplaceAll(path, `\`, "/")), nil
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
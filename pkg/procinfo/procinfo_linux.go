@@ -0,0 +1,87 @@
+package procinfo
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+func lookup(client, server *net.TCPAddr) (string, error) {
+	inode, err := findInode(client, server)
+	if err != nil {
+		return "", err
+	}
+
+	target := "socket:[" + inode + "]"
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/[0-9]*")
+	for _, fd := range fds {
+		if link, err := os.Readlink(fd); err != nil || link != target {
+			continue
+		}
+
+		pid := strings.Split(fd, "/")[2]
+		if exe, err := os.Readlink("/proc/" + pid + "/exe"); err == nil {
+			return exe, nil
+		}
+		comm, err := os.ReadFile("/proc/" + pid + "/comm")
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		return strings.TrimSpace(string(comm)), nil
+	}
+	return "", errors.Errorf("no process owns socket inode %s", inode)
+}
+
+// findInode find the socket of client in /proc/net/tcp{,6}, eg:
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+//	0: 0100007F:D431 0100007F:0438 01 00000000:00000000 00:00000000 00000000  1000        0 123456
+func findInode(client, server *net.TCPAddr) (string, error) {
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			if matchAddr(fields[1], client) && matchAddr(fields[2], server) {
+				f.Close()
+				return fields[9], nil
+			}
+		}
+		f.Close()
+	}
+	return "", errors.Errorf("no socket found for %s", client)
+}
+
+// matchAddr match the hex address of /proc/net/tcp, the IP is in 32-bit
+// words of host byte order, little-endian is assumed
+func matchAddr(hexAddr string, addr *net.TCPAddr) bool {
+	hexIP, hexPort, ok := strings.Cut(hexAddr, ":")
+	if !ok {
+		return false
+	}
+	if port, err := strconv.ParseUint(hexPort, 16, 16); err != nil || int(port) != addr.Port {
+		return false
+	}
+
+	raw, err := hex.DecodeString(hexIP)
+	if err != nil || len(raw)%4 != 0 {
+		return false
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	return net.IP(raw).Equal(addr.IP)
+}
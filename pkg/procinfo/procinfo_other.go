@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+
+package procinfo
+
+import "net"
+
+func lookup(client, server *net.TCPAddr) (string, error) {
+	return "", ErrUnsupported
+}
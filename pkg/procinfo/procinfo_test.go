@@ -0,0 +1,42 @@
+package procinfo
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" {
+		t.Skip(ErrUnsupported)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	exe, _ := os.Executable()
+	name, err := Lookup(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != filepath.Base(exe) {
+		t.Errorf("Lookup() = %s, want %s", name, filepath.Base(exe))
+	}
+}
@@ -0,0 +1,86 @@
+package procinfo
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	iphlpapi                       = syscall.NewLazyDLL("iphlpapi.dll")
+	procGetExtendedTcpTable        = iphlpapi.NewProc("GetExtendedTcpTable")
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procQueryFullProcessImageNameW = kernel32.NewProc("QueryFullProcessImageNameW")
+)
+
+const (
+	tcpTableOwnerPIDAll            = 5
+	processQueryLimitedInformation = 0x1000
+)
+
+func lookup(client, server *net.TCPAddr) (string, error) {
+	pid, err := findPID(client, server)
+	if err != nil {
+		return "", err
+	}
+
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, pid)
+	if err != nil {
+		return "", errors.Wrapf(err, "open process %d", pid)
+	}
+	defer syscall.CloseHandle(h)
+
+	buf := make([]uint16, syscall.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if r, _, err := procQueryFullProcessImageNameW.Call(uintptr(h), 0,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size))); r == 0 {
+		return "", errors.Wrapf(err, "query image name of process %d", pid)
+	}
+	return syscall.UTF16ToString(buf[:size]), nil
+}
+
+// findPID find the owner of client socket in the TCP table
+func findPID(client, server *net.TCPAddr) (uint32, error) {
+	af, rowSize := uint32(syscall.AF_INET), 24 // MIB_TCPROW_OWNER_PID
+	if client.IP.To4() == nil {
+		af, rowSize = syscall.AF_INET6, 56 // MIB_TCP6ROW_OWNER_PID
+	}
+
+	var size uint32
+	procGetExtendedTcpTable.Call(0, uintptr(unsafe.Pointer(&size)), 0, uintptr(af), tcpTableOwnerPIDAll, 0)
+	if size == 0 {
+		return 0, errors.New("get TCP table size")
+	}
+	size += 4096 // the table may grow between calls
+	buf := make([]byte, size)
+	if r, _, _ := procGetExtendedTcpTable.Call(uintptr(unsafe.Pointer(&buf[0])),
+		uintptr(unsafe.Pointer(&size)), 0, uintptr(af), tcpTableOwnerPIDAll, 0); r != 0 {
+		return 0, errors.Errorf("get TCP table: %d", r)
+	}
+
+	num := int(binary.LittleEndian.Uint32(buf))
+	for i := 0; i < num; i++ {
+		row := buf[4+i*rowSize : 4+(i+1)*rowSize]
+		var localPort, remotePort, pid uint32
+		if af == syscall.AF_INET {
+			localPort, remotePort = readPort(row[8:]), readPort(row[16:])
+			pid = binary.LittleEndian.Uint32(row[20:])
+		} else {
+			localPort, remotePort = readPort(row[20:]), readPort(row[44:])
+			pid = binary.LittleEndian.Uint32(row[52:])
+		}
+
+		if int(localPort) == client.Port && int(remotePort) == server.Port {
+			return pid, nil
+		}
+	}
+	return 0, errors.Errorf("no socket found for %s", client)
+}
+
+// readPort read the port in network byte order of the DWORD
+func readPort(b []byte) uint32 {
+	return uint32(b[0])<<8 | uint32(b[1])
+}
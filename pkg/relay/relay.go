@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/conns/teeconn"
+	"github.com/wweir/sower/pkg/dialer"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// RelayTo dial the addr and relay data between conn and the target
+func RelayTo(conn net.Conn, addr string) (dur time.Duration, err error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+
+	start := time.Now()
+	rc, err := dialer.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return time.Since(start), errors.WithStack(err)
+	}
+	defer rc.Close()
+
+	Relay(conn, rc)
+	return time.Since(start), nil
+}
+
+// Relay copy data between conn1 and conn2 in both directions. When one side
+// reaches EOF, the write direction of the other side is closed, so that
+// protocols relying on TCP half-close keep working.
+func Relay(conn1, conn2 net.Conn) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go redirect(conn2, conn1, wg)
+	redirect(conn1, conn2, wg)
+	wg.Wait()
+}
+
+func redirect(dst, src net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	_, err := io.Copy(dst, src)
+	if err == nil && closeWrite(dst) == nil {
+		return
+	}
+
+	// half-close is not supported or the copy broke, wakeup blocked goroutine
+	now := time.Now()
+	src.SetDeadline(now)
+	dst.SetDeadline(now)
+}
+
+func closeWrite(conn net.Conn) error {
+	switch c := conn.(type) {
+	case closeWriter:
+		return c.CloseWrite()
+	case *teeconn.Conn:
+		return closeWrite(c.Conn)
+	case interface{ NetConn() net.Conn }:
+		return closeWrite(c.NetConn())
+	default:
+		return errors.New("half-close not supported")
+	}
+}
@@ -0,0 +1,56 @@
+package relay_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/wweir/sower/pkg/relay"
+)
+
+func TestRelay_HalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// echo server, reply after the request is fully read
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, _ := io.ReadAll(conn)
+		conn.Write(append(req, " done"...))
+	}()
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyLn.Close()
+	go func() {
+		conn, err := proxyLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		relay.RelayTo(conn, ln.Addr().String())
+	}()
+
+	conn, err := net.Dial("tcp", proxyLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	conn.(*net.TCPConn).CloseWrite()
+	resp, _ := io.ReadAll(conn)
+	if string(resp) != "ping done" {
+		t.Errorf("unexpected response: %q", resp)
+	}
+}
@@ -0,0 +1,24 @@
+package replayconn
+
+import "net"
+
+// Conn replay the data before reading the underlying connection, for the
+// data already read from it by sniffing or rewritten from its head
+type Conn struct {
+	net.Conn
+	buf []byte
+}
+
+func New(conn net.Conn, buf []byte) *Conn {
+	return &Conn{Conn: conn, buf: buf}
+}
+
+func (c *Conn) NetConn() net.Conn { return c.Conn }
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.buf) != 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
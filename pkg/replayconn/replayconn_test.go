@@ -0,0 +1,23 @@
+package replayconn
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestConn(t *testing.T) {
+	r, w := net.Pipe()
+	go func() {
+		defer w.Close()
+		w.Write([]byte(" world"))
+	}()
+
+	conn := New(r, []byte("hello"))
+	if conn.NetConn() != r {
+		t.Error("unexpected underlying conn")
+	}
+	if got, err := io.ReadAll(conn); err != nil || string(got) != "hello world" {
+		t.Errorf("unexpected data: %q, err: %v", got, err)
+	}
+}
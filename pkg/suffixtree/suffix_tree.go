@@ -133,6 +133,49 @@ func (n *node) matchSecs(secs []string, fuzzNode bool) bool {
 	return n.index("**") >= 0
 }
 
+// MatchRule return the rule matched the item, the '**' in the middle of a
+// rule is reported as '*'
+func (n *Node) MatchRule(item string) (string, bool) {
+	if n == nil {
+		return "", false
+	}
+
+	rule, ok := n.matchRule(strings.Split(n.trim(item), n.sep))
+	if !ok {
+		return "", false
+	}
+	return strings.Join(rule, n.sep), true
+}
+
+// matchRule follow the path of matchSecs, return the secs of the matched rule
+func (n *node) matchRule(secs []string) ([]string, bool) {
+	length := len(secs)
+	if length == 0 {
+		switch {
+		case n == nil, n.index("") != -1:
+			return nil, true
+		case n.index("**") != -1:
+			return []string{"**"}, true
+		}
+		return nil, false
+	}
+
+	if idx := n.index(secs[length-1]); idx >= 0 {
+		if rule, ok := n.subNodes[idx].matchRule(secs[:length-1]); ok {
+			return append(rule, secs[length-1]), true
+		}
+	}
+	if idx := n.index("*"); idx >= 0 {
+		if rule, ok := n.subNodes[idx].matchRule(secs[:length-1]); ok {
+			return append(rule, "*"), true
+		}
+	}
+	if n.index("**") >= 0 {
+		return []string{"**"}, true
+	}
+	return nil, false
+}
+
 // index return the sec index in node, or -1 if not found
 func (n *node) index(sec string) int {
 	if n == nil {
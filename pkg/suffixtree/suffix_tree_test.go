@@ -85,3 +85,25 @@ func TestNode_Match(t *testing.T) {
 		})
 	}
 }
+
+func TestNode_MatchRule(t *testing.T) {
+	node := suffixtree.NewNodeFromRules("wweir.cc", "*.wweir.cc", "**.github.com", "a.**.com")
+	tests := []struct {
+		arg  string
+		want string
+		ok   bool
+	}{
+		{"wweir.cc", "wweir.cc", true},
+		{"a.wweir.cc", "*.wweir.cc", true},
+		{"a.b.wweir.cc", "", false},
+		{"github.com", "**.github.com", true},
+		{"api.github.com.", "**.github.com", true},
+		{"a.fuzz.com", "a.*.com", true},
+		{"b.fuzz.com", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := node.MatchRule(tt.arg); got != tt.want || ok != tt.ok {
+			t.Errorf("Node.MatchRule(%s) = %s, %v, want %s, %v", tt.arg, got, ok, tt.want, tt.ok)
+		}
+	}
+}
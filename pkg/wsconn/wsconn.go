@@ -0,0 +1,238 @@
+package wsconn
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// https://tools.ietf.org/html/rfc6455
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Client do the websocket handshake as client over conn
+func Client(conn net.Conn, host, path string) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, errors.Wrap(err, "write handshake")
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "read handshake")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, errors.Errorf("websocket handshake failed, status: %s", resp.Status)
+	}
+
+	return &Conn{Conn: conn, br: br, client: true}, nil
+}
+
+// Accept do the websocket handshake as server if the request on conn is a
+// websocket upgrade to path
+func Accept(conn net.Conn, path string) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "read request")
+	}
+
+	if req.URL.Path != path || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.Errorf("not a websocket upgrade to %s", path)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		return nil, errors.Wrap(err, "write handshake")
+	}
+
+	return &Conn{Conn: conn, br: br}, nil
+}
+
+// Conn is a websocket connection, which carries a stream in binary frames
+type Conn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool // client frames must be masked
+
+	wmu sync.Mutex
+
+	remain  uint64 // unread payload of the current frame
+	mask    []byte
+	maskIdx int
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|op)
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xFFFF:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	if c.client {
+		key := make([]byte, 4)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		buf = append(buf, key...)
+		for i, b := range payload {
+			buf = append(buf, b^key[i%4])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for c.remain == 0 {
+		if err := c.readHead(); err != nil {
+			return 0, err
+		}
+	}
+
+	// the whole frame is already sent by peer, read full to keep the
+	// message boundary for the callers reading a head in one call
+	if uint64(len(b)) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := io.ReadFull(c.br, b)
+	c.unmask(b[:n])
+	c.remain -= uint64(n)
+	return n, err
+}
+
+func (c *Conn) unmask(b []byte) {
+	if c.mask == nil {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskIdx%4]
+		c.maskIdx++
+	}
+}
+
+// readHead read the next frame head, control frames are handled inside
+func (c *Conn) readHead() error {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.br, head); err != nil {
+		return err
+	}
+
+	op := head[0] & 0x0F
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(c.br, buf); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(buf))
+	case 127:
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(c.br, buf); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(buf)
+	}
+
+	c.mask, c.maskIdx = nil, 0
+	if head[1]&0x80 != 0 {
+		c.mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.br, c.mask); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case opContinuation, opText, opBinary:
+		c.remain = length
+		return nil
+
+	case opClose:
+		_ = c.writeFrame(opClose, nil)
+		return io.EOF
+
+	case opPing, opPong:
+		if length > 125 {
+			return errors.New("control frame too large")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		if op == opPing {
+			return c.writeFrame(opPong, payload)
+		}
+		return nil
+
+	default:
+		return errors.Errorf("unknown opcode: %d", op)
+	}
+}
@@ -0,0 +1,37 @@
+package wsconn_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/wweir/sower/pkg/wsconn"
+)
+
+func TestWebsocket(t *testing.T) {
+	c, s := net.Pipe()
+	payload := bytes.Repeat([]byte("sower"), 0x10000)
+
+	go func() {
+		defer c.Close()
+		ws, err := wsconn.Client(c, "sower.example", "/ws")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ws.Write([]byte("ping"))
+		ws.Write(payload)
+	}()
+
+	defer s.Close()
+	ws, err := wsconn.Accept(s, "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := io.ReadAll(ws)
+	if !bytes.Equal(got, append([]byte("ping"), payload...)) {
+		t.Errorf("unexpected payload, len: %d", len(got))
+	}
+}
@@ -0,0 +1,79 @@
+package router
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/conns/teeconn"
+)
+
+// the actions of the blocked connections
+const (
+	BlockClose  = "close"  // close the connection
+	BlockReset  = "reset"  // close the connection with TCP RST
+	BlockReject = "reject" // HTTP 403 for port 80, TLS alert for port 443, close the others
+)
+
+// SetBlockAction set how the blocked connections are closed, so that the
+// clients fail fast instead of hanging
+func (r *Router) SetBlockAction(action string) error {
+	switch action {
+	case BlockClose, BlockReset, BlockReject:
+	default:
+		return errors.Errorf("unknown block action: %s", action)
+	}
+
+	r.blockAction = action
+	return nil
+}
+
+var (
+	httpForbidden = []byte("HTTP/1.1 403 Forbidden\r\n" +
+		"Content-Type: text/plain\r\nContent-Length: 16\r\nConnection: close\r\n\r\n" +
+		"blocked by rule\n")
+	// fatal access_denied alert in a TLS 1.2 record
+	tlsAccessDenied = []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x31}
+)
+
+// BlockHandle close the blocked connection by the block action
+func (r *Router) BlockHandle(conn net.Conn, port uint16) error {
+	switch r.blockAction {
+	case BlockReset:
+		return setLinger0(conn)
+
+	case BlockReject:
+		var resp []byte
+		switch port {
+		case 80:
+			resp = httpForbidden
+		case 443:
+			resp = tlsAccessDenied
+		default:
+			return nil
+		}
+
+		// drain the request in flight, so that the response is not dropped by a RST
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Read(make([]byte, 4096))
+		_, err := conn.Write(resp)
+		return errors.Wrap(err, "write block response")
+	}
+	return nil
+}
+
+// setLinger0 make the close send RST instead of FIN
+func setLinger0(conn net.Conn) error {
+	for {
+		switch c := conn.(type) {
+		case interface{ SetLinger(sec int) error }:
+			return errors.Wrap(c.SetLinger(0), "set linger")
+		case *teeconn.Conn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package router
+
+import (
+	"net"
+
+	"github.com/sower-proxy/deferlog/log"
+)
+
+// cidrSet match the IPs by the CIDRs, the IPv4 and IPv6 CIDRs are indexed
+// separately by the prefix length, so a match costs a lookup per length
+type cidrSet struct {
+	v4, v6 cidrIndex
+}
+
+type cidrIndex struct {
+	lens []int                   // prefix lengths in use, longest first
+	nets map[int]map[string]bool // prefix length -> masked IP
+}
+
+func newCIDRSet(cidrs []*net.IPNet) *cidrSet {
+	s := &cidrSet{}
+	for _, cidr := range cidrs {
+		ones, bits := cidr.Mask.Size()
+		if bits == 32 {
+			s.v4.add(cidr.IP.To4(), ones)
+		} else {
+			s.v6.add(cidr.IP.To16(), ones)
+		}
+	}
+	return s
+}
+
+func (idx *cidrIndex) add(ip net.IP, ones int) {
+	if idx.nets == nil {
+		idx.nets = map[int]map[string]bool{}
+	}
+	if _, ok := idx.nets[ones]; !ok {
+		idx.nets[ones] = map[string]bool{}
+		i := 0
+		for i < len(idx.lens) && idx.lens[i] > ones {
+			i++
+		}
+		idx.lens = append(idx.lens[:i], append([]int{ones}, idx.lens[i:]...)...)
+	}
+	idx.nets[ones][string(ip.Mask(net.CIDRMask(ones, len(ip)*8)))] = true
+}
+
+func (idx *cidrIndex) contains(ip net.IP) bool {
+	for _, ones := range idx.lens {
+		if idx.nets[ones][string(ip.Mask(net.CIDRMask(ones, len(ip)*8)))] {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains report whether the IP is in any of the CIDRs
+func (s *cidrSet) Contains(ip net.IP) bool {
+	if s == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return s.v4.contains(ip4)
+	}
+	return s.v6.contains(ip.To16())
+}
+
+// parseCIDRs parse the CIDRs, the invalid ones are logged and skipped
+func parseCIDRs(cidrs []string) *cidrSet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to parse CIDR")
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+	return newCIDRSet(nets)
+}
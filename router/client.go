@@ -0,0 +1,85 @@
+package router
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// the routing policies of the clients, besides RuleBlock, RuleDirect and
+// RuleProxy which route all the traffic of the client
+const (
+	ClientRules   = "rules"   // evaluate all the rules, the default
+	ClientNoBlock = "noblock" // evaluate the rules except the block rules
+)
+
+type clientPolicy struct {
+	cidr   *net.IPNet
+	policy string
+}
+
+// SetClientPolicies set the routing policies by the source IP of the clients,
+// format: '<IP or CIDR> <policy>', eg: '192.168.1.10 proxy', the first matched wins
+func (r *Router) SetClientPolicies(policies []string) error {
+	clients := make([]clientPolicy, 0, len(policies))
+	for _, item := range policies {
+		fields := strings.Fields(item)
+		if len(fields) != 2 {
+			return errors.Errorf("invalid client policy, format: '<IP or CIDR> <policy>': %s", item)
+		}
+
+		switch fields[1] {
+		case ClientRules, ClientNoBlock, RuleBlock, RuleDirect, RuleProxy:
+		default:
+			return errors.Errorf("unknown client policy: %s", item)
+		}
+
+		cidr := fields[0]
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.Wrapf(err, "client policy (%s)", item)
+		}
+		clients = append(clients, clientPolicy{cidr: ipnet, policy: fields[1]})
+	}
+
+	r.clients = clients
+	return nil
+}
+
+// policyOf return the routing policy of the client
+func (r *Router) policyOf(addr net.Addr) string {
+	if len(r.clients) == 0 || addr == nil {
+		return ClientRules
+	}
+
+	ip := addrIP(addr)
+	for _, c := range r.clients {
+		if ip != nil && c.cidr.Contains(ip) {
+			return c.policy
+		}
+	}
+	return ClientRules
+}
+
+// addrIP return the IP of the address, nil if not an IP address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		host, _, _ := net.SplitHostPort(addr.String())
+		return net.ParseIP(host)
+	}
+}
@@ -27,16 +27,17 @@ func (r *Router) localSite(domain string) bool {
 		ip = ips[0]
 	}
 
-	// CIDR match
-	for _, cidr := range r.country.cidrs {
-		if cidr.Contains(ip) {
-			return true
-		}
+	// CIDR match, the excluded first
+	if r.country.excludes.Load().Contains(ip) {
+		return false
+	}
+	if r.country.cidrs.Load().Contains(ip) {
+		return true
 	}
 
-	// MMDB match CN
-	if r.country.Reader != nil {
-		city, err := r.country.City(ip)
+	// MMDB match the countries, default: CN
+	if db := r.country.db.Load(); db != nil {
+		country, err := db.Country(ip)
 		if err != nil {
 			log.Warn().Err(err).
 				Str("domain", domain).
@@ -45,7 +46,7 @@ func (r *Router) localSite(domain string) bool {
 			return false
 		}
 
-		if city.Country.IsoCode == "CN" {
+		if r.country.codes[country.Country.IsoCode] {
 			return true
 		}
 	}
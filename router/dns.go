@@ -2,12 +2,111 @@ package router
 
 import (
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/pkg/errors"
 	"github.com/sower-proxy/deferlog/log"
 )
 
+type ttlRule struct {
+	ttl  uint32
+	rule *ruleSet
+}
+
+// SetTTLRules set the TTL override rules, format: '<ttl> <rule>'
+func (r *Router) SetTTLRules(rules []string) {
+	idx := map[uint32]int{}
+	var ttlRules []ttlRule
+	var ttlLists [][]string
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) != 2 {
+			log.Error().Str("rule", rule).Msg("invalid TTL rule, format: '<ttl> <rule>'")
+			continue
+		}
+		ttl, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			log.Error().Err(err).Str("rule", rule).Msg("parse TTL rule")
+			continue
+		}
+
+		i, ok := idx[uint32(ttl)]
+		if !ok {
+			i = len(ttlRules)
+			idx[uint32(ttl)] = i
+			ttlRules = append(ttlRules, ttlRule{ttl: uint32(ttl)})
+			ttlLists = append(ttlLists, nil)
+		}
+		ttlLists[i] = append(ttlLists[i], fields[1])
+	}
+
+	for i := range ttlRules {
+		ttlRules[i].rule = newRuleSet(ttlLists[i]...)
+	}
+	r.dns.ttlRules.Store(&ttlRules)
+}
+
+// overrideTTL rewrite the TTL of answers if the domain matched a TTL rule
+func (r *Router) overrideTTL(domain string, m *dns.Msg) *dns.Msg {
+	for _, rule := range *r.dns.ttlRules.Load() {
+		if !rule.rule.Match(domain) {
+			continue
+		}
+
+		m = m.Copy()
+		for _, rr := range m.Answer {
+			rr.Header().Ttl = rule.ttl
+		}
+		return m
+	}
+	return m
+}
+
+// SetHosts set the static hosts answered before routing, format:
+// '<IP> <host> [<host>...]' as the hosts file
+func (r *Router) SetHosts(entries []string) error {
+	hosts := map[string][]net.IP{}
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) < 2 {
+			return errors.Errorf("invalid hosts entry, format: '<IP> <host> [<host>...]': %s", entry)
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return errors.Errorf("invalid IP of hosts entry: %s", entry)
+		}
+
+		for _, host := range fields[1:] {
+			host = dns.Fqdn(strings.ToLower(host))
+			hosts[host] = append(hosts[host], ip)
+		}
+	}
+	r.dns.hosts = hosts
+	return nil
+}
+
+// dnsHosts answer the static host by the IPs of the query type, the other
+// query types get an empty answer
+func dnsHosts(domain string, ips []net.IP, req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+
+	hdr := dns.RR_Header{Name: domain, Rrtype: req.Question[0].Qtype, Class: dns.ClassINET, Ttl: 60}
+	for _, ip := range ips {
+		switch ip4 := ip.To4(); {
+		case req.Question[0].Qtype == dns.TypeA && ip4 != nil:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case req.Question[0].Qtype == dns.TypeAAAA && ip4 == nil:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return m
+}
+
 func (r *Router) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	// https://stackoverflow.com/questions/4082081/requesting-a-and-aaaa-records-in-single-dns-query/4083071#4083071
 	if len(req.Question) == 0 {
@@ -15,88 +114,398 @@ func (r *Router) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		w = &udpWriter{ResponseWriter: w, size: udpSize(req)}
+	}
+	if r.queryLog == nil {
+		r.serveDNS(w, req)
+		return
+	}
+
+	start := time.Now()
+	lw := &logWriter{ResponseWriter: w}
+	verdict := r.serveDNS(lw, req)
+	r.queryLog.add(req, lw, verdict, time.Since(start))
+}
+
+// serveDNS answer the query, return the verdict of the domain
+func (r *Router) serveDNS(w dns.ResponseWriter, req *dns.Msg) (verdict string) {
 	domain := req.Question[0].Name
+	if ips, ok := r.dns.hosts[strings.ToLower(domain)]; ok {
+		log.Info().
+			Str("===", domain).
+			Msg("ServeDNS")
+		_ = w.WriteMsg(r.overrideTTL(domain, dnsHosts(domain, ips, req)))
+		return "hosts"
+	}
 
-	// 1. rule_based( block > direct > proxy )
-	switch {
-	case r.blockRule.Match(domain):
-		_ = w.WriteMsg(r.dnsFail(req, dns.RcodeNameError))
+	if m := r.dnsPTR(req); m != nil {
+		_ = w.WriteMsg(m)
+		return "reverse"
+	}
+	if u := r.forwardOf(domain); u != nil {
+		log.Info().
+			Str("-=>", domain).
+			Str("upstream", u.server).
+			Msg("ServeDNS")
+		r.serveBy(w, req, domain, u, true)
+		return "forward"
+	}
+	if isLocalName(domain) {
+		log.Info().
+			Str("~~~", domain).
+			Msg("ServeDNS")
+		r.serveLocal(w, req)
+		return "local"
+	}
+
+	policy := r.policyOf(w.RemoteAddr())
+	if r.dryRun {
+		kind := r.matchDomain(domain, policy)
+		if kind == "" {
+			kind = r.final
+		}
+		log.Info().
+			Str("domain", domain).
+			Str("route", kind).
+			Msg("ServeDNS dry run, resolve direct")
+		r.serveUpstream(w, req, domain, RuleDirect)
+		return "dry run " + kind
+	}
+
+	// 1. rule_based, in the order of priority, default: block > direct > proxy
+	kind := r.matchDomain(domain, policy)
+	switch kind {
+	case RuleBlock:
+		_ = w.WriteMsg(r.dnsBlock(domain, req))
 		log.Info().
 			Str("-X-", domain).
 			Msg("ServeDNS")
-		return
+		return RuleBlock
 
-	case r.directRule.Match(domain):
+	case RuleDirect:
 		log.Info().
 			Str("---", domain).
 			Msg("ServeDNS")
+		if r.aaaaPolicy(RuleDirect, req) == AAAAEmpty {
+			_ = w.WriteMsg(new(dns.Msg).SetReply(req))
+			return RuleDirect
+		}
 
-	case r.proxyRule.Match(domain):
-		_ = w.WriteMsg(r.dnsProxyA(domain, r.dns.serveIP, req))
+	case RuleProxy:
 		log.Info().
 			Str(">>>", domain).
 			Msg("ServeDNS")
-		return
+		if r.fakeIP != nil {
+			_ = w.WriteMsg(r.dnsFakeIP(domain, req))
+			return RuleProxy
+		}
+		if r.aaaaPolicy(RuleProxy, req) != AAAAPass || isSVCB(req) {
+			_ = w.WriteMsg(r.overrideTTL(domain, r.dnsProxyA(domain, req)))
+			return RuleProxy
+		}
 
 	default:
+		if r.fakeIP != nil {
+			log.Info().
+				Str("..>", domain).
+				Msg("ServeDNS fake IP")
+			_ = w.WriteMsg(r.dnsFakeIP(domain, req))
+			return "fake IP"
+		}
+		if r.final == RuleProxy {
+			log.Info().
+				Str("..>", domain).
+				Msg("ServeDNS")
+			if r.aaaaPolicy(RuleProxy, req) != AAAAPass || isSVCB(req) {
+				_ = w.WriteMsg(r.overrideTTL(domain, r.dnsProxyA(domain, req)))
+				return "final proxy"
+			}
+			break
+		}
 		log.Info().
 			Str("...", domain).
 			Msg("ServeDNS")
+		if r.aaaaPolicy(RuleDirect, req) == AAAAEmpty {
+			_ = w.WriteMsg(new(dns.Msg).SetReply(req))
+			return r.final
+		}
+	}
+
+	if kind == "" {
+		kind = r.final
+	}
+	r.serveUpstream(w, req, domain, kind)
+	return kind
+}
+
+// serveUpstream resolve by the upstream DNS of the category with cache, do not
+// fallback to proxy to avoid side-effect
+func (r *Router) serveUpstream(w dns.ResponseWriter, req *dns.Msg, domain, kind string) {
+	u := r.dns.fallback
+	if kind == RuleProxy && r.dns.proxyDNS != nil {
+		u = r.dns.proxyDNS
 	}
 
-	// 2. direct with cache, do not fallback to proxy to avoid side-effect
-	c := &dnsCache{Router: r, Req: req}
-	if err := r.dns.cache.Remember(c, req.Question[0].String()); err != nil {
+	r.serveBy(w, req, domain, u, kind != RuleProxy)
+}
+
+// serveBy resolve by the upstream with cache, the direct resolved carry the
+// client subnet and obey the direct AAAA policy
+func (r *Router) serveBy(w dns.ResponseWriter, req *dns.Msg, domain string, u *upstream, direct bool) {
+	resp, err := r.lookup(u, req, direct)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("question", req.Question[0].String()).
+			Msg("resolve by upstream")
 		_ = w.WriteMsg(r.dnsFail(req, dns.RcodeServerFailure))
 		return
 	}
+	ecsReply(req, resp)
+	if direct && r.dns.aaaa[RuleDirect] == AAAAEmpty {
+		dropIPv6Hint(resp)
+	}
+	if opt := req.IsEdns0(); opt == nil || !opt.Do() {
+		stripDNSSEC(resp)
+	}
 
-	c.Resp.SetReply(req)
-	c.Resp.Compress = true
-	_ = w.WriteMsg(c.Resp)
+	// SetReply reset the rcode of the upstream, eg: NXDOMAIN
+	rcode := resp.Rcode
+	resp.SetReply(req)
+	resp.Rcode = rcode
+	resp.Compress = true
+	_ = w.WriteMsg(r.overrideTTL(domain, resp))
+}
+
+// lookup resolve by the upstream with cache, nil for the system DNS
+func (r *Router) lookup(u *upstream, req *dns.Msg, ecs bool) (*dns.Msg, error) {
+	query := req
+	if ecs {
+		query = r.ecsQuery(req)
+	}
+	if r.dns.dnssec {
+		query = withDO(query)
+	}
+
+	key := newCacheKey(query, u)
+	if resp, refresh := r.dns.cache.get(key); resp != nil {
+		if refresh {
+			query := query.Copy()
+			go func() {
+				if _, err := r.resolve(u, query, key); err != nil {
+					log.Warn().Err(err).
+						Str("question", query.Question[0].String()).
+						Msg("prefetch dns record")
+				}
+			}()
+		}
+		return resp, nil
+	}
+	return r.resolve(u, query, key)
+}
+
+// resolve exchange the query by the upstream and cache the answer
+func (r *Router) resolve(u *upstream, query *dns.Msg, key cacheKey) (*dns.Msg, error) {
+	var resp *dns.Msg
+	var err error
+	if u != nil {
+		resp, err = u.exchange(query)
+	} else {
+		resp, err = r.exchangeClean(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.dns.dnssec {
+		if err := r.verifyRRSIG(u, resp); err != nil {
+			return nil, err
+		}
+	}
+	r.dns.cache.set(key, resp)
+	return resp, nil
+}
+
+// udpWriter truncate the answer over the UDP size of the client, the TC bit
+// make the client retry over TCP
+type udpWriter struct {
+	dns.ResponseWriter
+	size int
+}
+
+func (w *udpWriter) WriteMsg(m *dns.Msg) error {
+	m.Truncate(w.size)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// udpSize return the UDP payload size advertised by EDNS0, 512 by default
+func udpSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
 }
 
 func (r *Router) dnsFail(req *dns.Msg, rcode int) *dns.Msg {
 	m := new(dns.Msg)
-	m.SetRcode(req, dns.RcodeServerFailure)
+	m.SetRcode(req, rcode)
 	return m
 }
 
-func (r *Router) dnsProxyA(domain string, localIP net.IP, req *dns.Msg) *dns.Msg {
+// the DNS answers of the blocked domains, or a sinkhole IP
+const (
+	BlockAnswerNXDomain = "nxdomain" // NXDOMAIN
+	BlockAnswerZero     = "zero"     // 0.0.0.0 for A, :: for AAAA
+)
+
+// SetBlockAnswer set the DNS answer of the blocked domains, option: nxdomain,
+// zero or a sinkhole IP
+func (r *Router) SetBlockAnswer(answer string) error {
+	switch answer {
+	case BlockAnswerNXDomain:
+		r.dns.sinkhole = nil
+	case BlockAnswerZero:
+		r.dns.sinkhole = net.IPv6zero
+	default:
+		ip := net.ParseIP(answer)
+		if ip == nil {
+			return errors.Errorf("invalid DNS answer of blocked domains: %s", answer)
+		}
+		r.dns.sinkhole = ip
+	}
+	return nil
+}
+
+// dnsBlock answer the blocked domain by the sinkhole IP, the other query types
+// and the mismatched IP version get an empty answer
+func (r *Router) dnsBlock(domain string, req *dns.Msg) *dns.Msg {
+	if r.dns.sinkhole == nil {
+		return r.dnsFail(req, dns.RcodeNameError)
+	}
+
 	m := new(dns.Msg)
 	m.SetReply(req)
+	hdr := dns.RR_Header{Name: domain, Rrtype: req.Question[0].Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch ip := r.dns.sinkhole; req.Question[0].Qtype {
+	case dns.TypeA:
+		if ip.Equal(net.IPv6zero) {
+			ip = net.IPv4zero
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip4}}
+		}
+	case dns.TypeAAAA:
+		if ip.To4() == nil {
+			m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+		}
+	}
+	return m
+}
 
-	if localIP.To4() != nil {
-		m.Answer = []dns.RR{&dns.A{
-			Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 20},
-			A:   localIP,
-		}}
+// dnsProxyA answer the proxied domain by the serve IP of the query type, the
+// other query types get an empty answer, include HTTPS / SVCB whose ECH and
+// alternative endpoints bypass the serve IP
+func (r *Router) dnsProxyA(domain string, req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
 
-	} else {
-		m.Answer = []dns.RR{&dns.AAAA{
-			Hdr:  dns.RR_Header{Name: domain, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 20},
-			AAAA: localIP,
-		}}
+	hdr := dns.RR_Header{Name: domain, Rrtype: req.Question[0].Qtype, Class: dns.ClassINET, Ttl: 20}
+	switch req.Question[0].Qtype {
+	case dns.TypeA:
+		if ip4 := r.dns.serveIP.To4(); ip4 != nil {
+			m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip4}}
+		}
+	case dns.TypeAAAA:
+		if r.dns.aaaa[RuleProxy] == AAAAServe && r.dns.serveIP6 != nil {
+			m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: r.dns.serveIP6}}
+		}
 	}
 	return m
 }
 
-type dnsCache struct {
-	*Router
-	Req, Resp *dns.Msg
+// the AAAA answers of the domains per category
+const (
+	AAAAServe = "serve" // the IPv6 serve IP, empty if not set, proxy only
+	AAAAEmpty = "empty" // empty NOERROR
+	AAAAPass  = "pass"  // the upstream answer as is
+)
+
+// SetAAAAPolicy set the AAAA answer of the domains routed to the category,
+// option: serve, empty or pass. The unmatched domains follow the final policy.
+func (r *Router) SetAAAAPolicy(kind, policy string) error {
+	switch {
+	case kind == RuleProxy && (policy == AAAAServe || policy == AAAAEmpty || policy == AAAAPass),
+		kind == RuleDirect && (policy == AAAAEmpty || policy == AAAAPass):
+		r.dns.aaaa[kind] = policy
+		return nil
+	default:
+		return errors.Errorf("invalid AAAA policy (%s) of %s domains", policy, kind)
+	}
+}
+
+// SetServeIP6 set the IPv6 serve IP answering the AAAA queries of the proxied
+// domains, empty to keep the default
+func (r *Router) SetServeIP6(serveIP6 string) error {
+	if serveIP6 == "" {
+		return nil
+	}
+	ip := net.ParseIP(serveIP6)
+	if ip == nil || ip.To4() != nil {
+		return errors.Errorf("invalid IPv6 serve IP: %s", serveIP6)
+	}
+	r.dns.serveIP6 = ip
+	return nil
+}
+
+// isSVCB check whether the query is of type HTTPS or SVCB
+func isSVCB(req *dns.Msg) bool {
+	qtype := req.Question[0].Qtype
+	return qtype == dns.TypeHTTPS || qtype == dns.TypeSVCB
+}
+
+// dropIPv6Hint remove the ipv6hint of the HTTPS / SVCB answers, so that the
+// empty AAAA policy is not bypassed
+func dropIPv6Hint(m *dns.Msg) {
+	for _, rr := range m.Answer {
+		var svcb *dns.SVCB
+		switch rr := rr.(type) {
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		case *dns.SVCB:
+			svcb = rr
+		default:
+			continue
+		}
+
+		values := svcb.Value[:0]
+		for _, kv := range svcb.Value {
+			if kv.Key() != dns.SVCB_IPV6HINT {
+				values = append(values, kv)
+			}
+		}
+		svcb.Value = values
+	}
+}
+
+// aaaaPolicy return the AAAA policy of the category, empty if not a AAAA query
+func (r *Router) aaaaPolicy(kind string, req *dns.Msg) string {
+	if req.Question[0].Qtype != dns.TypeAAAA {
+		return ""
+	}
+	return r.dns.aaaa[kind]
 }
 
-func (r *dnsCache) Fulfill(question string) (err error) {
+// exchange forward the query to the system DNS server, retry once
+func (r *Router) exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	conn := <-r.dns.connCh
 
 	var rtt time.Duration
-	r.Resp, rtt, err = r.dns.ExchangeWithConn(r.Req, conn)
+	resp, rtt, err = r.dns.ExchangeWithConn(req, conn)
 	if err != nil {
-		r.Resp, rtt, err = r.dns.ExchangeWithConn(r.Req, conn)
+		resp, rtt, err = r.dns.ExchangeWithConn(req, conn)
 	}
 	log.DebugWarn(err).
 		Dur("rtt", rtt).
-		Str("question", question).
+		Str("question", req.Question[0].String()).
 		Msg("exchange dns record")
 
 	select {
@@ -104,5 +513,23 @@ func (r *dnsCache) Fulfill(question string) (err error) {
 	default:
 		conn.Close()
 	}
-	return err
+	if err == nil && resp.Truncated {
+		return retryTCP(req, resp, conn.RemoteAddr().String())
+	}
+	return resp, err
+}
+
+// retryTCP ask the server again over TCP for the truncated UDP answer, the
+// truncated one is kept if TCP fails
+func retryTCP(req, resp *dns.Msg, addr string) (*dns.Msg, error) {
+	client := dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	full, _, err := client.Exchange(req, addr)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("server", addr).
+			Str("question", req.Question[0].String()).
+			Msg("retry truncated answer over TCP")
+		return resp, nil
+	}
+	return full, nil
 }
@@ -0,0 +1,226 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsCache cache the upstream answers by the question and the upstream, for
+// the TTL of the answers clamped into [minTTL, maxTTL]. The NXDOMAIN and
+// NODATA answers are cached for the TTL of the SOA, at most negTTL (RFC 2308).
+type dnsCache struct {
+	mu             sync.Mutex
+	size           int
+	minTTL, maxTTL time.Duration
+	negTTL         time.Duration
+	prefetch       int
+	items          map[cacheKey]*dnsEntry
+}
+
+type dnsEntry struct {
+	msg         *dns.Msg
+	stored      time.Time
+	expire      time.Time
+	hits        int
+	prefetching bool
+}
+
+// SetDNSCache cache at most size answers, the TTLs of the answers are clamped
+// into [minTTL, maxTTL], the negative answers are kept at most negTTL, size 0
+// to disable, negTTL 0 to disable the negative caching
+func (r *Router) SetDNSCache(size int, minTTL, maxTTL, negTTL time.Duration) {
+	c := &r.dns.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size, c.minTTL, c.maxTTL, c.negTTL = size, minTTL, maxTTL, negTTL
+	c.items = map[cacheKey]*dnsEntry{}
+}
+
+// SetDNSPrefetch refresh the answers queried at least hits times before they
+// expire, in the last 10% of the TTL, 0 to disable
+func (r *Router) SetDNSPrefetch(hits int) {
+	c := &r.dns.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prefetch = hits
+}
+
+// cacheKey is the question, the DNSSEC bits, the client subnet and the
+// upstream, empty for the system DNS. The answers vary by the client subnet,
+// eg: the CDN domains.
+type cacheKey struct {
+	q        dns.Question
+	do, cd   bool
+	ecs      string
+	upstream string
+}
+
+func newCacheKey(req *dns.Msg, u *upstream) cacheKey {
+	key := cacheKey{q: req.Question[0], cd: req.CheckingDisabled}
+	if opt := req.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				bits := 8 * net.IPv6len
+				if subnet.Family == 1 {
+					bits = 8 * net.IPv4len
+				}
+				ip := subnet.Address.Mask(net.CIDRMask(int(subnet.SourceNetmask), bits))
+				key.ecs = fmt.Sprintf("%d/%s/%d", subnet.Family, ip, subnet.SourceNetmask)
+			}
+		}
+	}
+	if u != nil {
+		key.upstream = u.server
+	}
+	return key
+}
+
+func (k cacheKey) lower() cacheKey {
+	k.q.Name = strings.ToLower(k.q.Name)
+	return k
+}
+
+// get return a copy of the cached answer with the TTLs decreased, nil if
+// missed. The popular answer close to expiry is reported once to be refreshed.
+func (c *dnsCache) get(key cacheKey) (_ *dns.Msg, refresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key.lower()]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if now.After(e.expire) {
+		delete(c.items, key.lower())
+		return nil, false
+	}
+
+	e.hits++
+	if c.prefetch > 0 && e.hits >= c.prefetch && !e.prefetching &&
+		e.expire.Sub(now) < e.expire.Sub(e.stored)/10 {
+		e.prefetching, refresh = true, true
+	}
+
+	m := e.msg.Copy()
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				if hdr.Ttl > elapsed {
+					hdr.Ttl -= elapsed
+				} else {
+					hdr.Ttl = 1
+				}
+			}
+		}
+	}
+	return m, refresh
+}
+
+// set cache the successful answer for its min TTL, and the negative answer
+// for the negative TTL of its SOA
+func (c *dnsCache) set(key cacheKey, m *dns.Msg) {
+	if m.Truncated {
+		return
+	}
+	if m.Rcode == dns.RcodeSuccess && len(m.Answer) != 0 {
+		ttl := time.Duration(minTTL(m)) * time.Second
+		if ttl < c.minTTL {
+			ttl = c.minTTL
+		}
+		if c.maxTTL > 0 && ttl > c.maxTTL {
+			ttl = c.maxTTL
+		}
+		c.store(key, m, ttl)
+		return
+	}
+
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return
+	}
+	// the negative answer without SOA should not be cached
+	ttl, ok := negativeTTL(m)
+	if !ok {
+		return
+	}
+	if ttl > c.negTTL {
+		ttl = c.negTTL
+	}
+
+	// the clients cache the negative answer for the TTL of the SOA
+	m = m.Copy()
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Hdr.Ttl = uint32(ttl / time.Second)
+		}
+	}
+	c.store(key, m, ttl)
+}
+
+func (c *dnsCache) store(key cacheKey, m *dns.Msg, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 || ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if len(c.items) >= c.size {
+		for k, e := range c.items {
+			if now.After(e.expire) {
+				delete(c.items, k)
+			}
+		}
+		// still full, drop an arbitrary one
+		for k := range c.items {
+			if len(c.items) < c.size {
+				break
+			}
+			delete(c.items, k)
+		}
+	}
+	c.items[key.lower()] = &dnsEntry{msg: m.Copy(), stored: now, expire: now.Add(ttl)}
+}
+
+// flush drop all the cached answers
+func (c *dnsCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = map[cacheKey]*dnsEntry{}
+}
+
+// minTTL return the min TTL of the records, the OPT pseudo record is skipped
+func minTTL(m *dns.Msg) uint32 {
+	ttl, found := uint32(0), false
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT && (!found || hdr.Ttl < ttl) {
+				ttl, found = hdr.Ttl, true
+			}
+		}
+	}
+	return ttl
+}
+
+// negativeTTL return the TTL of the NXDOMAIN / NODATA answer, which is the
+// smaller of the SOA TTL and the SOA MINIMUM, false if no SOA in authority
+func negativeTTL(m *dns.Msg) (time.Duration, bool) {
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second, true
+		}
+	}
+	return 0, false
+}
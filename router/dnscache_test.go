@@ -0,0 +1,156 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestCache(minTTL, maxTTL, negTTL time.Duration) *dnsCache {
+	return &dnsCache{size: 10, minTTL: minTTL, maxTTL: maxTTL, negTTL: negTTL, items: map[cacheKey]*dnsEntry{}}
+}
+
+func answer(name string, ttl uint32) *dns.Msg {
+	m := new(dns.Msg).SetQuestion(name, dns.TypeA)
+	m.Response = true
+	m.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.IPv4(1, 2, 3, 4),
+	}}
+	return m
+}
+
+func negative(name string, rcode int, soaTTL, minTTL uint32) *dns.Msg {
+	m := new(dns.Msg).SetQuestion(name, dns.TypeA)
+	m.Response, m.Rcode = true, rcode
+	m.Ns = []dns.RR{&dns.SOA{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+		Ns:  "ns.example.com.", Mbox: "admin.example.com.", Minttl: minTTL,
+	}}
+	return m
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		minTTL, maxTTL time.Duration
+		ttl            uint32
+		want           time.Duration
+	}{
+		{"answer TTL", 0, time.Hour, 300, 300 * time.Second},
+		{"clamp to min TTL", 10 * time.Minute, time.Hour, 300, 10 * time.Minute},
+		{"clamp to max TTL", 0, time.Minute, 300, time.Minute},
+		{"unlimited max TTL", 0, 0, 86400, 24 * time.Hour},
+		{"zero TTL", 0, time.Hour, 0, 0},
+	} {
+		c := newTestCache(tc.minTTL, tc.maxTTL, time.Minute)
+		m := answer("a.example.com.", tc.ttl)
+		key := newCacheKey(m, nil)
+		c.set(key, m)
+
+		e, ok := c.items[key.lower()]
+		if tc.want == 0 {
+			if ok {
+				t.Errorf("%s: should not be cached", tc.name)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: not cached", tc.name)
+			continue
+		}
+		if got := e.expire.Sub(e.stored); got != tc.want {
+			t.Errorf("%s: cached for %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDNSCacheGet(t *testing.T) {
+	c := newTestCache(0, time.Hour, time.Minute)
+	m := answer("a.example.com.", 300)
+	c.set(newCacheKey(m, nil), m)
+
+	// the question is case insensitive, the TTLs decrease by the elapsed time
+	key := newCacheKey(new(dns.Msg).SetQuestion("A.Example.com.", dns.TypeA), nil)
+	c.items[key.lower()].stored = time.Now().Add(-100 * time.Second)
+	got, _ := c.get(key)
+	if got == nil || got.Answer[0].Header().Ttl != 200 {
+		t.Fatalf("unexpected cached answer: %v", got)
+	}
+	if m.Answer[0].Header().Ttl != 300 {
+		t.Error("the cached answer should be copied")
+	}
+
+	c.items[key.lower()].expire = time.Now().Add(-time.Second)
+	if got, _ := c.get(key); got != nil {
+		t.Error("the expired answer should be dropped")
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		msg    *dns.Msg
+		negTTL time.Duration
+		want   time.Duration
+	}{
+		{"NXDOMAIN by SOA MINIMUM", negative("x.example.com.", dns.RcodeNameError, 300, 30), time.Hour, 30 * time.Second},
+		{"NODATA by SOA TTL", negative("x.example.com.", dns.RcodeSuccess, 20, 300), time.Hour, 20 * time.Second},
+		{"clamp to negative TTL", negative("x.example.com.", dns.RcodeNameError, 300, 300), time.Minute, time.Minute},
+		{"negative caching disabled", negative("x.example.com.", dns.RcodeNameError, 300, 300), 0, 0},
+		{"SERVFAIL", negative("x.example.com.", dns.RcodeServerFailure, 300, 300), time.Hour, 0},
+		{"without SOA", new(dns.Msg).SetRcode(new(dns.Msg).SetQuestion("x.example.com.", dns.TypeA), dns.RcodeNameError), time.Hour, 0},
+	} {
+		c := newTestCache(0, time.Hour, tc.negTTL)
+		key := newCacheKey(tc.msg, nil)
+		c.set(key, tc.msg)
+
+		got, _ := c.get(key)
+		if tc.want == 0 {
+			if got != nil {
+				t.Errorf("%s: should not be cached", tc.name)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: not cached", tc.name)
+			continue
+		}
+		// the clients cache the negative answer for the TTL of the SOA
+		if ttl := time.Duration(got.Ns[0].Header().Ttl) * time.Second; ttl != tc.want {
+			t.Errorf("%s: SOA TTL %s, want %s", tc.name, ttl, tc.want)
+		}
+		if e := c.items[key.lower()]; e.expire.Sub(e.stored) != tc.want {
+			t.Errorf("%s: cached for %s, want %s", tc.name, e.expire.Sub(e.stored), tc.want)
+		}
+	}
+}
+
+func TestCacheKeyECS(t *testing.T) {
+	query := func(subnet string) *dns.Msg {
+		m := new(dns.Msg).SetQuestion("cdn.example.com.", dns.TypeA)
+		if subnet == "" {
+			return m
+		}
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		ip, ipNet, _ := net.ParseCIDR(subnet)
+		ones, _ := ipNet.Mask.Size()
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: ip.To4(),
+		})
+		return m
+	}
+
+	a, b := newCacheKey(query("1.2.3.0/24"), nil), newCacheKey(query("5.6.7.0/24"), nil)
+	if a == b {
+		t.Error("the answers of the different client subnets should not share the key")
+	}
+	if a != newCacheKey(query("1.2.3.4/24"), nil) {
+		t.Error("the host bits out of the source netmask should be ignored")
+	}
+	if a == newCacheKey(query(""), nil) {
+		t.Error("the query without client subnet should not share the key")
+	}
+}
@@ -0,0 +1,118 @@
+package router
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// SetDNSSECVerify request the DNSSEC records from the upstream, and verify the
+// RRSIG of the signed answers by the DNSKEY of the signer. The chain of trust
+// up to the root is not validated, the unsigned answers are passed.
+func (r *Router) SetDNSSECVerify(enable bool) {
+	r.dns.dnssec = enable
+}
+
+// withDO return the query with the DO bit set
+func withDO(req *dns.Msg) *dns.Msg {
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		return req
+	}
+
+	m := req.Copy()
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		m.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return m
+}
+
+// stripDNSSEC remove the DNSSEC records for the client without the DO bit
+func stripDNSSEC(m *dns.Msg) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			default:
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	m.Answer, m.Ns, m.Extra = strip(m.Answer), strip(m.Ns), strip(m.Extra)
+}
+
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+// verifyRRSIG verify the signed RRsets of the answer section
+func (r *Router) verifyRRSIG(u *upstream, resp *dns.Msg) error {
+	rrsets := map[rrsetKey][]dns.RR{}
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		key := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	for _, sig := range sigs {
+		rrset := rrsets[rrsetKey{strings.ToLower(sig.Hdr.Name), sig.TypeCovered}]
+		if len(rrset) == 0 {
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			return errors.Errorf("RRSIG of %s out of validity period", sig.Hdr.Name)
+		}
+
+		keys, err := r.dnskeys(u, sig.SignerName, resp)
+		if err != nil {
+			return errors.Wrapf(err, "DNSKEY of %s", sig.SignerName)
+		}
+		verified := false
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, rrset) == nil {
+				verified = true
+				break
+			}
+		}
+		if !verified {
+			return errors.Errorf("bogus RRSIG of %s %s", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered])
+		}
+	}
+	return nil
+}
+
+// dnskeys return the DNSKEY of the signer, the DNSKEY answer is verified by
+// the keys in itself
+func (r *Router) dnskeys(u *upstream, signer string, resp *dns.Msg) ([]*dns.DNSKEY, error) {
+	m := resp
+	if q := resp.Question[0]; q.Qtype != dns.TypeDNSKEY || !strings.EqualFold(q.Name, signer) {
+		req := new(dns.Msg).SetQuestion(signer, dns.TypeDNSKEY)
+		req.SetEdns0(dns.DefaultMsgSize, true)
+
+		var err error
+		if m, err = r.lookup(u, req, false); err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []*dns.DNSKEY
+	for _, rr := range m.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no DNSKEY")
+	}
+	return keys, nil
+}
@@ -0,0 +1,100 @@
+package router
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// the EDNS Client Subnet handling of the queries to the upstream, or a CIDR
+// to override the client subnet
+const (
+	ECSForward = "forward" // forward as is
+	ECSStrip   = "strip"   // strip from the queries
+)
+
+// SetECS set the EDNS Client Subnet of the queries to the upstream of the
+// direct and unmatched domains, option: forward, strip or a CIDR, eg: 1.2.3.0/24
+func (r *Router) SetECS(ecs string) error {
+	switch ecs {
+	case "", ECSForward, ECSStrip:
+		r.dns.ecs, r.dns.ecsSubnet = ecs, nil
+		return nil
+	}
+
+	ip, ipNet, err := net.ParseCIDR(ecs)
+	if err != nil {
+		return errors.Wrapf(err, "invalid ECS option: %s", ecs)
+	}
+	ones, _ := ipNet.Mask.Size()
+	subnet := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(ones),
+		Address:       ipNet.IP,
+	}
+	if ip.To4() == nil {
+		subnet.Family = 2
+	}
+	r.dns.ecs, r.dns.ecsSubnet = ecs, subnet
+	return nil
+}
+
+// ecsQuery return the query to the upstream with the client subnet handled
+func (r *Router) ecsQuery(req *dns.Msg) *dns.Msg {
+	if r.dns.ecs == "" || r.dns.ecs == ECSForward {
+		return req
+	}
+
+	m := req.Copy()
+	stripECS(m)
+	if r.dns.ecsSubnet != nil {
+		opt := m.IsEdns0()
+		if opt == nil {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			opt = m.IsEdns0()
+		}
+		opt.Option = append(opt.Option, r.dns.ecsSubnet)
+	}
+	return m
+}
+
+// ecsReply drop the EDNS added to the query of the client without EDNS, and
+// the client subnet the client did not send
+func ecsReply(req, resp *dns.Msg) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+		return
+	}
+
+	for _, o := range reqOpt.Option {
+		if o.Option() == dns.EDNS0SUBNET {
+			return
+		}
+	}
+	stripECS(resp)
+}
+
+// stripECS remove the client subnet option of the message
+func stripECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
@@ -0,0 +1,114 @@
+package router
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// fakeIP hand out an address of the pool per domain, the connections to the
+// addresses are routed by the domains. The oldest mapping is recycled once the
+// pool is used up.
+type fakeIP struct {
+	mu     sync.Mutex
+	prefix netip.Prefix
+	next   netip.Addr
+	byIP   map[netip.Addr]string
+	byName map[string]netip.Addr
+}
+
+// SetFakeIP answer the proxied and unmatched domains by the addresses of the
+// pool, eg: 198.18.0.0/15, empty to disable. The connections to the addresses
+// come from SOCKS5 or a redirection of the pool to sower.
+func (r *Router) SetFakeIP(pool string) error {
+	if pool == "" {
+		r.fakeIP = nil
+		return nil
+	}
+
+	prefix, err := netip.ParsePrefix(pool)
+	if err != nil {
+		return errors.Wrap(err, "parse fake IP pool")
+	}
+	if prefix.Addr().BitLen()-prefix.Bits() < 2 {
+		return errors.Errorf("fake IP pool too small: %s", pool)
+	}
+
+	prefix = prefix.Masked()
+	r.fakeIP = &fakeIP{
+		prefix: prefix,
+		next:   prefix.Addr().Next(),
+		byIP:   map[netip.Addr]string{},
+		byName: map[string]netip.Addr{},
+	}
+	return nil
+}
+
+// ResetFakeIP drop the mappings of the fake IP pool, and hand out the
+// addresses from the start again
+func (r *Router) ResetFakeIP() {
+	f := r.fakeIP
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next = f.prefix.Addr().Next()
+	f.byIP = map[netip.Addr]string{}
+	f.byName = map[string]netip.Addr{}
+}
+
+// addr return the address of the domain, allocate one if not mapped yet
+func (f *fakeIP) addr(domain string) netip.Addr {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if ip, ok := f.byName[domain]; ok {
+		return ip
+	}
+
+	// the network and the last addresses are skipped
+	ip := f.next
+	if f.next = ip.Next(); !f.prefix.Contains(f.next.Next()) {
+		f.next = f.prefix.Addr().Next()
+	}
+	if old, ok := f.byIP[ip]; ok {
+		delete(f.byName, old)
+	}
+	f.byIP[ip], f.byName[domain] = domain, ip
+	return ip
+}
+
+// domain return the domain mapped to the address
+func (f *fakeIP) domain(host string) (string, bool) {
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !f.prefix.Contains(ip.Unmap()) {
+		return "", false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	domain, ok := f.byIP[ip.Unmap()]
+	return domain, ok
+}
+
+// dnsFakeIP answer the domain by the fake address of the query type, the other
+// query types get an empty answer
+func (r *Router) dnsFakeIP(domain string, req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	hdr := dns.RR_Header{Name: domain, Rrtype: req.Question[0].Qtype, Class: dns.ClassINET, Ttl: 20}
+	switch ip := r.fakeIP.prefix.Addr(); {
+	case req.Question[0].Qtype == dns.TypeA && ip.Is4():
+		m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: r.fakeIP.addr(domain).AsSlice()}}
+	case req.Question[0].Qtype == dns.TypeAAAA && ip.Is6():
+		m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: r.fakeIP.addr(domain).AsSlice()}}
+	}
+	return m
+}
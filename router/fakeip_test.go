@@ -0,0 +1,43 @@
+package router
+
+import "testing"
+
+func TestFakeIPRecycle(t *testing.T) {
+	r := &Router{}
+	if err := r.SetFakeIP("10.0.0.0/30"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the network and the last addresses are skipped, the oldest is recycled
+	for _, tc := range []struct{ domain, ip string }{
+		{"a.com.", "10.0.0.1"},
+		{"b.com", "10.0.0.2"},
+		{"A.com", "10.0.0.1"},
+		{"c.com", "10.0.0.1"},
+	} {
+		if ip := r.fakeIP.addr(tc.domain); ip.String() != tc.ip {
+			t.Errorf("%s: got %s, want %s", tc.domain, ip, tc.ip)
+		}
+	}
+	if domain, ok := r.fakeIP.domain("10.0.0.1"); !ok || domain != "c.com" {
+		t.Errorf("unexpected domain of recycled address: %s", domain)
+	}
+	if domain, ok := r.fakeIP.domain("10.0.0.2"); !ok || domain != "b.com" {
+		t.Errorf("unexpected domain: %s", domain)
+	}
+	if _, ok := r.fakeIP.domain("10.0.0.3"); ok {
+		t.Error("the address out of the pool should not be mapped")
+	}
+
+	r.ResetFakeIP()
+	if _, ok := r.fakeIP.domain("10.0.0.2"); ok {
+		t.Error("the mapping should be dropped after reset")
+	}
+	if ip := r.fakeIP.addr("d.com"); ip.String() != "10.0.0.1" {
+		t.Errorf("should hand out from the start after reset, got %s", ip)
+	}
+
+	if err := r.SetFakeIP("10.0.0.0/31"); err == nil {
+		t.Error("the pool too small should fail")
+	}
+}
@@ -0,0 +1,60 @@
+package router
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// forward is the resolver of the domain suffix, eg: the DNS of a VPN
+type forward struct {
+	suffix string
+	u      *upstream
+}
+
+// SetForwards set the resolvers of the domain suffixes, which are asked
+// directly ahead of routing, format: '<suffix> <server>', the server is a
+// DoH URL, a DoT address or a DNS over TCP address, eg: 'corp.internal 10.0.0.2'
+func (r *Router) SetForwards(entries []string) error {
+	var forwards []forward
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return errors.Errorf("invalid forward entry, format: '<suffix> <server>': %s", entry)
+		}
+
+		server := fields[1]
+		if !isDoH(server) && !isDoT(server) {
+			host := server
+			if h, _, err := net.SplitHostPort(server); err == nil {
+				host = h
+			}
+			if net.ParseIP(host) == nil {
+				return errors.Errorf("invalid resolver of forward entry: %s", entry)
+			}
+		}
+
+		suffix := dns.Fqdn(strings.ToLower(strings.TrimPrefix(fields[0], ".")))
+		forwards = append(forwards, forward{suffix: suffix, u: newUpstream(server, directDial)})
+	}
+	r.dns.forwards = forwards
+	return nil
+}
+
+// forwardOf return the resolver of the longest matched suffix, nil if none
+func (r *Router) forwardOf(domain string) *upstream {
+	domain = dns.Fqdn(strings.ToLower(domain))
+	var u *upstream
+	matched := 0
+	for _, f := range r.dns.forwards {
+		if len(f.suffix) <= matched {
+			continue
+		}
+		if domain == f.suffix || strings.HasSuffix(domain, "."+f.suffix) {
+			u, matched = f.u, len(f.suffix)
+		}
+	}
+	return u
+}
@@ -0,0 +1,62 @@
+package router
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// RuleHit is the match counts of a rule, by the DNS queries and by the
+// connections separately, as a connection may be matched without a query,
+// eg: via SOCKS5, and a query without a connection, eg: blocked by DNS
+type RuleHit struct {
+	Kind    string
+	Rule    string
+	Queries int64
+	Conns   int64
+}
+
+type hitCount struct {
+	queries, conns atomic.Int64
+}
+
+// hit count the match of the rule, by a DNS query or by a connection
+func (r *Router) hit(kind, rule string, query bool) {
+	key := kind + " " + rule
+	val, ok := r.hits.Load(key)
+	if !ok {
+		val, _ = r.hits.LoadOrStore(key, &hitCount{})
+	}
+	if query {
+		val.(*hitCount).queries.Add(1)
+	} else {
+		val.(*hitCount).conns.Add(1)
+	}
+}
+
+// RuleHits return the match counts of the matched rules, the most matched first
+func (r *Router) RuleHits() []RuleHit {
+	var hits []RuleHit
+	r.hits.Range(func(key, val interface{}) bool {
+		kind, rule, _ := strings.Cut(key.(string), " ")
+		c := val.(*hitCount)
+		hits = append(hits, RuleHit{Kind: kind, Rule: rule, Queries: c.queries.Load(), Conns: c.conns.Load()})
+		return true
+	})
+
+	sort.Slice(hits, func(i, j int) bool {
+		if ci, cj := hits[i].Queries+hits[i].Conns, hits[j].Queries+hits[j].Conns; ci != cj {
+			return ci > cj
+		}
+		return hits[i].Kind+hits[i].Rule < hits[j].Kind+hits[j].Rule
+	})
+	return hits
+}
+
+// ResetRuleHits drop the match counts
+func (r *Router) ResetRuleHits() {
+	r.hits.Range(func(key, _ interface{}) bool {
+		r.hits.Delete(key)
+		return true
+	})
+}
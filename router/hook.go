@@ -0,0 +1,174 @@
+package router
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/pkg/replayconn"
+)
+
+// hook is a long running program overriding the verdicts. A line is written to
+// its stdin per connection: '<id> <host> <port> <source IP> <SNI or ->', and
+// the program answers a line: '<id> <block|direct|proxy|->', '-' to keep the
+// verdict. The answer out of the timeout is ignored.
+type hook struct {
+	args    []string
+	timeout time.Duration
+
+	wmu     sync.Mutex // serialize the writes to stdin
+	mu      sync.Mutex
+	stdin   io.WriteCloser
+	started time.Time
+	seq     uint64
+	waiting map[uint64]chan string
+}
+
+// SetHook start the hook program by the command line, empty to disable
+func (r *Router) SetHook(command string, timeout time.Duration) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		r.hook = nil
+		return nil
+	}
+
+	h := &hook{args: args, timeout: timeout, waiting: map[uint64]chan string{}}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.start(); err != nil {
+		return err
+	}
+	r.hook = h
+	return nil
+}
+
+// start the program, the caller holds the lock
+func (h *hook) start() error {
+	h.started = time.Now()
+	cmd := exec.Command(h.args[0], h.args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errors.Wrap(err, "hook stdin")
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrap(err, "hook stdout")
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "start hook (%s)", h.args[0])
+	}
+	h.stdin = stdin
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			idStr, verdict, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+			id, err := strconv.ParseUint(idStr, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			h.mu.Lock()
+			if ch, ok := h.waiting[id]; ok {
+				ch <- strings.TrimSpace(verdict)
+				delete(h.waiting, id)
+			}
+			h.mu.Unlock()
+		}
+
+		err := cmd.Wait()
+		log.Error().Err(err).Strs("hook", h.args).Msg("hook exited")
+		h.mu.Lock()
+		if h.stdin == stdin {
+			h.stdin = nil
+		}
+		h.mu.Unlock()
+	}()
+	return nil
+}
+
+// query the verdict of the connection, empty if not overridden
+func (h *hook) query(host string, port uint16, src net.IP, sni string) string {
+	if sni == "" {
+		sni = "-"
+	}
+
+	ch := make(chan string, 1)
+	h.mu.Lock()
+	if h.stdin == nil && time.Since(h.started) > time.Second {
+		if err := h.start(); err != nil {
+			log.Error().Err(err).Msg("restart hook")
+		}
+	}
+	if h.stdin == nil {
+		h.mu.Unlock()
+		return ""
+	}
+	h.seq++
+	id, stdin := h.seq, h.stdin
+	h.waiting[id] = ch
+	h.mu.Unlock()
+
+	h.wmu.Lock()
+	_, err := fmt.Fprintf(stdin, "%d %s %d %s %s\n", id, host, port, src, sni)
+	h.wmu.Unlock()
+
+	var verdict string
+	if err == nil {
+		select {
+		case verdict = <-ch:
+		case <-time.After(h.timeout):
+			log.Warn().Str("host", host).Dur("timeout", h.timeout).Msg("hook timeout")
+		}
+	}
+
+	h.mu.Lock()
+	delete(h.waiting, id)
+	h.mu.Unlock()
+
+	switch verdict {
+	case RuleBlock, RuleDirect, RuleProxy:
+		return verdict
+	default:
+		return ""
+	}
+}
+
+// sniffSNI read the TLS ClientHello of the connection for the SNI, the data
+// read is replayed by the returned connection
+func sniffSNI(conn net.Conn) (string, net.Conn) {
+	rec := &recordConn{Conn: conn}
+	var sni string
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_ = tls.Server(rec, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errors.New("sniffed")
+		},
+	}).Handshake()
+	_ = conn.SetReadDeadline(time.Time{})
+
+	return sni, replayconn.New(conn, rec.buf)
+}
+
+// recordConn record the data read, and drop the data written
+type recordConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	return n, err
+}
+func (c *recordConn) Write(b []byte) (int, error) { return len(b), nil }
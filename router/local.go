@@ -0,0 +1,90 @@
+package router
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/pkg/dhcp"
+)
+
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// isLocalName check whether the domain is a name of the local network, which
+// is never routed by the rules: single-label, .local and .home.arpa
+func isLocalName(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if net.ParseIP(domain) != nil {
+		return false
+	}
+	return domain != "" && !strings.Contains(domain, ".") ||
+		strings.HasSuffix(domain, ".local") || strings.HasSuffix(domain, ".home.arpa")
+}
+
+// serveLocal resolve the .local names by mDNS, and the other local names by
+// the system DNS, which is the DNS of the local network
+func (r *Router) serveLocal(w dns.ResponseWriter, req *dns.Msg) {
+	var resp *dns.Msg
+	var err error
+	switch name := strings.ToLower(req.Question[0].Name); {
+	case strings.HasSuffix(name, ".local."):
+		resp, err = exchangeMDNS(req)
+	case r.dns.fallback == nil:
+		resp, err = r.exchange(req)
+	default:
+		// the encrypted fallback replace the system DNS, ask the system DNS directly
+		var server string
+		if server, err = dhcp.GetDNSServer(); err == nil {
+			addr := net.JoinHostPort(server, "53")
+			if resp, _, err = new(dns.Client).Exchange(req, addr); err == nil && resp.Truncated {
+				resp, err = retryTCP(req, resp, addr)
+			}
+		}
+	}
+	if err != nil { // no answer is not the proof of nonexistence
+		_ = w.WriteMsg(r.dnsFail(req, dns.RcodeServerFailure))
+		return
+	}
+
+	// keep the rcode of the upstream answer, SetReply resets it
+	rcode := resp.Rcode
+	resp.SetReply(req)
+	resp.Rcode = rcode
+	_ = w.WriteMsg(resp)
+}
+
+// exchangeMDNS send the one-shot multicast DNS query, and wait the first
+// answer in a second
+func exchangeMDNS(req *dns.Msg) (*dns.Msg, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen mDNS")
+	}
+	defer conn.Close()
+
+	m := req.Copy()
+	m.RecursionDesired = false
+	pack, err := m.Pack()
+	if err != nil {
+		return nil, errors.Wrap(err, "pack mDNS query")
+	}
+	if _, err := conn.WriteToUDP(pack, mdnsAddr); err != nil {
+		return nil, errors.Wrap(err, "send mDNS query")
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, errors.Wrap(err, "read mDNS answer")
+		}
+
+		resp := new(dns.Msg)
+		if resp.Unpack(buf[:n]) == nil && resp.Response && len(resp.Answer) != 0 {
+			return resp, nil
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// decision is the cached result of decide
+type decision struct {
+	kind, rule string
+	matched    string // the matched rule counted as a hit, empty if no rule matched
+}
+
+// decisionCache is a bounded LRU of the decisions with TTL, so that the hot
+// hosts don't walk the rules on every connection
+type decisionCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type decisionEntry struct {
+	key    string
+	val    decision
+	expire time.Time
+}
+
+// SetDecisionCache cache at most size decisions for ttl, 0 to disable
+func (r *Router) SetDecisionCache(size int, ttl time.Duration) {
+	c := &r.decisions
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size, c.ttl = size, ttl
+	c.ll, c.items = list.New(), map[string]*list.Element{}
+}
+
+func (c *decisionCache) get(key string) (decision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 || c.ttl <= 0 {
+		return decision{}, false
+	}
+
+	e, ok := c.items[key]
+	if !ok {
+		return decision{}, false
+	}
+	entry := e.Value.(*decisionEntry)
+	if time.Now().After(entry.expire) {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		return decision{}, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.val, true
+}
+
+func (c *decisionCache) add(key string, val decision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 || c.ttl <= 0 {
+		return
+	}
+
+	expire := time.Now().Add(c.ttl)
+	if e, ok := c.items[key]; ok {
+		e.Value = &decisionEntry{key, val, expire}
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&decisionEntry{key, val, expire})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*decisionEntry).key)
+	}
+}
+
+// purge drop all the decisions, on the rules changed
+func (c *decisionCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ll != nil {
+		c.ll.Init()
+		c.items = map[string]*list.Element{}
+	}
+}
@@ -0,0 +1,89 @@
+package router
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+)
+
+// poison detect the poisoned answers of the system DNS, which are resolved
+// again by the clean upstream
+type poison struct {
+	bogus  *cidrSet
+	minRTT time.Duration
+	clean  *upstream
+}
+
+// SetPoisonFilter resolve the answers of the system DNS again by the DoH / DoT
+// upstream if any answer IP is in the bogus IPs or CIDRs, or the answer
+// arrived in less than minRTT. Empty upstream to disable.
+func (r *Router) SetPoisonFilter(bogus []string, minRTT time.Duration, upstream string) error {
+	if upstream == "" {
+		r.dns.poison = nil
+		return nil
+	}
+	if !isDoH(upstream) && !isDoT(upstream) {
+		return errors.Errorf("poison filter need a DoH / DoT upstream: %s", upstream)
+	}
+
+	cidrs := make([]string, 0, len(bogus))
+	for _, item := range bogus {
+		switch ip := net.ParseIP(item); {
+		case strings.Contains(item, "/"):
+			cidrs = append(cidrs, item)
+		case ip == nil:
+			return errors.Errorf("invalid bogus IP: %s", item)
+		case ip.To4() != nil:
+			cidrs = append(cidrs, item+"/32")
+		default:
+			cidrs = append(cidrs, item+"/128")
+		}
+	}
+
+	r.dns.poison = &poison{
+		bogus:  parseCIDRs(cidrs),
+		minRTT: minRTT,
+		clean:  newUpstream(upstream, directDial),
+	}
+	return nil
+}
+
+// poisoned check the answer arrived in the rtt for the poisoning signatures
+func (p *poison) poisoned(resp *dns.Msg, rtt time.Duration) bool {
+	if p.minRTT > 0 && rtt < p.minRTT {
+		return true
+	}
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if p.bogus.Contains(rr.A) {
+				return true
+			}
+		case *dns.AAAA:
+			if p.bogus.Contains(rr.AAAA) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exchangeClean resolve by the system DNS, and by the clean upstream again if
+// the answer looks poisoned
+func (r *Router) exchangeClean(req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := r.exchange(req)
+	if err != nil || r.dns.poison == nil || !r.dns.poison.poisoned(resp, time.Since(start)) {
+		return resp, err
+	}
+
+	log.Warn().
+		Str("question", req.Question[0].String()).
+		Dur("rtt", time.Since(start)).
+		Msg("poisoned answer, resolve by the clean upstream")
+	return r.dns.poison.clean.exchange(req)
+}
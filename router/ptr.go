@@ -0,0 +1,89 @@
+package router
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// serveName is the PTR answer of the serve IPs
+const serveName = "sower."
+
+// dnsPTR answer the reverse lookup of the serve IPs by sower, and of the fake
+// IPs by the mapped domains, nil for the other queries
+func (r *Router) dnsPTR(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qtype != dns.TypePTR {
+		return nil
+	}
+	ip, ok := ptrAddr(q.Name)
+	if !ok {
+		return nil
+	}
+
+	var name string
+	switch {
+	case isServeIP(ip, r.dns.serveIP), isServeIP(ip, r.dns.serveIP6):
+		name = serveName
+	case r.fakeIP != nil && r.fakeIP.prefix.Contains(ip):
+		domain, ok := r.fakeIP.domain(ip.String())
+		if !ok {
+			return r.dnsFail(req, dns.RcodeNameError)
+		}
+		name = dns.Fqdn(domain)
+	default:
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 20},
+		Ptr: name,
+	}}
+	return m
+}
+
+func isServeIP(ip netip.Addr, serveIP net.IP) bool {
+	serve, ok := netip.AddrFromSlice(serveIP)
+	return ok && !serve.IsUnspecified() && serve.Unmap() == ip
+}
+
+// ptrAddr parse the address of the reverse lookup name, eg:
+// 4.3.2.1.in-addr.arpa, b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa
+func ptrAddr(name string) (netip.Addr, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		ip, err := netip.ParseAddr(strings.Join(labels, "."))
+		return ip, err == nil
+
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+		var sb strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			sb.WriteString(nibbles[i])
+			if i%4 == 0 && i != 0 {
+				sb.WriteByte(':')
+			}
+		}
+		ip, err := netip.ParseAddr(sb.String())
+		return ip, err == nil
+
+	default:
+		return netip.Addr{}, false
+	}
+}
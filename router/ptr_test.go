@@ -0,0 +1,30 @@
+package router
+
+import "testing"
+
+func TestPtrAddr(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"4.3.2.1.in-addr.arpa.", "1.2.3.4"},
+		{"4.3.2.1.IN-ADDR.ARPA", "1.2.3.4"},
+		{"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.", "4321:0:1:2:3:4:567:89ab"},
+		{"3.2.1.in-addr.arpa.", ""},
+		{"256.3.2.1.in-addr.arpa.", ""},
+		{"1.0.0.0.ip6.arpa.", ""},
+		{"z.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.", ""},
+		{"example.com.", ""},
+	} {
+		ip, ok := ptrAddr(tc.name)
+		if tc.want == "" {
+			if ok {
+				t.Errorf("%s: should fail, got %s", tc.name, ip)
+			}
+			continue
+		}
+		if !ok || ip.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, ip, tc.want)
+		}
+	}
+}
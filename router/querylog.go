@@ -0,0 +1,98 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSQuery is a served DNS query
+type DNSQuery struct {
+	Time    time.Time
+	Client  string
+	Name    string
+	Type    string
+	Verdict string
+	Rcode   string
+	Answer  []string
+	Latency time.Duration
+}
+
+// queryLog keep the latest DNS queries in a ring buffer
+type queryLog struct {
+	mu      sync.Mutex
+	entries []DNSQuery
+	next    int
+	full    bool
+}
+
+// SetQueryLog keep the latest size DNS queries with the verdicts, 0 to disable
+func (r *Router) SetQueryLog(size int) {
+	if size <= 0 {
+		r.queryLog = nil
+		return
+	}
+	r.queryLog = &queryLog{entries: make([]DNSQuery, size)}
+}
+
+// DNSQueries return the kept DNS queries, the oldest first
+func (r *Router) DNSQueries() []DNSQuery {
+	l := r.queryLog
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]DNSQuery(nil), l.entries[:l.next]...)
+	}
+	return append(append([]DNSQuery(nil), l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+func (l *queryLog) add(req *dns.Msg, w *logWriter, verdict string, latency time.Duration) {
+	q := DNSQuery{
+		Time:    time.Now(),
+		Name:    req.Question[0].Name,
+		Type:    dns.TypeToString[req.Question[0].Qtype],
+		Verdict: verdict,
+		Latency: latency,
+	}
+	if ip := addrIP(w.RemoteAddr()); ip != nil {
+		q.Client = ip.String()
+	}
+	if w.msg != nil {
+		q.Rcode = dns.RcodeToString[w.msg.Rcode]
+		for _, rr := range w.msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				q.Answer = append(q.Answer, rr.A.String())
+			case *dns.AAAA:
+				q.Answer = append(q.Answer, rr.AAAA.String())
+			case *dns.CNAME:
+				q.Answer = append(q.Answer, rr.Target)
+			default:
+				q.Answer = append(q.Answer, dns.TypeToString[rr.Header().Rrtype])
+			}
+		}
+	}
+
+	l.mu.Lock()
+	l.entries[l.next] = q
+	if l.next = (l.next + 1) % len(l.entries); l.next == 0 {
+		l.full = true
+	}
+	l.mu.Unlock()
+}
+
+// logWriter keep the answer written for the query log
+type logWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *logWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
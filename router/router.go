@@ -1,40 +1,93 @@
 package router
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 	geoip2 "github.com/oschwald/geoip2-golang"
 	"github.com/pkg/errors"
-	"github.com/sower-proxy/conns/relay"
 	"github.com/sower-proxy/deferlog"
 	"github.com/sower-proxy/deferlog/log"
 	"github.com/sower-proxy/mem"
 	"github.com/wweir/sower/pkg/dhcp"
-	"github.com/wweir/sower/pkg/suffixtree"
+	"github.com/wweir/sower/pkg/dialer"
+	"github.com/wweir/sower/pkg/procinfo"
+	"github.com/wweir/sower/pkg/relay"
 )
 
 type ProxyDialFn func(network, host string, port uint16) (net.Conn, error)
+
+// remoteRule route the matched domains to the named remote
+type remoteRule struct {
+	tag  string
+	rule *ruleSet
+}
+
 type Router struct {
-	blockRule   *suffixtree.Node
-	directRule  *suffixtree.Node
-	proxyRule   *suffixtree.Node
+	priority    []string
+	final       string
+	dryRun      bool
+	blockAction string
+	clients     []clientPolicy
+	hook        *hook
+	fakeIP      *fakeIP
+	queryLog    *queryLog
+	blockRule   atomic.Pointer[ruleSet]
+	directRule  atomic.Pointer[ruleSet]
+	proxyRule   atomic.Pointer[ruleSet]
 	ProxyDial   ProxyDialFn
 	accessCache *mem.Cache
 
+	remotes     map[string]ProxyDialFn
+	remoteRules atomic.Pointer[[]remoteRule]
+
 	dns struct {
 		dns.Client
 		fallbackDNS string
+		fallback    *upstream // DoH / DoT fallback, replace the system DNS
+		proxyDNS    *upstream // resolver of the proxied domains
 		serveIP     net.IP
+		serveIP6    net.IP
+		aaaa        map[string]string // category -> AAAA policy
 		connCh      chan *dns.Conn
-		cache       *mem.Cache
+		resetCh     chan struct{}
+		cache       dnsCache
+		ttlRules    atomic.Pointer[[]ttlRule]
+		sinkhole    net.IP // nil for NXDOMAIN
+		hosts       map[string][]net.IP
+		ecs         string
+		ecsSubnet   *dns.EDNS0_SUBNET
+		dnssec      bool
+		poison      *poison
+		forwards    []forward
 	}
 
 	country struct {
-		*geoip2.Reader
-		cidrs []*net.IPNet
+		db       atomic.Pointer[geoip2.Reader]
+		codes    map[string]bool
+		cidrs    atomic.Pointer[cidrSet]
+		excludes atomic.Pointer[cidrSet]
+	}
+
+	verdicts  verdicts
+	hits      sync.Map // '<kind> <rule>' -> *hitCount
+	decisions decisionCache
+
+	fallback struct {
+		enable    bool
+		ttl       time.Duration
+		threshold int
+		learned   sync.Map // domain -> expire time.Time
+		failures  sync.Map // domain -> failure
+		dirty     atomic.Bool
 	}
 }
 
@@ -42,42 +95,357 @@ func NewRouter(serveIP, fallbackDNS, mmdbFile string, proxyDial ProxyDialFn) *Ro
 	r := Router{
 		ProxyDial:   proxyDial,
 		accessCache: mem.New(time.Hour), // TODO: config
+		priority:    []string{RuleBlock, RuleDirect, RuleProxy},
+		final:       FinalDetect,
+		blockAction: BlockClose,
 	}
 
 	r.dns.serveIP = net.ParseIP(serveIP)
+	if r.dns.serveIP.To4() == nil {
+		r.dns.serveIP6 = r.dns.serveIP
+	}
+	r.dns.aaaa = map[string]string{RuleProxy: AAAAServe, RuleDirect: AAAAPass}
 	r.dns.fallbackDNS = fallbackDNS
 	r.dns.connCh = make(chan *dns.Conn, 1)
-	r.dns.cache = mem.New(5 * time.Minute) // Tll: 10 minutes
-	go r.dialDNSConn()
+	r.dns.resetCh = make(chan struct{}, 1)
+	r.SetDNSCache(10000, 0, time.Hour, 5*time.Minute)
+	if isDoH(fallbackDNS) || isDoT(fallbackDNS) {
+		r.SetFallbackProxy(false)
+	} else {
+		go r.dialDNSConn()
+	}
 
-	var err error
-	r.country.Reader, err = geoip2.Open(mmdbFile)
-	log.InfoWarn(err).Str("file", mmdbFile).Msg("open geoip2 db")
+	// rules are replaced while serving, start with the empty ones
+	r.SetBlockRules(nil)
+	r.SetDirectRules(nil)
+	r.SetProxyRules(nil)
+	r.SetCountryCIDRs(nil)
+	r.SetCountryExcludes(nil)
+	r.SetCountryCodes([]string{"CN"})
+	r.SetTTLRules(nil)
+
+	if mmdbFile != "" {
+		db, err := geoip2.Open(mmdbFile)
+		log.InfoWarn(err).Str("file", mmdbFile).Msg("open geoip2 db")
+		if err == nil {
+			r.country.db.Store(db)
+		}
+	}
 
 	return &r
 }
 
 func (r *Router) SetBlockRules(blockList []string) {
-	r.blockRule = suffixtree.NewNodeFromRules(blockList...)
+	r.blockRule.Store(newRuleSet(blockList...))
+	r.decisions.purge()
 }
 func (r *Router) SetDirectRules(directList []string) {
-	r.directRule = suffixtree.NewNodeFromRules(directList...)
+	r.directRule.Store(newRuleSet(directList...))
+	r.decisions.purge()
+}
+
+// the kinds of rules
+const (
+	RuleBlock  = "block"
+	RuleDirect = "direct"
+	RuleProxy  = "proxy"
+)
+
+// SetPriority set the evaluation order of rules, the first matched wins
+func (r *Router) SetPriority(kinds []string) error {
+	seen := map[string]bool{}
+	for _, kind := range kinds {
+		switch kind {
+		case RuleBlock, RuleDirect, RuleProxy:
+		default:
+			return errors.Errorf("unknown rule kind: %s", kind)
+		}
+		if seen[kind] {
+			return errors.Errorf("duplicated rule kind: %s", kind)
+		}
+		seen[kind] = true
+	}
+	if len(seen) != 3 {
+		return errors.Errorf("rule priority should contain all of block/direct/proxy: %v", kinds)
+	}
+
+	r.priority = kinds
+	return nil
 }
+
+// FinalDetect route the hosts not matched by any rule by the country and the
+// access detection, the other final policies are RuleDirect and RuleProxy
+const FinalDetect = "detect"
+
+// SetFinal set the policy of the hosts not matched by any rule
+func (r *Router) SetFinal(final string) error {
+	switch final {
+	case FinalDetect, RuleDirect, RuleProxy:
+	default:
+		return errors.Errorf("unknown final policy: %s", final)
+	}
+
+	r.final = final
+	return nil
+}
+
+// SetDryRun log the decisions but forward everything direct, to audit the rules
+// against the real traffic before enforcing them
+func (r *Router) SetDryRun(dryRun bool) {
+	r.dryRun = dryRun
+}
+
+func (r *Router) ruleOf(kind string) *ruleSet {
+	switch kind {
+	case RuleBlock:
+		return r.blockRule.Load()
+	case RuleDirect:
+		return r.directRule.Load()
+	default:
+		return r.proxyRule.Load()
+	}
+}
+
+// matchDomain return the kind of the first matched rule by the domain, under
+// the policy of the client
+func (r *Router) matchDomain(domain, policy string) string {
+	switch policy {
+	case RuleBlock, RuleDirect, RuleProxy:
+		return policy
+	}
+	for _, kind := range r.priority {
+		if kind == RuleBlock && policy == ClientNoBlock {
+			continue
+		}
+		if rule, ok := r.ruleOf(kind).matchRule(domain); ok {
+			r.hit(kind, rule, true)
+			return kind
+		}
+	}
+	return ""
+}
+
+// SetRemotes set the named remotes, which are referenced by the proxy rules
+func (r *Router) SetRemotes(remotes map[string]ProxyDialFn) {
+	r.remotes = remotes
+}
+
+// SetProxyRules set the proxy rules, a rule is routed to the named remote if
+// it is prefixed with the tag, eg: '>>us **.netflix.com'
 func (r *Router) SetProxyRules(proxyList []string) {
-	// for i, p := range proxyList {
-	// 	fmt.Println("proxyList:", i, p)
-	// }
-	r.proxyRule = suffixtree.NewNodeFromRules(proxyList...)
+	rules := make([]string, 0, len(proxyList))
+	tagged := map[string][]string{}
+	var tags []string
+	for _, rule := range proxyList {
+		if strings.HasPrefix(rule, ">>") {
+			tag, domain, _ := strings.Cut(strings.TrimPrefix(rule, ">>"), " ")
+			if _, ok := r.remotes[tag]; !ok {
+				log.Error().Str("rule", rule).Msg("unknown remote of proxy rule")
+				continue
+			}
+			if _, ok := tagged[tag]; !ok {
+				tags = append(tags, tag)
+			}
+			rule = strings.TrimSpace(domain)
+			tagged[tag] = append(tagged[tag], rule)
+		}
+		rules = append(rules, rule)
+	}
+
+	remoteRules := make([]remoteRule, 0, len(tags))
+	for _, tag := range tags {
+		remoteRules = append(remoteRules, remoteRule{tag, newRuleSet(tagged[tag]...)})
+	}
+	r.remoteRules.Store(&remoteRules)
+	r.proxyRule.Store(newRuleSet(rules...))
+	r.decisions.purge()
+}
+
+// ProxyDialFor return the dial of the remote which the domain is routed to
+func (r *Router) ProxyDialFor(domain string) ProxyDialFn {
+	if tag := r.remoteOf(domain); tag != "" {
+		return r.remotes[tag]
+	}
+	return r.ProxyDial
 }
+
+// remoteOf return the tag of the remote which the domain is routed to, empty
+// for the default remote
+func (r *Router) remoteOf(domain string) string {
+	for _, rr := range *r.remoteRules.Load() {
+		if rr.rule.Match(domain) {
+			return rr.tag
+		}
+	}
+	return ""
+}
+
 func (r *Router) SetCountryCIDRs(directCIDRs []string) {
-	r.country.cidrs = make([]*net.IPNet, 0, len(directCIDRs))
-	for _, cidr := range directCIDRs {
-		_, ipnet, err := net.ParseCIDR(cidr)
+	r.country.cidrs.Store(parseCIDRs(directCIDRs))
+	r.decisions.purge()
+}
+
+// SetCountryExcludes set the CIDRs excluded from the countries, which
+// override both the country CIDRs and the mmdb
+func (r *Router) SetCountryExcludes(cidrs []string) {
+	r.country.excludes.Store(parseCIDRs(cidrs))
+	r.decisions.purge()
+}
+
+// SetCountryCodes set the ISO codes of the countries routed direct by the mmdb
+func (r *Router) SetCountryCodes(codes []string) {
+	r.country.codes = make(map[string]bool, len(codes))
+	for _, code := range codes {
+		r.country.codes[strings.ToUpper(strings.TrimSpace(code))] = true
+	}
+}
+
+// SetCountryDB replace the geoip2 db by the mmdb content
+func (r *Router) SetCountryDB(mmdb []byte) error {
+	db, err := geoip2.FromBytes(mmdb)
+	if err != nil {
+		return errors.Wrap(err, "parse geoip2 db")
+	}
+	r.country.db.Store(db)
+	r.decisions.purge()
+	return nil
+}
+
+// FlushDNSCache drop all cached DNS records
+func (r *Router) FlushDNSCache() {
+	r.dns.cache.flush()
+}
+
+// FlushAccessCache drop the results of site access detection
+func (r *Router) FlushAccessCache() {
+	r.accessCache.Rotate(true)
+}
+
+// ResetLearnedRules drop the rules learned from direct dial failures
+func (r *Router) ResetLearnedRules() {
+	r.fallback.learned.Range(func(key, _ interface{}) bool {
+		r.fallback.learned.Delete(key)
+		return true
+	})
+	r.fallback.failures.Range(func(key, _ interface{}) bool {
+		r.fallback.failures.Delete(key)
+		return true
+	})
+	r.fallback.dirty.Store(true)
+	r.decisions.purge()
+}
+
+// ResetNetwork drop the states bound to the current network, eg: DNS server
+// from DHCP, DNS records and site access detection
+func (r *Router) ResetNetwork() {
+	select {
+	case r.dns.resetCh <- struct{}{}:
+	default:
+	}
+
+	r.FlushDNSCache()
+	r.FlushAccessCache()
+	r.FlushVerdicts()
+}
+
+// SetDirectFallback makes a failed direct dial retry through the proxy.
+// If ttl is positive, the failed domain is routed to proxy for ttl.
+func (r *Router) SetDirectFallback(enable bool, ttl time.Duration) {
+	r.fallback.enable = enable
+	r.fallback.ttl = ttl
+}
+
+// SetFallbackThreshold learn the domain only if its direct dials failed
+// threshold times within the fallback ttl
+func (r *Router) SetFallbackThreshold(threshold int) {
+	r.fallback.threshold = threshold
+}
+
+type failure struct {
+	count int
+	since time.Time
+}
+
+func (r *Router) learnFallback(domain string) {
+	if r.fallback.ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	f := failure{count: 1, since: now}
+	if val, ok := r.fallback.failures.Load(domain); ok {
+		if prev := val.(failure); now.Sub(prev.since) < r.fallback.ttl {
+			f = failure{count: prev.count + 1, since: prev.since}
+		}
+	}
+	if f.count < r.fallback.threshold {
+		r.fallback.failures.Store(domain, f)
+		return
+	}
+
+	r.fallback.failures.Delete(domain)
+	r.fallback.learned.Store(domain, now.Add(r.fallback.ttl))
+	r.fallback.dirty.Store(true)
+	r.decisions.purge()
+	log.Info().
+		Str("domain", domain).
+		Int("failures", f.count).
+		Time("expire", now.Add(r.fallback.ttl)).
+		Msg("learned proxy rule from direct dial failures")
+}
+
+// LearnedChanged report whether the learned rules changed since the last save
+func (r *Router) LearnedChanged() bool {
+	return r.fallback.dirty.Load()
+}
+
+// SaveLearned write the unexpired learned rules, a line per domain:
+// '<domain> <expire unix>'
+func (r *Router) SaveLearned(w io.Writer) error {
+	r.fallback.dirty.Store(false)
+
+	bw := bufio.NewWriter(w)
+	now := time.Now()
+	r.fallback.learned.Range(func(key, val interface{}) bool {
+		if expire := val.(time.Time); expire.After(now) {
+			fmt.Fprintf(bw, "%s %d\n", key, expire.Unix())
+		}
+		return true
+	})
+	return errors.Wrap(bw.Flush(), "write learned rules")
+}
+
+// LoadLearned read the learned rules written by SaveLearned, the expired are dropped
+func (r *Router) LoadLearned(rd io.Reader) error {
+	now := time.Now()
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to parse CIDR")
+			continue
+		}
+
+		if expire := time.Unix(sec, 0); expire.After(now) {
+			r.fallback.learned.Store(fields[0], expire)
 		}
-		r.country.cidrs = append(r.country.cidrs, ipnet)
 	}
+	return errors.Wrap(scanner.Err(), "read learned rules")
+}
+func (r *Router) isFallback(domain string) bool {
+	val, ok := r.fallback.learned.Load(domain)
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(val.(time.Time)) {
+		r.fallback.learned.Delete(domain)
+		return false
+	}
+	return true
 }
 
 func (r *Router) dialDNSConn() {
@@ -91,53 +459,182 @@ func (r *Router) dialDNSConn() {
 			server = r.dns.fallbackDNS
 		}
 
+	DIAL:
 		for {
-			conn, err := dns.DialTimeout("udp", net.JoinHostPort(server, "53"), time.Second)
+			c, err := dialer.DialTimeout("udp", net.JoinHostPort(server, "53"), time.Second)
 			if err != nil {
 				log.Error().Err(err).Str("ip", server).Msg("dial dns server")
 				break
 			}
 
-			r.dns.connCh <- conn
+			conn := &dns.Conn{Conn: c}
+			select {
+			case r.dns.connCh <- conn:
+			case <-r.dns.resetCh:
+				conn.Close()
+				break DIAL
+			}
+		}
+
+		// drop the pooled connection to the former DNS server
+		select {
+		case conn := <-r.dns.connCh:
+			conn.Close()
+		default:
 		}
 	}
 }
 
 func (r *Router) RouteHandle(conn net.Conn, domain string, port uint16) (err error) {
 	start := time.Now()
+	if r.fakeIP != nil {
+		if host, ok := r.fakeIP.domain(domain); ok {
+			domain = host
+		}
+	}
+	proc := r.lookupProcess(conn)
+	policy := r.policyOf(conn.RemoteAddr())
 	defer func() {
 		deferlog.DebugWarn(err).
 			Str("domain", domain).
 			Uint16("port", port).
+			Str("process", proc).
+			Str("policy", policy).
 			Dur("spend", time.Since(start)).
 			Msg("serve socks5")
 	}()
 
-	addr := net.JoinHostPort(domain, strconv.FormatUint(uint64(port), 10))
+	kind, rule := r.route(domain, port, proc, policy)
+	if r.hook != nil {
+		var sni string
+		if port == 443 {
+			sni, conn = sniffSNI(conn)
+		}
+		if verdict := r.hook.query(domain, port, addrIP(conn.RemoteAddr()), sni); verdict != "" {
+			kind, rule = verdict, "hook"
+		}
+	}
+	if r.dryRun {
+		log.Info().
+			Str("domain", domain).
+			Uint16("port", port).
+			Str("process", proc).
+			Str("route", kind).
+			Str("rule", rule).
+			Msg("dry run, forward direct")
+		return r.directHandle(conn, domain, port, false)
+	}
 
-	// 1. rule_based( block > direct > proxy )
-	// 2. detect_based( CN IP || access site )
-	// 3. fallback( proxy )
-	switch {
-	case r.blockRule.Match(domain):
-		return nil
+	switch kind {
+	case RuleBlock:
+		return r.BlockHandle(conn, port)
+	case RuleDirect:
+		return r.DirectHandle(conn, domain, port)
+	default:
+		return r.ProxyHandle(conn, domain, port)
+	}
+}
 
-	case r.directRule.Match(domain):
-		return r.DirectHandle(conn, addr)
+// decide return the route of the destination and the matched rule or reason
+//
+// 1. rule_based, in the order of priority, default: block > learned fallback > direct > proxy
+// 2. final policy, default: detect_based( CN IP || access site )
+// 3. fallback( proxy )
+//
+// Without probe, the access detection is skipped and FinalDetect is returned
+// for the hosts out of the country.
+func (r *Router) decide(domain string, port uint16, proc, policy string, probe bool) decision {
+	switch policy {
+	case RuleBlock, RuleDirect, RuleProxy:
+		return decision{kind: policy, rule: "client policy"}
+	}
+	if isLocalName(domain) {
+		return decision{kind: RuleDirect, rule: "local name"}
+	}
+	if r.forwardOf(domain) != nil {
+		return decision{kind: RuleDirect, rule: "forwarded name"}
+	}
 
-	case r.proxyRule.Match(domain):
-		return r.ProxyHandle(conn, domain, port)
+	for _, k := range r.priority {
+		if k == RuleBlock && policy == ClientNoBlock {
+			continue
+		}
+		// the learned fallback overrides the direct rules
+		if k == RuleDirect && r.isFallback(domain) {
+			return decision{kind: RuleProxy, rule: "learned from direct dial failures"}
+		}
+
+		rules := r.ruleOf(k)
+		matched, ok := rules.matchPortRule(domain, port)
+		if !ok && rules.MatchProcess(proc) {
+			matched, ok = "proc:"+strings.ToLower(proc), true
+		}
+		if ok {
+			return decision{kind: k, rule: k + " rule " + matched, matched: matched}
+		}
+	}
 
-	case r.localSite(domain), r.isAccess(domain, port):
-		return r.DirectHandle(conn, addr)
+	switch {
+	case r.final != FinalDetect:
+		return decision{kind: r.final, rule: "final policy"}
+	case probe && r.detect(domain, port):
+		return decision{kind: RuleDirect, rule: "detected"}
+	case probe:
+		return decision{kind: RuleProxy, rule: "detected"}
+	case r.localSite(domain):
+		return decision{kind: RuleDirect, rule: "country"}
 	default:
-		return r.ProxyHandle(conn, domain, port)
+		return decision{kind: FinalDetect, rule: "access detection, proxy if inaccessible"}
+	}
+}
+
+// route decide the route of the connection by the cached decisions, and count
+// the rule hits
+func (r *Router) route(domain string, port uint16, proc, policy string) (kind, rule string) {
+	key := policy + " " + proc + " " + net.JoinHostPort(domain, strconv.FormatUint(uint64(port), 10))
+	d, ok := r.decisions.get(key)
+	if !ok {
+		d = r.decide(domain, port, proc, policy, true)
+		r.decisions.add(key, d)
+	}
+
+	if d.matched != "" {
+		r.hit(d.kind, d.matched, false)
+	}
+	return d.kind, d.rule
+}
+
+// Explain describe how the destination would be routed without dialing it:
+// the kind of route, the matched rule or the reason, and the remote tag if
+// proxied. The process rules and the access detection are skipped.
+func (r *Router) Explain(domain string, port uint16) (kind, rule, remote string) {
+	d := r.decide(domain, port, "", ClientRules, false)
+	kind, rule = d.kind, d.rule
+	if kind == RuleProxy || kind == FinalDetect {
+		remote = r.remoteOf(domain)
 	}
+	return kind, rule, remote
+}
+
+// lookupProcess find the local process of the inbound connection, only if
+// there are process rules
+func (r *Router) lookupProcess(conn net.Conn) string {
+	if !r.blockRule.Load().hasProcs() && !r.directRule.Load().hasProcs() && !r.proxyRule.Load().hasProcs() {
+		return ""
+	}
+
+	name, err := procinfo.Lookup(conn)
+	if err != nil {
+		log.Debug().Err(err).
+			Str("from", conn.RemoteAddr().String()).
+			Msg("lookup process")
+	}
+	return name
 }
 
 func (r *Router) ProxyHandle(conn net.Conn, domain string, port uint16) error {
 	start := time.Now()
-	rc, err := r.ProxyDial("tcp", domain, port)
+	rc, err := r.ProxyDialFor(domain)("tcp", domain, port)
 	if err != nil {
 		return errors.Wrapf(err, "proxy dial (%s:%d), spend (%s)", domain, port, time.Since(start))
 	}
@@ -147,7 +644,28 @@ func (r *Router) ProxyHandle(conn net.Conn, domain string, port uint16) error {
 	return nil
 }
 
-func (r *Router) DirectHandle(conn net.Conn, addr string) error {
-	dur, err := relay.RelayTo(conn, addr)
-	return errors.Wrapf(err, "spend (%s)", dur)
+func (r *Router) DirectHandle(conn net.Conn, domain string, port uint16) error {
+	return r.directHandle(conn, domain, port, r.fallback.enable)
+}
+
+func (r *Router) directHandle(conn net.Conn, domain string, port uint16, fallback bool) error {
+	start := time.Now()
+	addr := net.JoinHostPort(domain, strconv.FormatUint(uint64(port), 10))
+	rc, err := dialer.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		if !fallback {
+			return errors.Wrapf(err, "direct dial (%s), spend (%s)", addr, time.Since(start))
+		}
+
+		log.Warn().Err(err).
+			Str("addr", addr).
+			Dur("spend", time.Since(start)).
+			Msg("direct dial failed, fallback to proxy")
+		r.learnFallback(domain)
+		return r.ProxyHandle(conn, domain, port)
+	}
+	defer rc.Close()
+
+	relay.Relay(conn, rc)
+	return nil
 }
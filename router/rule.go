@@ -0,0 +1,301 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/pkg/suffixtree"
+)
+
+// ruleSet match the domain by the wildcard rules in suffix tree, the regexp
+// rules prefixed with 're:', eg: 're:^img\d+\.cdn\.com$', or the keyword
+// rules prefixed with 'kw:', eg: 'kw:google'. The literal IP destinations
+// are matched by the CIDR rules, eg: '10.0.0.0/8'. The port rules match the
+// destination port, optionally combined with a host rule, eg: 'port:25',
+// 'port:6881-6889', '**.example.com port:8080'. The process rules match the
+// local process dialed the inbound connection, eg: 'proc:chrome.exe'.
+// The time rules match a host or port rule in the schedule of the local clock,
+// eg: '**.facebook.com time:mon-fri@09:00-18:00', 'kw:game time:22:00-06:00',
+// 'port:22 time:09:00-18:00'.
+// The rules prefixed with '!' are the exceptions, which are evaluated before
+// the others, eg: '**.ads.com' and '!good.ads.com'.
+type ruleSet struct {
+	except   *ruleSet
+	tree     *suffixtree.Node
+	regexps  []*regexp.Regexp
+	keywords []string
+	cidrs    []*net.IPNet
+	ports    []portRule
+	times    []timeRule
+	procs    map[string]bool
+}
+
+type portRule struct {
+	host   *ruleSet // nil for any host
+	lo, hi uint16
+}
+
+func parsePortRule(rule string) (portRule, error) {
+	host, spec, _ := strings.Cut(rule, "port:")
+	loStr, hiStr, isRange := strings.Cut(strings.TrimSpace(spec), "-")
+	if !isRange {
+		hiStr = loStr
+	}
+	lo, err := strconv.ParseUint(loStr, 10, 16)
+	if err != nil {
+		return portRule{}, errors.Wrapf(err, "port rule (%s)", rule)
+	}
+	hi, err := strconv.ParseUint(hiStr, 10, 16)
+	if err != nil || hi < lo {
+		return portRule{}, errors.Errorf("invalid port rule: %s", rule)
+	}
+
+	pr := portRule{lo: uint16(lo), hi: uint16(hi)}
+	if host = strings.TrimSpace(host); host != "" {
+		pr.host = newRuleSet(host)
+	}
+	return pr, nil
+}
+
+type timeRule struct {
+	host     *ruleSet
+	days     [7]bool // indexed by time.Weekday
+	from, to int     // minutes of the day, to is exclusive
+	rule     string
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseTimeRule parse '<host rule> time:[<days>@]<hh:mm>-<hh:mm>', the days
+// are comma separated weekdays or ranges, eg: 'mon-fri', 'sat,sun'
+func parseTimeRule(rule string) (timeRule, error) {
+	host, spec, _ := strings.Cut(rule, "time:")
+	tr := timeRule{rule: rule}
+	days, clock, ok := strings.Cut(strings.TrimSpace(spec), "@")
+	if !ok {
+		days, clock = "", days
+		tr.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, day := range strings.Split(days, ",") {
+		if day == "" {
+			continue
+		}
+		loStr, hiStr, isRange := strings.Cut(strings.ToLower(day), "-")
+		if !isRange {
+			hiStr = loStr
+		}
+		lo, ok1 := weekdays[loStr]
+		hi, ok2 := weekdays[hiStr]
+		if !ok1 || !ok2 {
+			return timeRule{}, errors.Errorf("invalid weekdays of time rule: %s", rule)
+		}
+		for d := lo; ; d = (d + 1) % 7 {
+			tr.days[d] = true
+			if d == hi {
+				break
+			}
+		}
+	}
+
+	fromStr, toStr, ok := strings.Cut(clock, "-")
+	if !ok {
+		return timeRule{}, errors.Errorf("invalid clock range of time rule: %s", rule)
+	}
+	from, err := time.Parse("15:04", fromStr)
+	if err != nil {
+		return timeRule{}, errors.Wrapf(err, "time rule (%s)", rule)
+	}
+	to, err := time.Parse("15:04", toStr)
+	if err != nil {
+		return timeRule{}, errors.Wrapf(err, "time rule (%s)", rule)
+	}
+	tr.from, tr.to = from.Hour()*60+from.Minute(), to.Hour()*60+to.Minute()
+
+	if host = strings.TrimSpace(host); host != "" {
+		tr.host = newRuleSet(host)
+	}
+	return tr, nil
+}
+
+// inSchedule check the local clock, the range across midnight belongs to the
+// weekday it starts
+func (tr *timeRule) inSchedule(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	switch {
+	case tr.from <= tr.to:
+		return tr.days[day] && tr.from <= minute && minute < tr.to
+	case minute >= tr.from:
+		return tr.days[day]
+	case minute < tr.to:
+		return tr.days[(day+6)%7]
+	}
+	return false
+}
+
+func newRuleSet(rules ...string) *ruleSet {
+	s := &ruleSet{procs: map[string]bool{}}
+	wildcards := make([]string, 0, len(rules))
+	var exceptions []string
+	for _, rule := range rules {
+		if except, ok := strings.CutPrefix(rule, "!"); ok {
+			exceptions = append(exceptions, strings.TrimSpace(except))
+			continue
+		}
+		if proc, ok := strings.CutPrefix(rule, "proc:"); ok {
+			s.procs[strings.ToLower(strings.TrimSpace(proc))] = true
+			continue
+		}
+		if strings.HasPrefix(rule, "time:") || strings.Contains(rule, " time:") {
+			tr, err := parseTimeRule(rule)
+			if err != nil {
+				log.Error().Err(err).Msg("parse time rule")
+				continue
+			}
+			s.times = append(s.times, tr)
+			continue
+		}
+		if strings.HasPrefix(rule, "port:") || strings.Contains(rule, " port:") {
+			pr, err := parsePortRule(rule)
+			if err != nil {
+				log.Error().Err(err).Msg("parse port rule")
+				continue
+			}
+			s.ports = append(s.ports, pr)
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(rule); err == nil {
+			s.cidrs = append(s.cidrs, cidr)
+			continue
+		}
+		if keyword, ok := strings.CutPrefix(rule, "kw:"); ok {
+			s.keywords = append(s.keywords, strings.ToLower(keyword))
+			continue
+		}
+		if expr, ok := strings.CutPrefix(rule, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				log.Error().Err(err).Str("rule", rule).Msg("compile regexp rule")
+				continue
+			}
+			s.regexps = append(s.regexps, re)
+			continue
+		}
+		wildcards = append(wildcards, rule)
+	}
+
+	s.tree = suffixtree.NewNodeFromRules(wildcards...)
+	if len(exceptions) != 0 {
+		s.except = newRuleSet(exceptions...)
+	}
+	return s
+}
+
+// MatchPort match the destination by both the host and port rules
+func (s *ruleSet) MatchPort(domain string, port uint16) bool {
+	_, ok := s.matchPortRule(domain, port)
+	return ok
+}
+
+// matchPortRule return the matched rule by both the host and port rules
+func (s *ruleSet) matchPortRule(domain string, port uint16) (string, bool) {
+	if s == nil || s.except.MatchPort(domain, port) {
+		return "", false
+	}
+	for _, pr := range s.ports {
+		if pr.lo <= port && port <= pr.hi && (pr.host == nil || pr.host.Match(domain)) {
+			rule := fmt.Sprintf("port:%d", pr.lo)
+			if pr.hi != pr.lo {
+				rule = fmt.Sprintf("port:%d-%d", pr.lo, pr.hi)
+			}
+			if pr.host != nil {
+				host, _ := pr.host.matchRule(domain)
+				rule = host + " " + rule
+			}
+			return rule, true
+		}
+	}
+	if rule, ok := s.matchTimeRule(domain, port); ok {
+		return rule, true
+	}
+	return s.matchRule(domain)
+}
+
+// matchTimeRule return the time rule in schedule, whose host part matches the
+// destination by both the host and port rules
+func (s *ruleSet) matchTimeRule(domain string, port uint16) (string, bool) {
+	if len(s.times) == 0 {
+		return "", false
+	}
+	now := time.Now()
+	for i := range s.times {
+		tr := &s.times[i]
+		if tr.inSchedule(now) && (tr.host == nil || tr.host.MatchPort(domain, port)) {
+			return tr.rule, true
+		}
+	}
+	return "", false
+}
+
+// MatchProcess match the process name by the process rules
+func (s *ruleSet) MatchProcess(name string) bool {
+	return s != nil && name != "" && s.procs[strings.ToLower(name)] && !s.except.MatchProcess(name)
+}
+
+func (s *ruleSet) hasProcs() bool {
+	return s != nil && len(s.procs) != 0
+}
+
+// Match match the domain by the host rules, the port rules are skipped
+func (s *ruleSet) Match(domain string) bool {
+	_, ok := s.matchRule(domain)
+	return ok
+}
+
+// matchRule return the matched host rule
+func (s *ruleSet) matchRule(domain string) (string, bool) {
+	if s == nil || s.except.Match(domain) {
+		return "", false
+	}
+	if rule, ok := s.tree.MatchRule(domain); ok {
+		return rule, true
+	}
+	if ip := net.ParseIP(domain); ip != nil {
+		for _, cidr := range s.cidrs {
+			if cidr.Contains(ip) {
+				return cidr.String(), true
+			}
+		}
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, keyword := range s.keywords {
+		if strings.Contains(domain, keyword) {
+			return "kw:" + keyword, true
+		}
+	}
+	for _, re := range s.regexps {
+		if re.MatchString(domain) {
+			return "re:" + re.String(), true
+		}
+	}
+	if len(s.times) != 0 {
+		now := time.Now()
+		for i := range s.times {
+			tr := &s.times[i]
+			if tr.inSchedule(now) && (tr.host == nil || tr.host.Match(domain)) {
+				return tr.rule, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,130 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePortRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule   string
+		lo, hi uint16
+		host   bool
+		fail   bool
+	}{
+		{"port:25", 25, 25, false, false},
+		{"port:6881-6889", 6881, 6889, false, false},
+		{"**.example.com port:8080", 8080, 8080, true, false},
+		{"port:90-80", 0, 0, false, true},
+		{"port:65536", 0, 0, false, true},
+		{"port:http", 0, 0, false, true},
+	} {
+		pr, err := parsePortRule(tc.rule)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("%s: should fail", tc.rule)
+			}
+			continue
+		}
+		if err != nil || pr.lo != tc.lo || pr.hi != tc.hi || (pr.host != nil) != tc.host {
+			t.Errorf("%s: unexpected %d-%d host %v, err: %v", tc.rule, pr.lo, pr.hi, pr.host != nil, err)
+		}
+	}
+}
+
+func TestTimeRule(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day int, clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 1, day, c.Hour(), c.Minute(), 0, 0, time.Local)
+	}
+
+	for _, tc := range []struct {
+		rule string
+		now  time.Time
+		want bool
+	}{
+		{"time:09:00-18:00", at(3, "09:00"), true},
+		{"time:09:00-18:00", at(3, "18:00"), false},
+		{"time:mon-fri@09:00-18:00", at(5, "12:00"), true},
+		{"time:mon-fri@09:00-18:00", at(6, "12:00"), false},
+		{"time:sat,sun@00:00-23:59", at(7, "12:00"), true},
+		// the weekday range wraps around the week
+		{"time:fri-mon@09:00-18:00", at(7, "12:00"), true},
+		{"time:fri-mon@09:00-18:00", at(1, "12:00"), true},
+		{"time:fri-mon@09:00-18:00", at(2, "12:00"), false},
+		// the range across midnight belongs to the weekday it starts
+		{"time:mon@22:00-06:00", at(1, "23:00"), true},
+		{"time:mon@22:00-06:00", at(2, "03:00"), true},
+		{"time:mon@22:00-06:00", at(1, "03:00"), false},
+		{"time:mon@22:00-06:00", at(2, "06:00"), false},
+		{"time:mon@22:00-06:00", at(2, "23:00"), false},
+	} {
+		tr, err := parseTimeRule(tc.rule)
+		if err != nil {
+			t.Errorf("%s: %s", tc.rule, err)
+			continue
+		}
+		if got := tr.inSchedule(tc.now); got != tc.want {
+			t.Errorf("%s at %s: got %v, want %v", tc.rule, tc.now.Format("Mon 15:04"), got, tc.want)
+		}
+	}
+
+	for _, rule := range []string{"time:09:00", "time:xyz@09:00-18:00", "time:09:00-25:00"} {
+		if _, err := parseTimeRule(rule); err == nil {
+			t.Errorf("%s: should fail", rule)
+		}
+	}
+}
+
+func TestTimeRuleHost(t *testing.T) {
+	s := newRuleSet("port:22 time:09:00-18:00", "**.work.com time:09:00-18:00",
+		"**.dev.com port:8080 time:09:00-18:00")
+	for i := range s.times { // in schedule all day
+		s.times[i].from, s.times[i].to = 0, 24*60
+	}
+
+	for _, tc := range []struct {
+		domain string
+		port   uint16
+		want   bool
+	}{
+		{"example.com", 22, true},
+		{"example.com", 443, false},
+		{"a.work.com", 443, true},
+		{"a.dev.com", 8080, true},
+		{"a.dev.com", 443, false},
+		{"example.com", 8080, false},
+	} {
+		if got := s.MatchPort(tc.domain, tc.port); got != tc.want {
+			t.Errorf("%s:%d: got %v, want %v", tc.domain, tc.port, got, tc.want)
+		}
+	}
+
+	// the DNS queries have no port, only the host part is matched
+	if !s.Match("a.work.com") || s.Match("example.com") {
+		t.Error("unexpected time rule match of the domain")
+	}
+}
+
+func TestRuleSetException(t *testing.T) {
+	s := newRuleSet("**.ads.com", "!good.ads.com", "port:25", "!**.mail.com port:25", "10.0.0.0/8", "kw:track")
+	for _, tc := range []struct {
+		domain string
+		port   uint16
+		want   bool
+	}{
+		{"x.ads.com", 443, true},
+		{"good.ads.com", 443, false},
+		{"smtp.isp.com", 25, true},
+		{"smtp.mail.com", 25, false},
+		{"10.1.2.3", 443, true},
+		{"11.1.2.3", 443, false},
+		{"tracker.net", 443, true},
+		{"example.com", 443, false},
+	} {
+		if got := s.MatchPort(tc.domain, tc.port); got != tc.want {
+			t.Errorf("%s:%d: got %v, want %v", tc.domain, tc.port, got, tc.want)
+		}
+	}
+}
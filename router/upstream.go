@@ -0,0 +1,175 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/sower-proxy/deferlog/log"
+	"github.com/wweir/sower/pkg/dialer"
+	"github.com/wweir/sower/pkg/doh"
+)
+
+// isDoH check whether the DNS server is a DoH URL, eg: https://1.1.1.1/dns-query
+func isDoH(server string) bool {
+	return strings.HasPrefix(server, "https://")
+}
+
+// isDoT check whether the DNS server is a DoT address, eg: tls://1.1.1.1:853
+func isDoT(server string) bool {
+	return strings.HasPrefix(server, "tls://")
+}
+
+type dialFn func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// upstream is the DoH, DoT or DNS over TCP server dialed by the dial function
+type upstream struct {
+	server string
+	doh    *http.Client
+	tcp    *tcpUpstream
+}
+
+func newUpstream(server string, dial dialFn) *upstream {
+	u := &upstream{server: server}
+	if isDoH(server) {
+		u.doh = &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{DialContext: dial, ForceAttemptHTTP2: true},
+		}
+		return u
+	}
+
+	addr, port := server, "53"
+	if isDoT(server) {
+		addr, port = strings.TrimPrefix(server, "tls://"), "853"
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, port)
+	}
+	u.tcp = &tcpUpstream{addr: addr, dial: dial, pool: make(chan *dns.Conn, 4)}
+	if isDoT(server) {
+		host, _, _ := net.SplitHostPort(addr)
+		u.tcp.conf = &tls.Config{ServerName: host}
+	}
+	return u
+}
+
+// exchange resolve by the upstream, retry once
+func (u *upstream) exchange(req *dns.Msg) (*dns.Msg, error) {
+	exchange := u.tcp.exchange
+	if u.doh != nil {
+		exchange = func(m *dns.Msg) (*dns.Msg, error) {
+			return doh.Exchange(u.doh, u.server, m)
+		}
+	}
+
+	start := time.Now()
+	resp, err := exchange(req)
+	if err != nil {
+		resp, err = exchange(req)
+	}
+	log.DebugWarn(err).
+		Dur("rtt", time.Since(start)).
+		Str("upstream", u.server).
+		Str("question", req.Question[0].String()).
+		Msg("exchange dns record")
+	return resp, err
+}
+
+// directDial dial the upstream directly
+func directDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialer.New(5*time.Second).DialContext(ctx, network, addr)
+}
+
+// proxyDial dial the upstream through the proxy
+func (r *Router) proxyDial(_ context.Context, network, addr string) (net.Conn, error) {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	return r.ProxyDial(network, host, uint16(p))
+}
+
+// SetFallbackProxy resolve by the DoH / DoT fallback through the proxy instead
+// of dialing it directly, take no effect on the plain DNS fallback
+func (r *Router) SetFallbackProxy(enable bool) {
+	if server := r.dns.fallbackDNS; isDoH(server) || isDoT(server) {
+		dial := directDial
+		if enable {
+			dial = r.proxyDial
+		}
+		r.dns.fallback = newUpstream(server, dial)
+	}
+}
+
+// SetProxyResolver resolve the proxied domains by the DoH, DoT or DNS over TCP
+// server through the proxy, eg: tls://8.8.8.8, empty to use the fallback
+func (r *Router) SetProxyResolver(server string) error {
+	if server == "" {
+		r.dns.proxyDNS = nil
+		return nil
+	}
+	if !isDoH(server) && !isDoT(server) {
+		host := server
+		if h, _, err := net.SplitHostPort(server); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			return errors.Errorf("invalid resolver of proxied domains: %s", server)
+		}
+	}
+
+	r.dns.proxyDNS = newUpstream(server, r.proxyDial)
+	return nil
+}
+
+// tcpUpstream is the DNS over TCP client, or the DoT client verifying the
+// server certificate with the TLS config. The connections are kept for reuse.
+type tcpUpstream struct {
+	addr string
+	dial dialFn
+	conf *tls.Config
+	pool chan *dns.Conn
+}
+
+func (u *tcpUpstream) exchange(req *dns.Msg) (*dns.Msg, error) {
+	var conn *dns.Conn
+	select {
+	case conn = <-u.pool:
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := u.dial(ctx, "tcp", u.addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "dial DNS (%s)", u.addr)
+		}
+		if u.conf != nil {
+			tc := tls.Client(c, u.conf)
+			if err := tc.HandshakeContext(ctx); err != nil {
+				c.Close()
+				return nil, errors.Wrapf(err, "handshake DoT (%s)", u.addr)
+			}
+			c = tc
+		}
+		conn = &dns.Conn{Conn: c}
+	}
+
+	// the idle connection may be closed by the server, it is dropped on error
+	client := dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	resp, _, err := client.ExchangeWithConn(req, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	select {
+	case u.pool <- conn:
+	default:
+		conn.Close()
+	}
+	return resp, nil
+}
@@ -0,0 +1,110 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// verdicts is the detection results of the hosts not matched by any rule,
+// which are persistable, so that a restart doesn't detect them again
+type verdicts struct {
+	ttl   time.Duration
+	m     sync.Map // host:port -> verdict
+	dirty atomic.Bool
+}
+
+type verdict struct {
+	direct bool
+	expire time.Time
+}
+
+// SetVerdictTTL keep the detection results for ttl, 0 to disable
+func (r *Router) SetVerdictTTL(ttl time.Duration) {
+	r.verdicts.ttl = ttl
+}
+
+// detect route the host by the country and the access detection
+func (r *Router) detect(domain string, port uint16) bool {
+	key := net.JoinHostPort(domain, strconv.FormatUint(uint64(port), 10))
+	if val, ok := r.verdicts.m.Load(key); ok {
+		if v := val.(verdict); time.Now().Before(v.expire) {
+			return v.direct
+		}
+		r.verdicts.m.Delete(key)
+	}
+
+	direct := r.localSite(domain) || r.isAccess(domain, port)
+	if r.verdicts.ttl > 0 {
+		r.verdicts.m.Store(key, verdict{direct: direct, expire: time.Now().Add(r.verdicts.ttl)})
+		r.verdicts.dirty.Store(true)
+	}
+	return direct
+}
+
+// VerdictsChanged report whether the verdicts changed since the last save
+func (r *Router) VerdictsChanged() bool {
+	return r.verdicts.dirty.Load()
+}
+
+// SaveVerdicts write the unexpired verdicts, a line per host:
+// '<host:port> <direct|proxy> <expire unix>'
+func (r *Router) SaveVerdicts(w io.Writer) error {
+	r.verdicts.dirty.Store(false)
+
+	bw := bufio.NewWriter(w)
+	now := time.Now()
+	r.verdicts.m.Range(func(key, val interface{}) bool {
+		v := val.(verdict)
+		if now.After(v.expire) {
+			return true
+		}
+
+		route := RuleProxy
+		if v.direct {
+			route = RuleDirect
+		}
+		fmt.Fprintf(bw, "%s %s %d\n", key, route, v.expire.Unix())
+		return true
+	})
+	return errors.Wrap(bw.Flush(), "write verdicts")
+}
+
+// LoadVerdicts read the verdicts written by SaveVerdicts, the expired are dropped
+func (r *Router) LoadVerdicts(rd io.Reader) error {
+	now := time.Now()
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if expire := time.Unix(sec, 0); expire.After(now) {
+			r.verdicts.m.Store(fields[0], verdict{direct: fields[1] == RuleDirect, expire: expire})
+		}
+	}
+	return errors.Wrap(scanner.Err(), "read verdicts")
+}
+
+// FlushVerdicts drop the detection results
+func (r *Router) FlushVerdicts() {
+	r.verdicts.m.Range(func(key, _ interface{}) bool {
+		r.verdicts.m.Delete(key)
+		return true
+	})
+	r.verdicts.dirty.Store(true)
+	r.decisions.purge()
+}
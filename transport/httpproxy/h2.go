@@ -0,0 +1,129 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/pkg/dialer"
+	"golang.org/x/net/http2"
+)
+
+// H2 is the client of HTTP/2 CONNECT proxy. All the proxied connections are
+// multiplexed as streams of a single HTTP/2 TLS connection.
+type H2 struct {
+	proxyAddr string
+	auth      string
+	padding   bool
+	tr        *http2.Transport
+}
+
+// NewH2 create the HTTP/2 CONNECT client, proxyAddr default to port 443
+func NewH2(proxyAddr, user, password string) *H2 {
+	if _, _, err := net.SplitHostPort(proxyAddr); err != nil {
+		proxyAddr = net.JoinHostPort(proxyAddr, "443")
+	}
+
+	h := &H2{proxyAddr: proxyAddr, auth: basicAuth(user, password)}
+	h.tr = &http2.Transport{
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return tls.DialWithDialer(dialer.Remote(0), network, h.proxyAddr, cfg)
+		},
+	}
+	return h
+}
+
+func basicAuth(user, password string) string {
+	if user == "" && password == "" {
+		return ""
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// Dial open a CONNECT stream to the target through the proxy
+func (h *H2) Dial(tgtHost string, tgtPort uint16) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: h.proxyAddr},
+		Host:   net.JoinHostPort(tgtHost, strconv.Itoa(int(tgtPort))),
+		Header: http.Header{},
+		Body:   pr,
+	}
+	if h.auth != "" {
+		req.Header.Set("Proxy-Authorization", h.auth)
+	}
+	if h.padding {
+		req.Header.Set(paddingHeader, genPaddingHeader())
+	}
+
+	resp, err := h.tr.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		return nil, errors.Wrap(err, "round trip")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		pw.Close()
+		return nil, statusError(resp)
+	}
+
+	conn := &streamConn{body: resp.Body, pw: pw, remote: h.proxyAddr}
+	if h.padding && resp.Header.Get(paddingHeader) != "" {
+		return &paddingConn{Conn: conn}, nil
+	}
+	return conn, nil
+}
+
+// streamConn is a HTTP/2 stream as a net.Conn
+type streamConn struct {
+	body   io.ReadCloser
+	pw     *io.PipeWriter
+	remote string
+
+	once  sync.Once
+	timer *time.Timer
+	mu    sync.Mutex
+}
+
+func (c *streamConn) Read(b []byte) (int, error)  { return c.body.Read(b) }
+func (c *streamConn) Write(b []byte) (int, error) { return c.pw.Write(b) }
+func (c *streamConn) CloseWrite() error           { return c.pw.Close() }
+func (c *streamConn) Close() error {
+	c.once.Do(func() {
+		c.pw.Close()
+		c.body.Close()
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr { return &net.TCPAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.remote)
+	return addr
+}
+
+// SetDeadline close the stream once the deadline exceeded, so that the blocked
+// Read/Write are waked up. Streams are not reusable after deadline exceeded.
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() { c.Close() })
+	}
+	return nil
+}
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
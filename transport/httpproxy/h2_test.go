@@ -0,0 +1,42 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestH2_Dial(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Host != "sower:443" ||
+			r.Header.Get("Proxy-Authorization") != basicAuth("user", "pass") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		buf := make([]byte, 4)
+		io.ReadFull(r.Body, buf)
+		w.Write(append(buf, " pong"...))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	h := NewH2(srv.Listener.Addr().String(), "user", "pass")
+	h.tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+	conn, err := h.Dial("sower", 443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	if resp, err := io.ReadAll(conn); err != nil || string(resp) != "ping pong" {
+		t.Errorf("unexpected response: %s, err: %v", resp, err)
+	}
+}
@@ -0,0 +1,157 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/pkg/replayconn"
+	"github.com/wweir/sower/transport"
+)
+
+const maxHeadSize = 8 << 10
+
+// HTTP is the client and the server of HTTP proxy, with optional Basic auth
+type HTTP struct {
+	auth string
+}
+
+func New(user, password string) *HTTP {
+	return &HTTP{auth: basicAuth(user, password)}
+}
+
+type addr string
+
+func (a addr) Network() string { return "tcp" }
+func (a addr) String() string  { return string(a) }
+
+// readHead read the HTTP head byte by byte, to avoid consuming the payload
+func readHead(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 0, 512)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n\r\n")) {
+		if len(buf) >= maxHeadSize {
+			return nil, errors.New("HTTP head too large")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		buf = append(buf, b[0])
+	}
+	return buf, nil
+}
+
+func (h *HTTP) Wrap(conn net.Conn, tgtHost string, tgtPort uint16) error {
+	target := net.JoinHostPort(tgtHost, strconv.Itoa(int(tgtPort)))
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if h.auth != "" {
+		req += "Proxy-Authorization: " + h.auth + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return errors.Wrap(err, "write request")
+	}
+
+	head, err := readHead(conn)
+	if err != nil {
+		return errors.Wrap(err, "read response")
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return errors.Wrap(err, "parse response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// statusError classify the failed response, the gateway errors and the
+// forbidden targets are the failures of the target
+func statusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return errors.Wrapf(transport.ErrTarget, "proxy response: %s", resp.Status)
+	default:
+		return errors.Errorf("proxy response: %s", resp.Status)
+	}
+}
+
+// Unwrap accept a CONNECT request, and check the Basic auth if configured
+func (h *HTTP) Unwrap(conn net.Conn) (net.Addr, error) {
+	req, err := h.readRequest(conn)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != http.MethodConnect {
+		return nil, errors.Errorf("unsupported method: %s", req.Method)
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return nil, errors.Wrap(err, "write response")
+	}
+	return addr(req.Host), nil
+}
+
+// UnwrapConn accept a CONNECT request, or a plain HTTP request in the
+// absolute-URI form, which is rewritten to the origin form and replayed by
+// the returned conn. The plain HTTP connection is closed after the request,
+// as the following requests may be sent to the other hosts.
+func (h *HTTP) UnwrapConn(conn net.Conn) (net.Conn, net.Addr, error) {
+	req, err := h.readRequest(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.Method == http.MethodConnect {
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			return nil, nil, errors.Wrap(err, "write response")
+		}
+		return conn, addr(req.Host), nil
+	}
+
+	if req.URL.Host == "" {
+		_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return nil, nil, errors.Errorf("not a proxy request: %s", req.URL)
+	}
+	target := req.URL.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Header.Set("Connection", "close")
+	if len(req.TransferEncoding) != 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s %s\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Proto, req.URL.Host)
+	_ = req.Header.Write(&head)
+	head.WriteString("\r\n")
+	return replayconn.New(conn, head.Bytes()), addr(target), nil
+}
+
+// readRequest read the request head, and check the Basic auth if configured
+func (h *HTTP) readRequest(conn net.Conn) (*http.Request, error) {
+	head, err := readHead(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "read request")
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse request")
+	}
+
+	if h.auth != "" && req.Header.Get("Proxy-Authorization") != h.auth {
+		_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+			"Proxy-Authenticate: Basic realm=\"sower\"\r\n\r\n"))
+		return nil, errors.New("auth fail")
+	}
+	return req, nil
+}
@@ -0,0 +1,103 @@
+package httpproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/transport"
+)
+
+func TestHTTP(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer client.Close()
+		errCh <- New("user", "pass").Wrap(client, "sower", 443)
+	}()
+
+	if addr, err := New("user", "pass").Unwrap(server); err != nil || addr.String() != "sower:443" {
+		t.Errorf("unexpected address: %v, err: %v", addr, err)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("wrap: %s", err)
+	}
+
+	client, server = net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		errCh <- New("user", "wrong").Wrap(client, "sower", 443)
+	}()
+	if _, err := New("user", "pass").Unwrap(server); err == nil {
+		t.Error("should fail with wrong password")
+	}
+	if err := <-errCh; err == nil {
+		t.Error("wrap should fail with wrong password")
+	}
+}
+
+func TestUnwrapConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_, _ = client.Write([]byte("POST http://sower/path?q=1 HTTP/1.1\r\nHost: sower\r\n" +
+			"Proxy-Connection: keep-alive\r\nContent-Length: 4\r\n\r\nbody"))
+	}()
+
+	conn, addr, err := New("", "").UnwrapConn(server)
+	if err != nil || addr.String() != "sower:80" {
+		t.Fatalf("unexpected address: %v, err: %v", addr, err)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.RequestURI != "/path?q=1" || req.Host != "sower" || !req.Close ||
+		req.Header.Get("Proxy-Connection") != "" {
+		t.Errorf("unexpected request: %s %s %v", req.RequestURI, req.Host, req.Header)
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != "body" {
+		t.Errorf("unexpected body: %q", body)
+	}
+	client.Close()
+
+	client, server = net.Pipe()
+	defer server.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		defer client.Close()
+		errCh <- New("", "").Wrap(client, "sower", 443)
+	}()
+	if _, addr, err := New("", "").UnwrapConn(server); err != nil || addr.String() != "sower:443" {
+		t.Errorf("unexpected address: %v, err: %v", addr, err)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("wrap: %s", err)
+	}
+}
+
+func TestWrapTargetError(t *testing.T) {
+	for status, target := range map[string]bool{
+		"502 Bad Gateway":                   true,
+		"407 Proxy Authentication Required": false,
+	} {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			_, _ = readHead(server)
+			_, _ = server.Write([]byte("HTTP/1.1 " + status + "\r\n\r\n"))
+		}()
+
+		err := New("", "").Wrap(client, "sower", 443)
+		if err == nil || errors.Is(err, transport.ErrTarget) != target {
+			t.Errorf("%s: unexpected error: %v", status, err)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,103 @@
+package httpproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+)
+
+// naiveproxy pads the first frames of both directions to resist traffic
+// length analysis, negotiated by the "padding" header of CONNECT.
+// +----------------+--------------+----------+---------+
+// | PAYLOAD LENGTH | PADDING SIZE | PAYLOAD  | PADDING |
+// +----------------+--------------+----------+---------+
+// |       2        |      1       | Variable |  0-255  |
+// +----------------+--------------+----------+---------+
+const (
+	firstPaddings  = 8
+	maxPaddingSize = 255
+	paddingHeader  = "padding"
+)
+
+// paddingChars are not compressed well by HPACK huffman coding
+const paddingChars = "!#$()+<>?@[]^`{}"
+
+// SetPadding enable the naiveproxy compatible padding
+func (h *H2) SetPadding(enable bool) *H2 {
+	h.padding = enable
+	return h
+}
+
+func genPaddingHeader() string {
+	buf := make([]byte, 16+rand.Intn(17))
+	for i := range buf {
+		buf[i] = paddingChars[rand.Intn(len(paddingChars))]
+	}
+	return string(buf)
+}
+
+type paddingConn struct {
+	net.Conn
+	readFrames, writeFrames      int
+	payloadRemain, paddingRemain int
+}
+
+func (c *paddingConn) NetConn() net.Conn { return c.Conn }
+
+func (c *paddingConn) Read(b []byte) (int, error) {
+	for c.payloadRemain == 0 {
+		if c.paddingRemain > 0 {
+			if _, err := io.CopyN(io.Discard, c.Conn, int64(c.paddingRemain)); err != nil {
+				return 0, err
+			}
+			c.paddingRemain = 0
+		}
+		if c.readFrames >= firstPaddings {
+			return c.Conn.Read(b)
+		}
+
+		head := make([]byte, 3)
+		if _, err := io.ReadFull(c.Conn, head); err != nil {
+			return 0, err
+		}
+		c.payloadRemain = int(binary.BigEndian.Uint16(head))
+		c.paddingRemain = int(head[2])
+		c.readFrames++
+	}
+
+	if len(b) > c.payloadRemain {
+		b = b[:c.payloadRemain]
+	}
+	n, err := c.Conn.Read(b)
+	c.payloadRemain -= n
+	return n, err
+}
+
+func (c *paddingConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 && c.writeFrames < firstPaddings {
+		size := len(b)
+		if size > 0xFFFF {
+			size = 0xFFFF
+		}
+		padding := rand.Intn(maxPaddingSize + 1)
+
+		buf := make([]byte, 3+size+padding)
+		binary.BigEndian.PutUint16(buf, uint16(size))
+		buf[2] = byte(padding)
+		copy(buf[3:], b[:size])
+		if _, err := c.Conn.Write(buf); err != nil {
+			return n, err
+		}
+
+		c.writeFrames++
+		n += size
+		b = b[size:]
+	}
+
+	if len(b) == 0 {
+		return n, nil
+	}
+	nn, err := c.Conn.Write(b)
+	return n + nn, err
+}
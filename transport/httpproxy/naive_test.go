@@ -0,0 +1,35 @@
+package httpproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestPaddingConn(t *testing.T) {
+	w, r := net.Pipe()
+	client, server := &paddingConn{Conn: w}, &paddingConn{Conn: r}
+
+	var want []byte
+	go func() {
+		defer client.Close()
+		for i := 0; i < firstPaddings+4; i++ {
+			if _, err := client.Write(bytes.Repeat([]byte{byte(i)}, 100+i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < firstPaddings+4; i++ {
+		want = append(want, bytes.Repeat([]byte{byte(i)}, 100+i)...)
+	}
+
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("data mismatch, got %d bytes, want %d bytes", len(got), len(want))
+	}
+}
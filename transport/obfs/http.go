@@ -0,0 +1,76 @@
+package obfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"net/http"
+)
+
+// HTTP disguise the connection as a websocket upgrade request,
+// the first payload is carried as the request body
+type HTTP struct {
+	host string
+}
+
+func (h *HTTP) Wrap(conn net.Conn) (net.Conn, error) {
+	return &httpConn{Conn: conn, host: h.host}, nil
+}
+
+type httpConn struct {
+	net.Conn
+	host string
+
+	requested bool
+	br        *bufio.Reader
+}
+
+func (c *httpConn) NetConn() net.Conn { return c.Conn }
+
+func (c *httpConn) Write(b []byte) (int, error) {
+	if c.requested {
+		return c.Conn.Write(b)
+	}
+	c.requested = true
+
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return 0, err
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "GET / HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"User-Agent: curl/7.%d.%d\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Content-Length: %d\r\n\r\n",
+		c.host, mrand.Intn(54), mrand.Intn(2), base64.StdEncoding.EncodeToString(key), len(b))
+	buf.Write(b)
+
+	if _, err := c.Conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *httpConn) Read(b []byte) (int, error) {
+	if c.br == nil {
+		c.br = bufio.NewReader(c.Conn)
+		resp, err := http.ReadResponse(c.br, nil)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+	}
+
+	if c.br.Buffered() > 0 {
+		return c.br.Read(b)
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,20 @@
+// Package obfs implement the client of simple-obfs, which disguises the
+// underlaying connection as HTTP or TLS traffic.
+package obfs
+
+import (
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/transport"
+)
+
+// New create the obfuscation wrapper by mode, option: http/tls
+func New(mode, host string) (transport.Wrapper, error) {
+	switch mode {
+	case "http":
+		return &HTTP{host: host}, nil
+	case "tls":
+		return &TLS{host: host}, nil
+	default:
+		return nil, errors.Errorf("unsupported obfs mode: %s", mode)
+	}
+}
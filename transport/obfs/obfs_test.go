@@ -0,0 +1,67 @@
+package obfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHTTP(t *testing.T) {
+	w, r := net.Pipe()
+	conn, _ := (&HTTP{host: "sower"}).Wrap(w)
+	go func() {
+		_, _ = conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+			t.Errorf("unexpected reply: %q, err: %v", buf, err)
+		}
+		conn.Close()
+	}()
+
+	req, err := http.ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if req.Host != "sower" || string(body) != "ping" {
+		t.Fatalf("unexpected request: %s %q", req.Host, body)
+	}
+	_, _ = r.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\npong"))
+	_, _ = io.Copy(io.Discard, r)
+}
+
+func TestTLS(t *testing.T) {
+	w, r := net.Pipe()
+	conn, _ := (&TLS{host: "sower"}).Wrap(w)
+	go func() {
+		_, _ = conn.Write([]byte("ping"))
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "pongpong" {
+			t.Errorf("unexpected reply: %q, err: %v", buf, err)
+		}
+		conn.Close()
+	}()
+
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(r, head); err != nil || head[0] != 0x16 {
+		t.Fatalf("unexpected record: %v, err: %v", head, err)
+	}
+	hello := make([]byte, binary.BigEndian.Uint16(head[3:]))
+	if _, err := io.ReadFull(r, hello); err != nil {
+		t.Fatal(err)
+	}
+	if ticket := hello[4+2+32+33+58+2+2+4:][:4]; string(ticket) != "ping" {
+		t.Fatalf("unexpected session ticket: %q", ticket)
+	}
+
+	resp := make([]byte, 105-3)
+	resp = append(resp, 0x17, 0x03, 0x03, 0x00, 0x04)
+	resp = append(resp, "pong"...)
+	resp = append(resp, 0x17, 0x03, 0x03, 0x00, 0x04)
+	resp = append(resp, "pong"...)
+	_, _ = r.Write(resp)
+	_, _ = io.Copy(io.Discard, r)
+}
@@ -0,0 +1,151 @@
+package obfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+const tlsChunkSize = 1 << 14
+
+// TLS disguise the connection as a TLS 1.2 session, the first payload is
+// carried in the session ticket extension of the ClientHello, and the rest
+// as application data records
+type TLS struct {
+	host string
+}
+
+func (t *TLS) Wrap(conn net.Conn) (net.Conn, error) {
+	return &tlsConn{Conn: conn, host: t.host}, nil
+}
+
+type tlsConn struct {
+	net.Conn
+	host string
+
+	helloSent, helloRecv bool
+	remain               int // payload remained in the current record
+}
+
+func (c *tlsConn) NetConn() net.Conn { return c.Conn }
+
+func (c *tlsConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		size := len(b)
+		if size > tlsChunkSize {
+			size = tlsChunkSize
+		}
+
+		var buf []byte
+		if !c.helloSent {
+			c.helloSent = true
+			buf = clientHello(b[:size], c.host)
+		} else {
+			buf = append([]byte{0x17, 0x03, 0x03, byte(size >> 8), byte(size)}, b[:size]...)
+		}
+		if _, err := c.Conn.Write(buf); err != nil {
+			return n, err
+		}
+
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+func (c *tlsConn) Read(b []byte) (int, error) {
+	if c.remain == 0 {
+		// ServerHello(5+91) + ChangeCipherSpec(5+1) + type and version(3) in
+		// the first response, and type and version(3) for the later records
+		discard := 3
+		if !c.helloRecv {
+			c.helloRecv = true
+			discard = 105
+		}
+		if _, err := io.CopyN(io.Discard, c.Conn, int64(discard)); err != nil {
+			return 0, err
+		}
+
+		size := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, size); err != nil {
+			return 0, err
+		}
+		c.remain = int(binary.BigEndian.Uint16(size))
+	}
+
+	if len(b) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := c.Conn.Read(b)
+	c.remain -= n
+	return n, err
+}
+
+func clientHello(data []byte, host string) []byte {
+	random := make([]byte, 28)
+	sessionID := make([]byte, 32)
+	_, _ = rand.Read(random)
+	_, _ = rand.Read(sessionID)
+
+	buf := &bytes.Buffer{}
+	// record: handshake, TLS 1.0, length
+	buf.Write([]byte{0x16, 0x03, 0x01})
+	_ = binary.Write(buf, binary.BigEndian, uint16(212+len(data)+len(host)))
+
+	// ClientHello, length, TLS 1.2
+	buf.Write([]byte{0x01, 0x00})
+	_ = binary.Write(buf, binary.BigEndian, uint16(208+len(data)+len(host)))
+	buf.Write([]byte{0x03, 0x03})
+
+	// random with timestamp, session id
+	_ = binary.Write(buf, binary.BigEndian, uint32(time.Now().Unix()))
+	buf.Write(random)
+	buf.WriteByte(32)
+	buf.Write(sessionID)
+
+	// cipher suites
+	buf.Write([]byte{0x00, 0x38})
+	buf.Write([]byte{
+		0xc0, 0x2c, 0xc0, 0x30, 0x00, 0x9f, 0xcc, 0xa9, 0xcc, 0xa8, 0xcc, 0xaa, 0xc0, 0x2b, 0xc0, 0x2f,
+		0x00, 0x9e, 0xc0, 0x24, 0xc0, 0x28, 0x00, 0x6b, 0xc0, 0x23, 0xc0, 0x27, 0x00, 0x67, 0xc0, 0x0a,
+		0xc0, 0x14, 0x00, 0x39, 0xc0, 0x09, 0xc0, 0x13, 0x00, 0x33, 0x00, 0x9d, 0x00, 0x9c, 0x00, 0x3d,
+		0x00, 0x3c, 0x00, 0x35, 0x00, 0x2f, 0x00, 0xff,
+	})
+
+	// compression methods: null
+	buf.Write([]byte{0x01, 0x00})
+
+	// extensions
+	_ = binary.Write(buf, binary.BigEndian, uint16(79+len(data)+len(host)))
+
+	// session ticket
+	buf.Write([]byte{0x00, 0x23})
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(data)))
+	buf.Write(data)
+
+	// server name
+	buf.Write([]byte{0x00, 0x00})
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(host)+5))
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(host)+3))
+	buf.WriteByte(0x00)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(host)))
+	buf.WriteString(host)
+
+	// ec point formats
+	buf.Write([]byte{0x00, 0x0b, 0x00, 0x04, 0x03, 0x01, 0x00, 0x02})
+	// supported groups
+	buf.Write([]byte{0x00, 0x0a, 0x00, 0x0a, 0x00, 0x08, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x19, 0x00, 0x18})
+	// signature algorithms
+	buf.Write([]byte{
+		0x00, 0x0d, 0x00, 0x20, 0x00, 0x1e, 0x06, 0x01, 0x06, 0x02, 0x06, 0x03, 0x05,
+		0x01, 0x05, 0x02, 0x05, 0x03, 0x04, 0x01, 0x04, 0x02, 0x04, 0x03, 0x03, 0x01,
+		0x03, 0x02, 0x03, 0x03, 0x02, 0x01, 0x02, 0x02, 0x02, 0x03,
+	})
+	// encrypt then mac, extended master secret
+	buf.Write([]byte{0x00, 0x16, 0x00, 0x00, 0x00, 0x17, 0x00, 0x00})
+
+	return buf.Bytes()
+}
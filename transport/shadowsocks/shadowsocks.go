@@ -0,0 +1,238 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// https://shadowsocks.org/guide/aead.html
+// [salt][encrypted payload length][length tag][encrypted payload][payload tag]...
+const maxPayloadSize = 0x3FFF
+
+// saltReader generate the session salts, replaced by the tests
+var saltReader io.Reader = rand.Reader
+
+type method struct {
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var methods = map[string]method{
+	"chacha20-ietf-poly1305": {32, chacha20poly1305.New},
+	"aes-256-gcm":            {32, newGCM},
+	"aes-128-gcm":            {16, newGCM},
+}
+
+// Shadowsocks is the client of shadowsocks AEAD protocol
+type Shadowsocks struct {
+	method
+	key []byte
+}
+
+func New(cipherMethod, password string) (*Shadowsocks, error) {
+	m, ok := methods[cipherMethod]
+	if !ok {
+		return nil, errors.Errorf("unsupported cipher: %s", cipherMethod)
+	}
+
+	return &Shadowsocks{
+		method: m,
+		key:    kdf(password, m.keySize),
+	}, nil
+}
+
+// kdf is the EVP_BytesToKey of OpenSSL with MD5
+func kdf(password string, keySize int) []byte {
+	var key, prev []byte
+	for len(key) < keySize {
+		sum := md5.Sum(append(prev, password...))
+		prev = sum[:]
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
+
+func (s *Shadowsocks) SaltSize() int { return s.keySize }
+
+// SessionAEAD derive the AEAD of a session by HKDF-SHA1
+func (s *Shadowsocks) SessionAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, s.keySize)
+	if _, err := io.ReadFull(hkdf.New(sha1.New, s.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return s.newAEAD(subkey)
+}
+
+func (s *Shadowsocks) WrapConn(conn net.Conn, tgtHost string, tgtPort uint16) (net.Conn, error) {
+	if len(tgtHost) > 255 {
+		return nil, errors.New("target host too long")
+	}
+
+	c := NewConn(conn, s)
+	if _, err := c.Write(socksAddr(tgtHost, tgtPort)); err != nil {
+		return nil, errors.Wrap(err, "write target")
+	}
+	return c, nil
+}
+
+// socksAddr encode the address in SOCKS5 format: ATYP + DST.ADDR + DST.PORT
+func socksAddr(host string, port uint16) []byte {
+	var buf []byte
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		buf = append([]byte{0x01}, ip.To4()...)
+	case ip != nil:
+		buf = append([]byte{0x04}, ip.To16()...)
+	default:
+		buf = append([]byte{0x03, byte(len(host))}, host...)
+	}
+	return append(buf, byte(port>>8), byte(port))
+}
+
+// Cipher derive the AEAD of a session from its salt
+type Cipher interface {
+	SaltSize() int
+	SessionAEAD(salt []byte) (cipher.AEAD, error)
+}
+
+// Conn is an AEAD encrypted connection
+type Conn struct {
+	net.Conn
+	cipher Cipher
+
+	enc, dec           cipher.AEAD
+	encNonce, decNonce []byte
+	plain              []byte // decrypted but not read yet
+}
+
+func NewConn(conn net.Conn, cipher Cipher) *Conn {
+	return &Conn{Conn: conn, cipher: cipher}
+}
+
+func (c *Conn) NetConn() net.Conn { return c.Conn }
+
+func (c *Conn) Write(b []byte) (int, error) {
+	// the salt goes with the first chunk, an empty write sends nothing
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var buf []byte
+	if c.enc == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := io.ReadFull(saltReader, salt); err != nil {
+			return 0, err
+		}
+		enc, err := c.cipher.SessionAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+
+		c.enc, c.encNonce = enc, make([]byte, enc.NonceSize())
+		buf = salt
+	}
+
+	n := 0
+	for len(b) > 0 {
+		size := len(b)
+		if size > maxPayloadSize {
+			size = maxPayloadSize
+		}
+
+		buf = c.seal(buf, []byte{byte(size >> 8), byte(size)})
+		buf = c.seal(buf, b[:size])
+		if _, err := c.Conn.Write(buf); err != nil {
+			return n, err
+		}
+
+		n += size
+		b = b[size:]
+		buf = buf[:0]
+	}
+	return n, nil
+}
+
+func (c *Conn) seal(dst, plain []byte) []byte {
+	dst = c.enc.Seal(dst, c.encNonce, plain, nil)
+	increase(c.encNonce)
+	return dst
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.plain) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func (c *Conn) readChunk() error {
+	if c.dec == nil {
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		dec, err := c.cipher.SessionAEAD(salt)
+		if err != nil {
+			return err
+		}
+		c.dec, c.decNonce = dec, make([]byte, dec.NonceSize())
+	}
+
+	buf := make([]byte, 2+c.dec.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	sizeBuf, err := c.open(buf)
+	if err != nil {
+		return errors.Wrap(err, "open length")
+	}
+
+	size := (int(sizeBuf[0])<<8 | int(sizeBuf[1])) & maxPayloadSize
+	buf = make([]byte, size+c.dec.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	if c.plain, err = c.open(buf); err != nil {
+		return errors.Wrap(err, "open payload")
+	}
+	return nil
+}
+
+func (c *Conn) open(b []byte) ([]byte, error) {
+	plain, err := c.dec.Open(b[:0], c.decNonce, b, nil)
+	increase(c.decNonce)
+	return plain, err
+}
+
+// increase the little-endian nonce
+func increase(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestShadowsocks_WrapConn(t *testing.T) {
+	for name := range methods {
+		t.Run(name, func(t *testing.T) {
+			ss, err := New(name, "123")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, w := net.Pipe()
+			defer r.Close()
+			payload := bytes.Repeat([]byte("sower"), maxPayloadSize)
+			go func() {
+				defer w.Close()
+				conn, err := ss.WrapConn(w, "sower", 443)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.Write(payload)
+			}()
+
+			// the server side decrypts with the same cipher
+			server := NewConn(r, ss)
+			addr := socksAddr("sower", 443)
+			buf := make([]byte, len(addr))
+			if _, err := io.ReadFull(server, buf); err != nil || !bytes.Equal(buf, addr) {
+				t.Fatalf("unexpected address: %v, err: %v", buf, err)
+			}
+			if got, err := io.ReadAll(server); err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("unexpected payload, len: %d, err: %v", len(got), err)
+			}
+		})
+	}
+}
+
+func TestShadowsocks_LongHost(t *testing.T) {
+	ss, err := New("aes-256-gcm", "sower")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w := net.Pipe()
+	defer r.Close()
+	defer w.Close()
+	if _, err := ss.WrapConn(w, strings.Repeat("a", 256), 443); err == nil {
+		t.Error("expect host too long error")
+	}
+}
+
+// the vector is built from the SIP004 spec with an independent implementation
+// of EVP_BytesToKey, HKDF-SHA1 and ChaCha20-Poly1305, checked against the
+// RFC 5869 and RFC 8439 vectors
+const (
+	vectorKey    = "f80abdc76b96c1cc16e88475a770de94be164502020399574f7042d35e3a7861"
+	vectorStream = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+		"71bc35f56fc38b92e0fe23f75528ece8f44372da69f66bb05f837e93cfae2ed7" +
+		"b4487164e65daed23fd463fafdd3fb1b29282469615156fb933319a6f0c7022b" +
+		"af1e0563d2f7fc95f8dfa19e5197b2eb79a846fa22298b4e3bc07ae98ed33b3e" +
+		"5eaa949ad5"
+	vectorRequest = "GET / HTTP/1.1\r\n\r\n"
+)
+
+func TestShadowsocks_Vector(t *testing.T) {
+	ss, err := New("chacha20-ietf-poly1305", "sower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(ss.key); got != vectorKey {
+		t.Fatalf("unexpected key: %s", got)
+	}
+	stream, _ := hex.DecodeString(vectorStream)
+
+	t.Run("write", func(t *testing.T) {
+		saltReader = bytes.NewReader(stream[:32])
+		defer func() { saltReader = rand.Reader }()
+
+		r, w := net.Pipe()
+		defer r.Close()
+		go func() {
+			defer w.Close()
+			conn, err := ss.WrapConn(w, "example.com", 443)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if n, err := conn.Write(nil); n != 0 || err != nil {
+				t.Errorf("unexpected empty write: %d, %v", n, err)
+			}
+			conn.Write([]byte(vectorRequest))
+		}()
+
+		if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, stream) {
+			t.Errorf("unexpected stream: %x, err: %v", got, err)
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer r.Close()
+		go func() {
+			defer w.Close()
+			w.Write(stream)
+		}()
+
+		got, err := io.ReadAll(NewConn(r, ss))
+		want := append(socksAddr("example.com", 443), vectorRequest...)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("unexpected plain: %q, err: %v", got, err)
+		}
+	})
+}
+
+func TestConn_EmptyWrite(t *testing.T) {
+	ss, err := New("aes-128-gcm", "sower")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w := net.Pipe()
+	defer r.Close()
+	go func() {
+		defer w.Close()
+		conn := NewConn(w, ss)
+		conn.Write(nil)
+		conn.Write([]byte("sower"))
+	}()
+
+	// the salt must come with the first non-empty write
+	if got, err := io.ReadAll(NewConn(r, ss)); err != nil || string(got) != "sower" {
+		t.Errorf("unexpected plain: %q, err: %v", got, err)
+	}
+}
@@ -0,0 +1,131 @@
+package snell
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/wweir/sower/transport/shadowsocks"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Snell share the AEAD chunk format of shadowsocks, with session keys
+// derived by argon2id. v1 uses chacha20-poly1305, v2/v3 use aes-128-gcm.
+// +-----+-----+-----------+-----------+----------+-----------+------+
+// | VER | CMD | ID LENGTH | CLIENT ID | HOST LEN |   HOST    | PORT |
+// +-----+-----+-----------+-----------+----------+-----------+------+
+// |  1  |  1  |     1     | Variable  |    1     | Variable  |  2   |
+// +-----+-----+-----------+-----------+----------+-----------+------+
+const (
+	headVersion = 1
+	saltSize    = 16
+
+	cmdConnect   = 1
+	cmdConnectV2 = 5
+
+	respTunnel = 0
+	respError  = 2
+)
+
+// Snell is the client of snell protocol
+type Snell struct {
+	psk     []byte
+	keySize int
+	cmd     byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func New(psk string, version int) (*Snell, error) {
+	s := &Snell{psk: []byte(psk)}
+	switch version {
+	case 1:
+		s.keySize, s.cmd, s.newAEAD = chacha20poly1305.KeySize, cmdConnect, chacha20poly1305.New
+	case 2, 3:
+		s.keySize, s.cmd, s.newAEAD = 16, cmdConnectV2, newGCM
+	default:
+		return nil, errors.Errorf("unsupported snell version: %d", version)
+	}
+	return s, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *Snell) SaltSize() int { return saltSize }
+
+// SessionAEAD derive the AEAD of a session by argon2id
+func (s *Snell) SessionAEAD(salt []byte) (cipher.AEAD, error) {
+	return s.newAEAD(argon2.IDKey(s.psk, salt, 3, 8, 1, 32)[:s.keySize])
+}
+
+func (s *Snell) WrapConn(conn net.Conn, tgtHost string, tgtPort uint16) (net.Conn, error) {
+	if len(tgtHost) > 255 {
+		return nil, errors.New("target host too long")
+	}
+
+	buf := make([]byte, 0, 4+len(tgtHost)+2)
+	buf = append(buf, headVersion, s.cmd, 0, byte(len(tgtHost)))
+	buf = append(buf, tgtHost...)
+	buf = append(buf, byte(tgtPort>>8), byte(tgtPort))
+
+	c := &Conn{Conn: shadowsocks.NewConn(conn, s)}
+	if _, err := c.Conn.Write(buf); err != nil {
+		return nil, errors.Wrap(err, "write target")
+	}
+	return c, nil
+}
+
+// Conn is a snell tunnel, the server response is checked on first read
+type Conn struct {
+	*shadowsocks.Conn
+	tunnel bool
+}
+
+func (c *Conn) NetConn() net.Conn { return c.Conn }
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if !c.tunnel {
+		if err := c.readResp(); err != nil {
+			return 0, err
+		}
+		c.tunnel = true
+	}
+
+	n, err := c.Conn.Read(b)
+	if n == 0 && err == nil && len(b) != 0 {
+		return 0, io.EOF // zero chunk ends the tunnel since v2
+	}
+	return n, err
+}
+
+func (c *Conn) readResp() error {
+	resp := make([]byte, 1)
+	if _, err := io.ReadFull(c.Conn, resp); err != nil {
+		return errors.Wrap(err, "read response")
+	}
+
+	switch resp[0] {
+	case respTunnel:
+		return nil
+	case respError:
+		head := make([]byte, 2) // error code + message length
+		if _, err := io.ReadFull(c.Conn, head); err != nil {
+			return errors.Wrap(err, "read error")
+		}
+		msg := make([]byte, head[1])
+		if _, err := io.ReadFull(c.Conn, msg); err != nil {
+			return errors.Wrap(err, "read error")
+		}
+		return errors.Errorf("snell error %d: %s", head[0], msg)
+	default:
+		return errors.Errorf("unknown snell response: %d", resp[0])
+	}
+}
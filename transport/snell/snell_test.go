@@ -0,0 +1,48 @@
+package snell
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/wweir/sower/transport/shadowsocks"
+)
+
+func TestSnell(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		s, err := New("psk", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, r := net.Pipe()
+		go func() {
+			conn, err := s.WrapConn(w, "sower", 443)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+				t.Errorf("unexpected reply: %q, err: %v", buf, err)
+			}
+			conn.Close()
+		}()
+
+		server := shadowsocks.NewConn(r, s)
+		head := make([]byte, 4+len("sower")+2)
+		if _, err := io.ReadFull(server, head); err != nil {
+			t.Fatal(err)
+		}
+		want := append([]byte{headVersion, s.cmd, 0, 5}, "sower\x01\xbb"...)
+		if !bytes.Equal(head, want) {
+			t.Fatalf("unexpected head: %v", head)
+		}
+
+		if _, err := server.Write(append([]byte{respTunnel}, "pong"...)); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, server)
+	}
+}
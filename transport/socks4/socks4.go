@@ -0,0 +1,114 @@
+package socks4
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// https://www.openssh.com/txt/socks4.protocol
+// https://www.openssh.com/txt/socks4a.protocol
+// +----+----+---------+--------+--------+------+--------+------+
+// | VN | CD | DSTPORT | DSTIP  | USERID | NULL | DOMAIN | NULL |
+// +----+----+---------+--------+--------+------+--------+------+
+// | 1  | 1  |    2    |   4    |  Var   |  1   | 4a Var |  1   |
+// +----+----+---------+--------+--------+------+--------+------+
+
+type reqHead struct {
+	VN      byte
+	CD      byte
+	DSTPORT uint16
+	DSTIP   [4]byte
+}
+
+var (
+	granted  = []byte{0, 90, 0, 0, 0, 0, 0, 0}
+	rejected = []byte{0, 91, 0, 0, 0, 0, 0, 0}
+)
+
+type Addr struct {
+	Host string
+	Port uint16
+}
+
+func (a *Addr) Network() string        { return "tcp" }
+func (a *Addr) String() string         { return net.JoinHostPort(a.Host, strconv.Itoa(int(a.Port))) }
+func (a *Addr) Addr() (string, uint16) { return a.Host, a.Port }
+
+// Socks4 is the SOCKS4/4a CONNECT protocol, for legacy clients
+type Socks4 struct{}
+
+func New() *Socks4 {
+	return &Socks4{}
+}
+
+func (s *Socks4) Unwrap(conn net.Conn) (net.Addr, error) {
+	head := &reqHead{}
+	if err := binary.Read(conn, binary.BigEndian, head); err != nil {
+		return nil, errors.Wrap(err, "read head")
+	}
+	if head.VN != 4 || head.CD != 1 {
+		_, _ = conn.Write(rejected)
+		return nil, errors.Errorf("unsupported version(%d) or command(%d)", head.VN, head.CD)
+	}
+
+	// read byte by byte to avoid consuming the payload
+	br := bufio.NewReaderSize(oneByteReader{conn}, 16)
+	if _, err := br.ReadString(0); err != nil {
+		return nil, errors.Wrap(err, "read user id")
+	}
+
+	addr := &Addr{Port: head.DSTPORT}
+	ip := head.DSTIP
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 { // socks4a
+		domain, err := br.ReadString(0)
+		if err != nil {
+			return nil, errors.Wrap(err, "read domain")
+		}
+		addr.Host = domain[:len(domain)-1]
+	} else {
+		addr.Host = net.IP(ip[:]).String()
+	}
+
+	if _, err := conn.Write(granted); err != nil {
+		return nil, errors.Wrap(err, "write reply")
+	}
+	return addr, nil
+}
+
+func (s *Socks4) Wrap(conn net.Conn, tgtHost string, tgtPort uint16) error {
+	buf := []byte{4, 1, byte(tgtPort >> 8), byte(tgtPort)}
+	if ip := net.ParseIP(tgtHost).To4(); ip != nil {
+		buf = append(append(buf, ip...), 0)
+	} else {
+		buf = append(buf, 0, 0, 0, 1, 0)
+		buf = append(append(buf, tgtHost...), 0)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return errors.WithStack(err)
+	}
+	if resp[1] != 90 {
+		return errors.Errorf("socks4 reply: %d", resp[1])
+	}
+	return nil
+}
+
+type oneByteReader struct {
+	io.Reader
+}
+
+func (r oneByteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return r.Reader.Read(b)
+}
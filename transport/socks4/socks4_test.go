@@ -0,0 +1,26 @@
+package socks4
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSocks4(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "sower"} {
+		client, server := net.Pipe()
+		errCh := make(chan error, 1)
+		go func() {
+			defer client.Close()
+			errCh <- New().Wrap(client, host, 443)
+		}()
+
+		addr, err := New().Unwrap(server)
+		if err != nil || addr.String() != net.JoinHostPort(host, "443") {
+			t.Errorf("unexpected address: %v, err: %v", addr, err)
+		}
+		if err := <-errCh; err != nil {
+			t.Errorf("wrap: %s", err)
+		}
+		server.Close()
+	}
+}
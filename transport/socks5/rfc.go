@@ -17,15 +17,16 @@ type authReq struct {
 
 func (req *authReq) Fulfill(r io.Reader) error {
 	buf := make([]byte, 2)
-	if n, err := r.Read(buf); err != nil || n != 2 {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
 
 	req.VER = buf[0]
 	req.NMETHODS = buf[1]
 
+	// the head may arrive in pieces, eg: replayed after sniffing
 	req.METHODS = make([]byte, int(req.NMETHODS))
-	if n, err := r.Read(req.METHODS); err != nil || n != len(req.METHODS) {
+	if _, err := io.ReadFull(r, req.METHODS); err != nil {
 		return err
 	}
 
@@ -3,10 +3,12 @@ package socks5
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 	"net"
 	"strconv"
 
 	"github.com/pkg/errors"
+	"github.com/wweir/sower/transport"
 )
 
 type AddrHead struct {
@@ -22,12 +24,20 @@ func (h *AddrHead) String() string {
 // Socks5 is a SOCKS5 proxy. It implements the teeconn.Conn interface.
 // It is used to be a second relay of other proxy tools.
 // user -> sower -socks5-> third-party proxy -> target
-type Socks5 struct{}
+type Socks5 struct {
+	user, password string
+}
 
 func New() *Socks5 {
 	return &Socks5{}
 }
 
+// SetAuth set the username/password(RFC 1929) used to connect upstream
+func (s *Socks5) SetAuth(user, password string) *Socks5 {
+	s.user, s.password = user, password
+	return s
+}
+
 var noAuthResp = authResp{VER: 5, METHOD: 0}
 var succHeadResp = respHead{VER: 5, REP: 0, RSV: 0, ATYP: 1}
 
@@ -79,19 +89,18 @@ var noAuthReq = struct {
 	NMETHODS uint8
 	METHODS  byte
 }{5, 1, 0}
+var userPassAuthReq = struct {
+	VER      byte
+	NMETHODS uint8
+	METHODS  [2]byte
+}{5, 2, [2]byte{0, 2}}
 var domainHead = reqHead{VER: 5, CMD: 1, RSV: 0, ATYP: 3}
 
 func (s *Socks5) Wrap(conn net.Conn, tgtHost string, tgtPort uint16) error {
-	{ // auth
-		if err := binary.Write(conn, binary.BigEndian, &noAuthReq); err != nil {
-			return errors.WithStack(err)
-		}
-
-		resp := &authResp{}
-		if err := binary.Read(conn, binary.BigEndian, resp); err != nil {
-			return errors.WithStack(err)
-		}
+	if err := s.auth(conn); err != nil {
+		return err
 	}
+
 	{ // head
 		buf := bytes.NewBuffer(make([]byte, 0, binary.Size(domainHead)+1+len(tgtHost)+2))
 		_ = binary.Write(buf, binary.BigEndian, domainHead)
@@ -107,7 +116,64 @@ func (s *Socks5) Wrap(conn net.Conn, tgtHost string, tgtPort uint16) error {
 		if err := binary.Read(conn, binary.BigEndian, &head); err != nil {
 			return errors.WithStack(err)
 		}
+		switch head.REP {
+		case 0:
+		case 2, 3, 4, 5, 6: // not allowed, network / host unreachable, refused, TTL expired
+			return errors.Wrapf(transport.ErrTarget, "socks5 reply: %d", head.REP)
+		default:
+			return errors.Errorf("socks5 reply: %d", head.REP)
+		}
+	}
+
+	return nil
+}
+
+// auth negotiate the auth method with upstream
+func (s *Socks5) auth(conn net.Conn) error {
+	var req interface{} = &noAuthReq
+	if s.user != "" || s.password != "" {
+		req = &userPassAuthReq
+	}
+	if err := binary.Write(conn, binary.BigEndian, req); err != nil {
+		return errors.WithStack(err)
 	}
 
+	resp := &authResp{}
+	if err := binary.Read(conn, binary.BigEndian, resp); err != nil {
+		return errors.WithStack(err)
+	}
+
+	switch resp.METHOD {
+	case 0x00:
+		return nil
+	case 0x02:
+		return s.userPassAuth(conn)
+	default:
+		return errors.Errorf("no acceptable auth method: %d", resp.METHOD)
+	}
+}
+
+// userPassAuth do the username/password sub-negotiation, RFC 1929
+func (s *Socks5) userPassAuth(conn net.Conn) error {
+	if len(s.user) > 255 || len(s.password) > 255 {
+		return errors.New("username or password too long")
+	}
+
+	buf := make([]byte, 0, 3+len(s.user)+len(s.password))
+	buf = append(buf, 1, byte(len(s.user)))
+	buf = append(buf, s.user...)
+	buf = append(buf, byte(len(s.password)))
+	buf = append(buf, s.password...)
+	if _, err := conn.Write(buf); err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return errors.WithStack(err)
+	}
+	if resp[1] != 0 {
+		return errors.New("socks5 username/password auth fail")
+	}
 	return nil
 }
@@ -0,0 +1,182 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// UDP request header of RFC 1928:
+// +-----+------+------+----------+----------+----------+
+// | RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// +-----+------+------+----------+----------+----------+
+// |  2  |  1   |  1   | Variable |    2     | Variable |
+// +-----+------+------+----------+----------+----------+
+
+var associateHead = reqHead{VER: 5, CMD: 3, RSV: 0, ATYP: 1}
+
+// WrapUDP prepend the UDP request header to data
+func WrapUDP(host string, port uint16, data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 4+1+len(host)+2+len(data)))
+	buf.Write([]byte{0, 0, 0})
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		buf.WriteByte(0x01)
+		buf.Write(ip.To4())
+	case ip != nil:
+		buf.WriteByte(0x04)
+		buf.Write(ip.To16())
+	case len(host) > 255:
+		return nil, errors.New("target host too long")
+	default:
+		buf.WriteByte(0x03)
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	}
+
+	buf.Write([]byte{byte(port >> 8), byte(port)})
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// UnwrapUDP parse the UDP request header, fragments are not supported
+func UnwrapUDP(packet []byte) (host string, port uint16, data []byte, err error) {
+	if len(packet) < 4 {
+		return "", 0, nil, errors.New("packet too short")
+	}
+	if packet[2] != 0 {
+		return "", 0, nil, errors.New("fragment is not supported")
+	}
+
+	addr, err := newAddrType(packet[3])
+	if err != nil {
+		return "", 0, nil, err
+	}
+	r := bytes.NewReader(packet[4:])
+	if err := addr.Fulfill(r); err != nil {
+		return "", 0, nil, errors.Wrap(err, "read address")
+	}
+
+	host, port = addr.Addr()
+	return host, port, packet[len(packet)-r.Len():], nil
+}
+
+func newAddrType(atyp byte) (addrType, error) {
+	switch atyp {
+	case 0x01: // IPv4
+		return &addrTypeIPv4{}, nil
+	case 0x03: // domain name
+		return &addrTypeDomain{}, nil
+	case 0x04: // IPv6
+		return &addrTypeIPv6{}, nil
+	default:
+		return nil, errors.New("invalid ATYP")
+	}
+}
+
+// UDPConn is a UDP association through the upstream socks5 proxy.
+// The association lives as long as the control connection.
+type UDPConn struct {
+	*net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+}
+
+// Associate negotiate UDP ASSOCIATE over the control connection ctrl
+func (s *Socks5) Associate(ctrl net.Conn) (*UDPConn, error) {
+	if err := s.auth(ctrl); err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, binary.Size(associateHead)+6))
+	_ = binary.Write(buf, binary.BigEndian, associateHead)
+	buf.Write([]byte{0, 0, 0, 0, 0, 0}) // 0.0.0.0:0, the client address is unknown yet
+	if _, err := ctrl.Write(buf.Bytes()); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	head := &reqHead{}
+	if err := binary.Read(ctrl, binary.BigEndian, head); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if head.CMD != 0 { // REP
+		return nil, errors.Errorf("socks5 reply: %d", head.CMD)
+	}
+
+	bnd, err := newAddrType(head.ATYP)
+	if err != nil {
+		return nil, err
+	}
+	if err := bnd.Fulfill(ctrl); err != nil {
+		return nil, errors.Wrap(err, "read bind address")
+	}
+
+	host, port := bnd.Addr()
+	relay, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// the upstream may reply unspecified IP, which means its own address
+	if relay.IP.IsUnspecified() {
+		if tcpAddr, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = tcpAddr.IP
+		}
+	}
+
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &UDPConn{UDPConn: conn, ctrl: ctrl, relay: relay}, nil
+}
+
+// WriteTo send data to the target through the association
+func (c *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	packet, err := WrapUDP(host, uint16(port), b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.UDPConn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom receive data and the target address from the association, the
+// packet is read into b and the header is stripped in place
+func (c *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, err := c.UDPConn.Read(b)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		host, port, data, err := UnwrapUDP(b[:n])
+		if err != nil {
+			continue // drop invalid packets
+		}
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			continue
+		}
+		return copy(b, data), addr, nil
+	}
+}
+
+// Close close both the UDP socket and the control connection
+func (c *UDPConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
@@ -0,0 +1,131 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestUDPHeader(t *testing.T) {
+	for _, host := range []string{"sower", "127.0.0.1", "::1"} {
+		packet, err := WrapUDP(host, 53, []byte("query"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotHost, gotPort, data, err := UnwrapUDP(packet)
+		if err != nil || gotHost != host || gotPort != 53 || !bytes.Equal(data, []byte("query")) {
+			t.Errorf("unexpected %s:%d %q, err: %v", gotHost, gotPort, data, err)
+		}
+	}
+
+	if _, err := WrapUDP(strings.Repeat("a", 256), 53, nil); err == nil {
+		t.Error("expect host too long error")
+	}
+}
+
+// tcpConn report the TCP remote address of the pipe, as the control connection
+type tcpConn struct {
+	net.Conn
+	remote *net.TCPAddr
+}
+
+func (c tcpConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestAssociate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		reply []byte
+		relay string
+		fail  bool
+	}{
+		{"bind address", []byte{5, 0, 0, 1, 10, 0, 0, 1, 0x1f, 0x90}, "10.0.0.1:8080", false},
+		{"unspecified bind address", []byte{5, 0, 0, 1, 0, 0, 0, 0, 0x1f, 0x90}, "127.0.0.2:8080", false},
+		{"general failure", []byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0}, "", true},
+	} {
+		client, server := net.Pipe()
+		errCh := make(chan error, 1)
+		go func() {
+			defer server.Close()
+			auth := new(authReq)
+			if err := auth.Fulfill(server); err != nil || auth.VER != 5 {
+				errCh <- fmt.Errorf("method selection: %v, err: %v", auth, err)
+				return
+			}
+			if _, err := server.Write([]byte{5, 0}); err != nil {
+				errCh <- err
+				return
+			}
+
+			req := make([]byte, 10)
+			if _, err := io.ReadFull(server, req); err != nil || req[1] != 3 {
+				errCh <- fmt.Errorf("associate request: %v, err: %v", req, err)
+				return
+			}
+			// the failed client does not read the whole reply
+			errCh <- nil
+			_, _ = server.Write(tc.reply)
+		}()
+
+		ctrl := tcpConn{Conn: client, remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1080}}
+		conn, err := New().Associate(ctrl)
+		if err := <-errCh; err != nil {
+			t.Fatalf("%s: fake server: %s", tc.name, err)
+		}
+		if tc.fail {
+			client.Close()
+			if err == nil {
+				conn.Close()
+				t.Errorf("%s: should fail", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if conn.relay.String() != tc.relay {
+			t.Errorf("%s: unexpected relay address: %s", tc.name, conn.relay)
+		}
+		conn.Close()
+	}
+}
+
+func TestUDPConn(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	// echo the packets back with the header kept
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, addr, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = relay.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	udp, err := net.DialUDP("udp", nil, relay.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, _ := net.Pipe()
+	conn := &UDPConn{UDPConn: udp, ctrl: ctrl}
+	defer conn.Close()
+
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	if _, err := conn.WriteTo([]byte("query"), target); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "query" || addr.String() != target.String() {
+		t.Errorf("unexpected %s from %v, err: %v", buf[:n], addr, err)
+	}
+}
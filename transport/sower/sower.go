@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/binary"
+	"io"
 	"net"
 	"strconv"
 
@@ -15,7 +16,12 @@ const maxDomainLength = 253
 
 var headSize = binary.Size(new(Head))
 
-// action(>=0x80) + checksum + port + target + data
+const (
+	cmdConnect       byte = 0x80
+	cmdConnectClient byte = 0x81 // head followed by client id: len(1) + id
+)
+
+// action(>=0x80) + checksum + port + target + [client id] + data
 // data(HTTP, first byte < 0x7F)
 type Head struct {
 	Cmd      byte
@@ -31,8 +37,15 @@ func (h *Head) String() string {
 	return net.JoinHostPort(addr, strconv.Itoa(int(h.Port)))
 }
 
+// ClientAddr is the target address carrying the client identifier
+type ClientAddr struct {
+	*Head
+	Client string
+}
+
 type Sower struct {
 	password []byte
+	clientID string
 }
 
 func New(password string) *Sower {
@@ -41,6 +54,15 @@ func New(password string) *Sower {
 	}
 }
 
+// SetClientID set the client identifier sent in handshake, max 255 bytes
+func (s *Sower) SetClientID(id string) *Sower {
+	if len(id) > 255 {
+		id = id[:255]
+	}
+	s.clientID = id
+	return s
+}
+
 func (s *Sower) Unwrap(conn net.Conn) (net.Addr, error) {
 	buf := make([]byte, headSize)
 	if n, err := conn.Read(buf); err != nil || n != headSize {
@@ -50,7 +72,7 @@ func (s *Sower) Unwrap(conn net.Conn) (net.Addr, error) {
 	h := &Head{}
 	_ = binary.Read(bytes.NewReader(buf), binary.BigEndian, h)
 	switch h.Cmd {
-	case 0x80:
+	case cmdConnect, cmdConnectClient:
 	default:
 		return nil, errors.Errorf("invalid command: %d", h.Cmd)
 	}
@@ -59,19 +81,44 @@ func (s *Sower) Unwrap(conn net.Conn) (net.Addr, error) {
 		return nil, errors.New("auth fail")
 	}
 
-	return h, nil
+	if h.Cmd == cmdConnect {
+		return h, nil
+	}
+
+	idLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, idLen); err != nil {
+		return nil, errors.Wrap(err, "read client id length")
+	}
+	id := make([]byte, idLen[0])
+	if _, err := io.ReadFull(conn, id); err != nil {
+		return nil, errors.Wrap(err, "read client id")
+	}
+
+	return &ClientAddr{Head: h, Client: string(id)}, nil
 }
 
 func (s *Sower) Wrap(conn net.Conn, tgtHost string, tgtPort uint16) error {
 	tgtAddr := [maxDomainLength]byte{}
 	copy(tgtAddr[:len(tgtHost)], []byte(tgtHost))
 
-	return binary.Write(conn, binary.BigEndian, &Head{
-		Cmd:      0x80,
+	head := &Head{
+		Cmd:      cmdConnect,
 		Checksum: sumChecksum(tgtAddr, s.password),
 		Port:     tgtPort,
 		TgtAddr:  tgtAddr,
-	})
+	}
+	if s.clientID == "" {
+		return binary.Write(conn, binary.BigEndian, head)
+	}
+
+	head.Cmd = cmdConnectClient
+	buf := bytes.NewBuffer(make([]byte, 0, headSize+1+len(s.clientID)))
+	_ = binary.Write(buf, binary.BigEndian, head)
+	buf.WriteByte(byte(len(s.clientID)))
+	buf.WriteString(s.clientID)
+
+	_, err := conn.Write(buf.Bytes())
+	return err
 }
 
 func sumChecksum(target [maxDomainLength]byte, password []byte) uint64 {
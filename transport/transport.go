@@ -1,10 +1,27 @@
 package transport
 
 import (
+	"errors"
 	"net"
 )
 
+// ErrTarget is the failure of the target reported by the remote, eg: the
+// target refused the connection, which says nothing about the remote health
+var ErrTarget = errors.New("target unreachable through remote")
+
 type Transport interface {
 	Unwrap(conn net.Conn) (net.Addr, error)
 	Wrap(conn net.Conn, tgtHost string, tgtPort uint16) error
 }
+
+// ConnTransport is a transport which takes over the whole connection,
+// eg: the encrypted ones. The returned conn must be used afterwards.
+type ConnTransport interface {
+	WrapConn(conn net.Conn, tgtHost string, tgtPort uint16) (net.Conn, error)
+}
+
+// Wrapper wrap the underlaying connection before the proxy protocol,
+// eg: obfuscation. Wrappers are able to be stacked under any transport.
+type Wrapper interface {
+	Wrap(conn net.Conn) (net.Conn, error)
+}
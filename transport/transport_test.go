@@ -32,6 +32,12 @@ func Test_Transports(t *testing.T) {
 		t.Errorf("test sower, unexpected address: %s, err: %s", addr, err)
 	}
 
+	if addr, err := testPipe(newSower().SetClientID("laptop")); err != nil || strings.TrimSpace(addr.String()) != "sower:443" {
+		t.Errorf("test sower with client id, unexpected address: %s, err: %s", addr, err)
+	} else if addr.(*sower.ClientAddr).Client != "laptop" {
+		t.Errorf("test sower with client id, unexpected client: %s", addr.(*sower.ClientAddr).Client)
+	}
+
 	if addr, err := testPipe(newTrojan()); err != nil || strings.TrimSpace(addr.String()) != "sower:443" {
 		t.Errorf("test trojan, unexpected address: %s, err: %s", addr, err)
 	}
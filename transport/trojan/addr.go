@@ -0,0 +1,84 @@
+package trojan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// socksAddr is the address without trailing CRLF:
+// +------+----------+----------+
+// | ATYP | DST.ADDR | DST.PORT |
+// +------+----------+----------+
+// |  1   | Variable |    2     |
+// +------+----------+----------+
+type socksAddr struct {
+	host string
+	port uint16
+}
+
+func (*socksAddr) Network() string { return "tcp" }
+func (a *socksAddr) String() string {
+	return net.JoinHostPort(a.host, strconv.Itoa(int(a.port)))
+}
+
+func writeAddr(buf *bytes.Buffer, host string, port uint16) error {
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		buf.WriteByte(0x01)
+		buf.Write(ip.To4())
+	case ip != nil:
+		buf.WriteByte(0x04)
+		buf.Write(ip.To16())
+	case len(host) > 255:
+		return errors.New("target host too long")
+	default:
+		buf.WriteByte(0x03)
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	}
+	buf.Write([]byte{byte(port >> 8), byte(port)})
+	return nil
+}
+
+func readAddr(r io.Reader) (host string, port uint16, err error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+
+	var addr []byte
+	switch atyp[0] {
+	case 0x01:
+		addr = make([]byte, net.IPv4len)
+	case 0x04:
+		addr = make([]byte, net.IPv6len)
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", 0, err
+		}
+		addr = make([]byte, l[0])
+	default:
+		return "", 0, errors.New("invalid ATYP")
+	}
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+	if atyp[0] == 0x03 {
+		host = string(addr)
+	} else {
+		host = net.IP(addr).String()
+	}
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", 0, err
+	}
+	return host, binary.BigEndian.Uint16(buf), nil
+}
@@ -0,0 +1,69 @@
+package trojan
+
+import (
+	"bytes"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// trojan-go starts a smux session with CMD X'7F', and each stream starts
+// with a simplesocks request, which is trojan request without password:
+// +-----+------+----------+----------+
+// | CMD | ATYP | DST.ADDR | DST.PORT |
+// +-----+------+----------+----------+
+// |  1  |  1   | Variable |    2     |
+// +-----+------+----------+----------+
+const (
+	cmdMux  = 0x7f
+	muxHost = "MUX_CONN"
+)
+
+// MuxAddr is returned by Unwrap for the trojan-go mux requests
+type MuxAddr struct {
+	net.Addr
+}
+
+func (a *MuxAddr) Network() string { return "mux" }
+
+// WrapMux write the trojan request to start a trojan-go mux session
+func (t *Trojan) WrapMux(conn net.Conn) error {
+	return t.wrap(conn, cmdMux, muxHost, 0)
+}
+
+// SimpleSocks is the request of the streams in trojan-go mux session
+type SimpleSocks struct{}
+
+func (SimpleSocks) Wrap(conn net.Conn, tgtHost string, tgtPort uint16) error {
+	buf := bytes.NewBuffer(make([]byte, 0, 1+1+1+len(tgtHost)+2))
+	buf.WriteByte(cmdConnect)
+	if err := writeAddr(buf, tgtHost, tgtPort); err != nil {
+		return err
+	}
+
+	_, err := conn.Write(buf.Bytes())
+	return errors.WithStack(err)
+}
+
+func (SimpleSocks) Unwrap(conn net.Conn) (net.Addr, error) {
+	cmd := make([]byte, 1)
+	if _, err := io.ReadFull(conn, cmd); err != nil {
+		return nil, errors.Wrap(err, "read cmd")
+	}
+
+	host, port, err := readAddr(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "read addr")
+	}
+
+	addr := &socksAddr{host: host, port: port}
+	switch cmd[0] {
+	case cmdConnect:
+		return addr, nil
+	case cmdAssociate:
+		return &UDPAddr{Addr: addr}, nil
+	default:
+		return nil, errors.Errorf("invalid CMD: %d", cmd[0])
+	}
+}
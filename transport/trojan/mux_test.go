@@ -0,0 +1,54 @@
+package trojan
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMux(t *testing.T) {
+	tj := New("password")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		if err := tj.WrapMux(client); err != nil {
+			t.Error(err)
+			return
+		}
+		_ = (SimpleSocks{}).Wrap(client, "example.com", 443)
+	}()
+
+	addr, err := tj.Unwrap(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.Network() != "mux" {
+		t.Fatalf("expect mux, got %s", addr.Network())
+	}
+
+	if addr, err = (SimpleSocks{}).Unwrap(server); err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "example.com:443" {
+		t.Errorf("unexpected addr: %s", addr)
+	}
+}
+
+func TestLongHost(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	host := strings.Repeat("a", 256)
+	if err := (SimpleSocks{}).Wrap(client, host, 443); err == nil {
+		t.Error("simplesocks: expect host too long error")
+	}
+	if err := WritePacket(client, host, 53, nil); err == nil {
+		t.Error("packet: expect host too long error")
+	}
+	if err := New("password").Wrap(client, host, 443); err == nil {
+		t.Error("trojan: expect host too long error")
+	}
+}
@@ -25,6 +25,7 @@ import (
 // o  CMD
 //         o  CONNECT X'01'
 //         o  UDP ：X'03'
+//         o  MUX ：X'7F', trojan-go extension
 // o  ATYP
 //         o  IP V4 : X'01'
 //         o  domain: X'03'
@@ -126,28 +127,47 @@ func (t *Trojan) Unwrap(conn net.Conn) (net.Addr, error) {
 	}
 
 	head.CMD, head.ATYP = buf[58], buf[59]
+	if head.CMD != cmdConnect && head.CMD != cmdAssociate && head.CMD != cmdMux {
+		return nil, errors.Errorf("invalid CMD: %d", head.CMD)
+	}
+
+	var addr net.Addr
+	var err error
 	switch head.ATYP {
 	case 0x01: //ipv4
-		addr := &ipv4Addr{}
-		err := binary.Read(conn, binary.BigEndian, addr)
-		return addr, errors.Wrap(err, "read addr")
+		a := &ipv4Addr{}
+		addr, err = a, binary.Read(conn, binary.BigEndian, a)
 
 	case 0x04: //ipv6
-		addr := &ipv6Addr{}
-		err := binary.Read(conn, binary.BigEndian, addr)
-		return addr, errors.Wrap(err, "read addr")
+		a := &ipv6Addr{}
+		addr, err = a, binary.Read(conn, binary.BigEndian, a)
 
 	case 0x03: // domain
-		addr := &domain{}
-		err := addr.Fulfill(conn)
-		return addr, errors.Wrap(err, "read addr")
+		a := &domain{}
+		addr, err = a, a.Fulfill(conn)
 
 	default:
 		return nil, errors.New("invalid ATYP")
 	}
+
+	switch head.CMD {
+	case cmdAssociate:
+		addr = &UDPAddr{Addr: addr}
+	case cmdMux:
+		addr = &MuxAddr{Addr: addr}
+	}
+	return addr, errors.Wrap(err, "read addr")
 }
 
 func (t *Trojan) Wrap(conn net.Conn, tgtHost string, tgtPort uint16) error {
+	return t.wrap(conn, cmdConnect, tgtHost, tgtPort)
+}
+
+func (t *Trojan) wrap(conn net.Conn, cmd byte, tgtHost string, tgtPort uint16) error {
+	if len(tgtHost) > 255 {
+		return errors.New("target host too long")
+	}
+
 	buf := bytes.NewBuffer(make([]byte, 0, headLen+1+len(tgtHost)+4))
 	ip := net.ParseIP(tgtHost)
 	switch {
@@ -166,6 +186,7 @@ func (t *Trojan) Wrap(conn net.Conn, tgtHost string, tgtPort uint16) error {
 	}
 
 	buf.Write([]byte{byte(tgtPort >> 8), byte(tgtPort), 0x0D, 0x0A})
+	buf.Bytes()[len(t.headPasswd)+2] = cmd
 
 	if n, err := conn.Write(buf.Bytes()); err != nil || n != len(buf.Bytes()) {
 		return errors.Errorf("n: %d, err: %s", n, err)
@@ -0,0 +1,69 @@
+package trojan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// UDP packets after the trojan request with CMD X'03':
+// +------+----------+----------+--------+---------+----------+
+// | ATYP | DST.ADDR | DST.PORT | Length |  CRLF   | Payload  |
+// +------+----------+----------+--------+---------+----------+
+// |  1   | Variable |    2     |   2    | X'0D0A' | Variable |
+// +------+----------+----------+--------+---------+----------+
+
+const (
+	cmdConnect   = 0x01
+	cmdAssociate = 0x03
+)
+
+// UDPAddr is returned by Unwrap for the UDP associate requests
+type UDPAddr struct {
+	net.Addr
+}
+
+func (a *UDPAddr) Network() string { return "udp" }
+
+// WrapUDP write the trojan request with UDP associate command
+func (t *Trojan) WrapUDP(conn net.Conn, tgtHost string, tgtPort uint16) error {
+	return t.wrap(conn, cmdAssociate, tgtHost, tgtPort)
+}
+
+// WritePacket write a UDP packet to the trojan connection
+func WritePacket(w io.Writer, host string, port uint16, payload []byte) error {
+	if len(payload) > 0xFFFF {
+		return errors.New("payload too large")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1+1+len(host)+2+2+2+len(payload)))
+	if err := writeAddr(buf, host, port); err != nil {
+		return err
+	}
+	buf.Write([]byte{byte(len(payload) >> 8), byte(len(payload)), 0x0D, 0x0A})
+	buf.Write(payload)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ReadPacket read a UDP packet from the trojan connection
+func ReadPacket(r io.Reader) (host string, port uint16, payload []byte, err error) {
+	if host, port, err = readAddr(r); err != nil {
+		return "", 0, nil, err
+	}
+
+	buf := make([]byte, 4) // length + CRLF
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", 0, nil, err
+	}
+	payload = make([]byte, binary.BigEndian.Uint16(buf[:2]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", 0, nil, err
+	}
+
+	return host, port, payload, nil
+}
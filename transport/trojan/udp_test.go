@@ -0,0 +1,45 @@
+package trojan
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestUDP(t *testing.T) {
+	tj := New("password")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		if err := tj.WrapUDP(client, "0.0.0.0", 0); err != nil {
+			t.Error(err)
+			return
+		}
+		_ = WritePacket(client, "8.8.8.8", 53, []byte("query"))
+		_ = WritePacket(client, "example.com", 443, []byte("quic"))
+	}()
+
+	addr, err := tj.Unwrap(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.Network() != "udp" {
+		t.Fatalf("expect udp, got %s", addr.Network())
+	}
+
+	for _, want := range []struct {
+		host    string
+		port    uint16
+		payload string
+	}{{"8.8.8.8", 53, "query"}, {"example.com", 443, "quic"}} {
+		host, port, payload, err := ReadPacket(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host != want.host || port != want.port || !bytes.Equal(payload, []byte(want.payload)) {
+			t.Errorf("got %s:%d %q, want %s:%d %q", host, port, payload, want.host, want.port, want.payload)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package vmess
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+)
+
+const (
+	kdfSaltAuthIDEncryptionKey     = "AES Auth ID Encryption"
+	kdfSaltRespHeaderLenKey        = "AEAD Resp Header Len Key"
+	kdfSaltRespHeaderLenIV         = "AEAD Resp Header Len IV"
+	kdfSaltRespHeaderPayloadKey    = "AEAD Resp Header Key"
+	kdfSaltRespHeaderPayloadIV     = "AEAD Resp Header IV"
+	kdfSaltVMessAEADKDF            = "VMess AEAD KDF"
+	kdfSaltHeaderPayloadAEADKey    = "VMess Header AEAD Key"
+	kdfSaltHeaderPayloadAEADIV     = "VMess Header AEAD Nonce"
+	kdfSaltHeaderPayloadLenAEADKey = "VMess Header AEAD Key_Length"
+	kdfSaltHeaderPayloadLenAEADIV  = "VMess Header AEAD Nonce_Length"
+)
+
+// kdf is the nested HMAC-SHA256 key derivation of VMess AEAD
+func kdf(key []byte, path ...string) []byte {
+	newHash := func() hash.Hash { return hmac.New(sha256.New, []byte(kdfSaltVMessAEADKDF)) }
+	for _, p := range path {
+		parent, p := newHash, p
+		newHash = func() hash.Hash { return hmac.New(parent, []byte(p)) }
+	}
+
+	h := newHash()
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+func kdf16(key []byte, path ...string) []byte {
+	return kdf(key, path...)[:16]
+}
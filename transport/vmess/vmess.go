@@ -0,0 +1,334 @@
+package vmess
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/sha3"
+)
+
+// https://github.com/v2fly/v2fly-github-io/blob/master/docs/developer/protocols/vmess.md
+// Only the AEAD header (alterId=0) with AES-128-GCM body is implemented.
+const (
+	version      = 1
+	optChunk     = 0x01 // chunk stream
+	optMasking   = 0x04 // chunk length masking
+	secAES128GCM = 0x03
+	cmdTCP       = 0x01
+	maxChunkSize = 1 << 14
+)
+
+type VMess struct {
+	cmdKey []byte
+}
+
+func New(uuid string) (*VMess, error) {
+	id, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", ""))
+	if err != nil || len(id) != 16 {
+		return nil, errors.Errorf("invalid uuid: %s", uuid)
+	}
+
+	cmdKey := md5.Sum(append(id, "c48619fe-8f02-49e0-b9e9-edf763e17e21"...))
+	return &VMess{cmdKey: cmdKey[:]}, nil
+}
+
+func (v *VMess) WrapConn(conn net.Conn, tgtHost string, tgtPort uint16) (net.Conn, error) {
+	if len(tgtHost) > 255 {
+		return nil, errors.New("target host too long")
+	}
+
+	c := &Conn{Conn: conn}
+	if _, err := rand.Read(c.reqKey[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(c.reqIV[:]); err != nil {
+		return nil, err
+	}
+	respKey, respIV := sha256.Sum256(c.reqKey[:]), sha256.Sum256(c.reqIV[:])
+	copy(c.respKey[:], respKey[:16])
+	copy(c.respIV[:], respIV[:16])
+	if _, err := rand.Read(c.respV[:]); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if c.writer, err = newChunkWriter(conn, c.reqKey[:], c.reqIV[:]); err != nil {
+		return nil, err
+	}
+
+	header, err := v.sealHeader(c.requestHeader(tgtHost, tgtPort))
+	if err != nil {
+		return nil, errors.Wrap(err, "seal header")
+	}
+	if _, err := conn.Write(header); err != nil {
+		return nil, errors.Wrap(err, "write header")
+	}
+	return c, nil
+}
+
+// authID: AES(timestamp + random + crc32)
+func (v *VMess) authID() ([]byte, error) {
+	plain := make([]byte, 16)
+	binary.BigEndian.PutUint64(plain, uint64(time.Now().Unix()))
+	if _, err := rand.Read(plain[8:12]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(plain[12:], crc32.ChecksumIEEE(plain[:12]))
+
+	block, err := aes.NewCipher(kdf16(v.cmdKey, kdfSaltAuthIDEncryptionKey))
+	if err != nil {
+		return nil, err
+	}
+	authID := make([]byte, 16)
+	block.Encrypt(authID, plain)
+	return authID, nil
+}
+
+// sealHeader: authID + sealed length + nonce + sealed header
+func (v *VMess) sealHeader(header []byte) ([]byte, error) {
+	authID, err := v.authID()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	lenAEAD, err := newGCM(kdf16(v.cmdKey, kdfSaltHeaderPayloadLenAEADKey, string(authID), string(nonce)))
+	if err != nil {
+		return nil, err
+	}
+	headerAEAD, err := newGCM(kdf16(v.cmdKey, kdfSaltHeaderPayloadAEADKey, string(authID), string(nonce)))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := append([]byte{}, authID...)
+	buf = lenAEAD.Seal(buf, kdf(v.cmdKey, kdfSaltHeaderPayloadLenAEADIV, string(authID), string(nonce))[:12],
+		[]byte{byte(len(header) >> 8), byte(len(header))}, authID)
+	buf = append(buf, nonce...)
+	buf = headerAEAD.Seal(buf, kdf(v.cmdKey, kdfSaltHeaderPayloadAEADIV, string(authID), string(nonce))[:12],
+		header, authID)
+	return buf, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Conn is a VMess connection, the response header is read on the first Read
+type Conn struct {
+	net.Conn
+
+	reqKey, reqIV, respKey, respIV [16]byte
+	respV                          [1]byte
+
+	writer *chunkWriter
+	reader *chunkReader
+}
+
+func (c *Conn) NetConn() net.Conn { return c.Conn }
+
+func (c *Conn) requestHeader(host string, port uint16) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 64+len(host)))
+	buf.WriteByte(version)
+	buf.Write(c.reqIV[:])
+	buf.Write(c.reqKey[:])
+	buf.WriteByte(c.respV[0])
+	buf.WriteByte(optChunk | optMasking)
+	buf.WriteByte(secAES128GCM) // no padding
+	buf.WriteByte(0)            // reserved
+	buf.WriteByte(cmdTCP)
+	buf.Write([]byte{byte(port >> 8), byte(port)})
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		buf.WriteByte(0x01)
+		buf.Write(ip.To4())
+	case ip != nil:
+		buf.WriteByte(0x03)
+		buf.Write(ip.To16())
+	default:
+		buf.WriteByte(0x02)
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	}
+
+	h := fnv.New32a()
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+	return buf.Bytes()
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.writer.Write(b)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.reader == nil {
+		if err := c.readResponseHeader(); err != nil {
+			return 0, errors.Wrap(err, "read response header")
+		}
+
+		var err error
+		if c.reader, err = newChunkReader(c.Conn, c.respKey[:], c.respIV[:]); err != nil {
+			return 0, err
+		}
+	}
+	return c.reader.Read(b)
+}
+
+func (c *Conn) readResponseHeader() error {
+	lenAEAD, err := newGCM(kdf16(c.respKey[:], kdfSaltRespHeaderLenKey))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 2+lenAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	lenBuf, err := lenAEAD.Open(nil, kdf(c.respIV[:], kdfSaltRespHeaderLenIV)[:12], buf, nil)
+	if err != nil {
+		return err
+	}
+
+	headerAEAD, err := newGCM(kdf16(c.respKey[:], kdfSaltRespHeaderPayloadKey))
+	if err != nil {
+		return err
+	}
+	buf = make([]byte, int(binary.BigEndian.Uint16(lenBuf))+headerAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	header, err := headerAEAD.Open(nil, kdf(c.respIV[:], kdfSaltRespHeaderPayloadIV)[:12], buf, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(header) < 4 || header[0] != c.respV[0] {
+		return errors.New("unexpected response header")
+	}
+	return nil
+}
+
+// chunk: masked length(2) + AES-128-GCM sealed payload
+type chunkWriter struct {
+	io.Writer
+	aead  cipher.AEAD
+	iv    []byte
+	count uint16
+	mask  sha3.ShakeHash
+}
+
+func newChunkWriter(w io.Writer, key, iv []byte) (*chunkWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	mask := sha3.NewShake128()
+	mask.Write(iv)
+	return &chunkWriter{Writer: w, aead: aead, iv: iv, mask: mask}, nil
+}
+
+func (w *chunkWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		size := len(b)
+		if size > maxChunkSize {
+			size = maxChunkSize
+		}
+
+		buf := make([]byte, 2, 2+size+w.aead.Overhead())
+		buf = w.aead.Seal(buf, nonce(w.count, w.iv), b[:size], nil)
+		w.count++
+		binary.BigEndian.PutUint16(buf, uint16(len(buf)-2)^nextMask(w.mask))
+		if _, err := w.Writer.Write(buf); err != nil {
+			return n, err
+		}
+
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+type chunkReader struct {
+	io.Reader
+	aead  cipher.AEAD
+	iv    []byte
+	count uint16
+	mask  sha3.ShakeHash
+	plain []byte
+}
+
+func newChunkReader(r io.Reader, key, iv []byte) (*chunkReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	mask := sha3.NewShake128()
+	mask.Write(iv)
+	return &chunkReader{Reader: r, aead: aead, iv: iv, mask: mask}, nil
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if len(r.plain) == 0 {
+		lenBuf := make([]byte, 2)
+		if _, err := io.ReadFull(r.Reader, lenBuf); err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint16(lenBuf) ^ nextMask(r.mask))
+		if size < r.aead.Overhead() {
+			return 0, errors.Errorf("invalid chunk size: %d", size)
+		}
+		if size == r.aead.Overhead() { // empty chunk marks the end
+			return 0, io.EOF
+		}
+
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r.Reader, buf); err != nil {
+			return 0, err
+		}
+		plain, err := r.aead.Open(buf[:0], nonce(r.count, r.iv), buf, nil)
+		if err != nil {
+			return 0, errors.Wrap(err, "open chunk")
+		}
+		r.count++
+		r.plain = plain
+	}
+
+	n := copy(b, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func nonce(count uint16, iv []byte) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint16(n, count)
+	copy(n[2:], iv[2:12])
+	return n
+}
+
+func nextMask(shake sha3.ShakeHash) uint16 {
+	buf := make([]byte, 2)
+	_, _ = shake.Read(buf)
+	return binary.BigEndian.Uint16(buf)
+}
@@ -0,0 +1,106 @@
+package vmess
+
+import (
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestVMess_WrapConn(t *testing.T) {
+	v, err := New("b831381d-6324-4d53-ad4f-8cda48b30811")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer client.Close()
+		conn, err := v.WrapConn(client, "sower", 443)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Write([]byte("ping"))
+
+		resp := make([]byte, 4)
+		if _, err := io.ReadFull(conn, resp); err != nil || string(resp) != "pong" {
+			t.Errorf("unexpected response: %s, err: %v", resp, err)
+		}
+	}()
+
+	// 1. auth id
+	authID := make([]byte, 16)
+	io.ReadFull(server, authID)
+	block, _ := aes.NewCipher(kdf16(v.cmdKey, kdfSaltAuthIDEncryptionKey))
+	plain := make([]byte, 16)
+	block.Decrypt(plain, authID)
+	if crc32.ChecksumIEEE(plain[:12]) != binary.BigEndian.Uint32(plain[12:]) {
+		t.Fatal("invalid auth id checksum")
+	}
+
+	// 2. header
+	sealedLen := make([]byte, 18)
+	nonce := make([]byte, 8)
+	io.ReadFull(server, sealedLen)
+	io.ReadFull(server, nonce)
+	lenAEAD, _ := newGCM(kdf16(v.cmdKey, kdfSaltHeaderPayloadLenAEADKey, string(authID), string(nonce)))
+	lenBuf, err := lenAEAD.Open(nil, kdf(v.cmdKey, kdfSaltHeaderPayloadLenAEADIV, string(authID), string(nonce))[:12], sealedLen, authID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedHeader := make([]byte, int(binary.BigEndian.Uint16(lenBuf))+16)
+	io.ReadFull(server, sealedHeader)
+	headerAEAD, _ := newGCM(kdf16(v.cmdKey, kdfSaltHeaderPayloadAEADKey, string(authID), string(nonce)))
+	header, err := headerAEAD.Open(nil, kdf(v.cmdKey, kdfSaltHeaderPayloadAEADIV, string(authID), string(nonce))[:12], sealedHeader, authID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqIV, reqKey, respV := header[1:17], header[17:33], header[33]
+	if port := binary.BigEndian.Uint16(header[38:40]); port != 443 || header[40] != 0x02 ||
+		string(header[42:42+int(header[41])]) != "sower" {
+		t.Fatalf("unexpected target in header: %v", header)
+	}
+
+	// 3. request body
+	reader, _ := newChunkReader(server, reqKey, reqIV)
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(reader, req); err != nil || string(req) != "ping" {
+		t.Fatalf("unexpected request: %s, err: %v", req, err)
+	}
+
+	// 4. response
+	respKey, respIV := sha256.Sum256(reqKey), sha256.Sum256(reqIV)
+	respHeader := []byte{respV, 0, 0, 0}
+	lenAEAD, _ = newGCM(kdf16(respKey[:16], kdfSaltRespHeaderLenKey))
+	headerAEAD, _ = newGCM(kdf16(respKey[:16], kdfSaltRespHeaderPayloadKey))
+	buf := lenAEAD.Seal(nil, kdf(respIV[:16], kdfSaltRespHeaderLenIV)[:12], []byte{0, byte(len(respHeader))}, nil)
+	buf = headerAEAD.Seal(buf, kdf(respIV[:16], kdfSaltRespHeaderPayloadIV)[:12], respHeader, nil)
+	server.Write(buf)
+
+	writer, _ := newChunkWriter(server, respKey[:16], respIV[:16])
+	writer.Write([]byte("pong"))
+	<-done
+}
+
+func TestVMess_LongHost(t *testing.T) {
+	v, err := New("b831381d-6324-4d53-ad4f-8cda48b30811")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, err := v.WrapConn(client, strings.Repeat("a", 256), 443); err == nil {
+		t.Error("expect host too long error")
+	}
+}